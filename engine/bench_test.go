@@ -113,6 +113,30 @@ func BenchmarkSingleQuery(b *testing.B) {
 	}
 }
 
+func BenchmarkVectorScalarArithmetic(b *testing.B) {
+	// 100k series per step.
+	test := setupStorage(b, 50000, 2, 10)
+	defer test.Close()
+
+	start := time.Unix(0, 0)
+	end := start.Add(5 * time.Minute)
+	step := time.Second * 30
+
+	opts := engine.Opts{
+		EngineOpts:        promql.EngineOpts{Timeout: 100 * time.Second},
+		SelectorBatchSize: 256,
+	}
+	for _, query := range []string{`http_requests_total * 2`, `2 * http_requests_total`, `http_requests_total > bool 2`} {
+		b.Run(query, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				result := executeRangeQuery(b, query, test, start, end, step, opts)
+				testutil.Ok(b, result.Err)
+			}
+		})
+	}
+}
+
 func BenchmarkRangeQuery(b *testing.B) {
 	samplesPerHour := 60 * 2
 	sixHourDataset := setupStorage(b, 1000, 3, 6*samplesPerHour)
@@ -239,6 +263,11 @@ func BenchmarkRangeQuery(b *testing.B) {
 			query:   `-http_requests_total`,
 			storage: sixHourDataset,
 		},
+		{
+			name:    "unary negation as binary operation",
+			query:   `0 - http_requests_total`,
+			storage: sixHourDataset,
+		},
 		{
 			name:    "vector and scalar comparison",
 			query:   `http_requests_total > 10`,
@@ -259,6 +288,26 @@ func BenchmarkRangeQuery(b *testing.B) {
 			query:   `http_requests_total @ 600.000 offset 5m`,
 			storage: sixHourDataset,
 		},
+		{
+			name:    "abs",
+			query:   `abs(http_requests_total)`,
+			storage: sixHourDataset,
+		},
+		{
+			name:    "ceil",
+			query:   `ceil(http_requests_total)`,
+			storage: sixHourDataset,
+		},
+		{
+			name:    "vector",
+			query:   `vector(time())`,
+			storage: sixHourDataset,
+		},
+		{
+			name:    "scalar of empty vector",
+			query:   `scalar(nonexistent)`,
+			storage: sixHourDataset,
+		},
 		{
 			name:    "clamp",
 			query:   `clamp(http_requests_total, 5, 10)`,
@@ -547,6 +596,10 @@ func BenchmarkNativeHistograms(b *testing.B) {
 			name:  "histogram_stddev",
 			query: `histogram_stddev(native_histogram_series)`,
 		},
+		{
+			name:  "histogram_stddev step invariant",
+			query: `histogram_stddev(native_histogram_series @ start())`,
+		},
 	}
 
 	opts := promql.EngineOpts{
@@ -74,6 +74,11 @@ type Opts struct {
 	// This will default to false.
 	EnableXFunctions bool
 
+	// EnableExtendedFunctions enables additional arguments of upstream functions, like the scaling factor
+	// of histogram_sum. Queries using them are not valid PromQL, so they fail in Prometheus and in remote
+	// engines which do not enable them either. This will default to false.
+	EnableExtendedFunctions bool
+
 	// EnableAnalysis enables query analysis.
 	EnableAnalysis bool
 
@@ -81,6 +86,104 @@ type Opts struct {
 	// This check can produce false positives when querying time-series data which does not conform to the Prometheus data model,
 	// and can be disabled if it leads to false positives.
 	DisableDuplicateLabelChecks bool
+
+	// AbsentLabelsLookback enables enriching the series synthesized by absent() with labels observed
+	// in this window before the query start. Only labels which have the same value across all observed
+	// series are added; labels which differ between them, like instance, or which only some of them have
+	// are not. When zero, absent() only uses labels from equality matchers, like Prometheus does.
+	AbsentLabelsLookback time.Duration
+
+	// MaxHistogramBuckets caps the number of buckets of native histograms produced by binary operations.
+	// Results exceeding the cap have their resolution reduced until they fit. Disabled when zero.
+	MaxHistogramBuckets int
+
+	// EnableExperimentalFunctions enables experimental aggregations like limitk and limit_ratio.
+	// They are also enabled for queries and plans created while parser.EnableExperimentalFunctions is set,
+	// which is read for every query. Queries parsed from a string additionally need the parser setting.
+	EnableExperimentalFunctions bool
+
+	// EnableHistogramSchemaReducedInfo adds an info annotation when adding or subtracting native histograms
+	// required downscaling one of them to a common schema. Prometheus does not return this annotation.
+	EnableHistogramSchemaReducedInfo bool
+
+	// SortOrSeries orders the output series of "or" operations by their label hash instead of
+	// by the order of the operands. This gives a deterministic order which does not depend on the engine version.
+	SortOrSeries bool
+
+	// HistogramEqualityTolerance is the relative tolerance used when comparing native histograms with == and !=.
+	// Histograms are equal if their bucket layouts match and their sums and counts differ by at most this tolerance.
+	// When set, results deviate from Prometheus which always compares histograms exactly. Defaults to exact comparison.
+	HistogramEqualityTolerance float64
+
+	// KeepNaNComparisons makes comparison operators keep samples when either operand is NaN,
+	// or return 1 when the bool modifier is used. This can help to find NaN values when debugging data quality.
+	// When set, results deviate from Prometheus where comparisons involving NaN are always false.
+	KeepNaNComparisons bool
+
+	// NestedLoopJoinThreshold is the maximum number of series on the low-card side of a binary operation,
+	// i.e. the "one" side of a group_left/group_right match or the right-hand side otherwise, for which
+	// series are matched with a nested loop instead of hash tables. This saves the memory of the hash tables
+	// when one side only has a few series. Defaults to 0, which always uses hash tables.
+	NestedLoopJoinThreshold int
+
+	// OperatorTimeBudget is a soft limit on the time an operator can spend in Next, excluding the time spent
+	// in its children. Operators exceeding it add an info annotation to the query result but keep executing.
+	// This helps to find slow operators without failing queries. Disabled when zero.
+	OperatorTimeBudget time.Duration
+
+	// DropNaNInSetOps makes "and" and "or" operations treat NaN samples of both operands as missing.
+	// NaN samples are then dropped from the result and do not match samples of the other operand.
+	// When set, results deviate from Prometheus where set operations do not inspect sample values.
+	DropNaNInSetOps bool
+
+	// RoundSignificantDigits rounds the float samples of query results to the given number of significant digits.
+	// This can be used to mask floating point differences when comparing results with other engines.
+	// Histograms are not rounded. Disabled when zero.
+	RoundSignificantDigits int
+
+	// MaxOrSeries is the maximum combined number of series of both operands of an "or" operation.
+	// Both operands of "or" are resolved before any step is evaluated, so operations between two large
+	// selectors hold the series of both in memory. Queries exceeding the limit fail. Disabled when zero.
+	MaxOrSeries int
+
+	// PermissiveManyToOne keeps a single match of one-to-one binary operations which match multiple series,
+	// and reports it with an annotation instead of failing the query. This can be useful for ad-hoc exploration.
+	// The kept match is the matching series with the lowest labels in the step, so the kept match does not
+	// depend on the order in which series are selected. When set, results deviate from Prometheus which
+	// fails such queries.
+	PermissiveManyToOne bool
+
+	// SkipManyToManyMatches leaves out the matching groups of binary operations which match multiple series on
+	// the side which needs to be unique, and reports them with an annotation instead of failing the query.
+	// The remaining matching groups are still evaluated, so the result is partial. This can be useful for
+	// dashboards where a single bad match should not fail the whole panel. When set, results deviate from
+	// Prometheus which fails such queries.
+	SkipManyToManyMatches bool
+
+	// MaxAnnotations is the maximum number of distinct annotations retained for a query. Queries touching many
+	// series can produce one annotation per series, which can grow large. Once the limit is reached, further
+	// annotations are dropped and replaced by a single warning. Disabled when zero.
+	MaxAnnotations int
+
+	// ValidateSeriesIDs makes binary operations verify that every output series they produce was registered
+	// when their join tables were built, and fail the query with an internal error otherwise. Without it, such
+	// bugs silently attribute samples to the wrong series. This adds a check for each output sample and is
+	// meant to be used in tests.
+	ValidateSeriesIDs bool
+
+	// MaxOperandGoroutines is the maximum number of goroutines a query uses to read the operands of binary
+	// operations concurrently. Deeply nested binary operations start one goroutine for each of them, so
+	// the number of goroutines grows with the size of the query. When the limit is reached, operands are
+	// read one after the other instead. The peak number of goroutines is reported in the telemetry of
+	// binary operators when analysis is enabled. Disabled when zero.
+	MaxOperandGoroutines int
+
+	// EnableSharedSubexpressions creates the operators of subtrees which occur more than once in a query,
+	// like rate(x[5m]) in rate(x[5m]) / sum(rate(x[5m])), only once and shares their output between all
+	// occurrences. This avoids evaluating the same subtree multiple times, but batches of a shared operator
+	// are buffered until every occurrence has read them, so occurrences which are read at a different pace
+	// can increase the memory usage of a query.
+	EnableSharedSubexpressions bool
 }
 
 // QueryOpts implements promql.QueryOpts but allows to override more engine default options.
@@ -98,6 +201,10 @@ type QueryOpts struct {
 
 	// LogicalOptimizers can be used to override the LogicalOptimizers engine setting.
 	LogicalOptimizers []logicalplan.Optimizer
+
+	// Recorder can be used to capture the intermediate results of subexpressions for debugging.
+	// See tap.Buffer for an in-memory implementation.
+	Recorder query.Recorder
 }
 
 func (opts QueryOpts) LookbackDelta() time.Duration { return opts.LookbackDeltaParam }
@@ -144,6 +251,9 @@ func NewWithScanners(opts Opts, scanners engstorage.Scanners) *Engine {
 
 	functions := make(map[string]*parser.Function, len(parser.Functions))
 	maps.Copy(functions, parser.Functions)
+	if opts.EnableExtendedFunctions {
+		maps.Copy(functions, parse.ExtendedFunctions)
+	}
 	if opts.EnableXFunctions {
 		maps.Copy(functions, parse.XFunctions)
 	}
@@ -196,8 +306,27 @@ func NewWithScanners(opts Opts, scanners engstorage.Scanners) *Engine {
 		noStepSubqueryIntervalFn: func(d time.Duration) time.Duration {
 			return time.Duration(opts.NoStepSubqueryIntervalFn(d.Milliseconds()) * 1000000)
 		},
-		decodingConcurrency: decodingConcurrency,
-		selectorBatchSize:   selectorBatchSize,
+		decodingConcurrency:         decodingConcurrency,
+		selectorBatchSize:           selectorBatchSize,
+		absentLabelsLookback:        opts.AbsentLabelsLookback,
+		maxHistogramBuckets:         opts.MaxHistogramBuckets,
+		enableExperimentalFunctions: opts.EnableExperimentalFunctions,
+		sortOrSeries:                opts.SortOrSeries,
+		enableSchemaReducedInfo:     opts.EnableHistogramSchemaReducedInfo,
+		enableDelayedNameRemoval:    opts.EnableDelayedNameRemoval,
+		histogramEqualityTolerance:  opts.HistogramEqualityTolerance,
+		keepNaNComparisons:          opts.KeepNaNComparisons,
+		nestedLoopJoinThreshold:     opts.NestedLoopJoinThreshold,
+		operatorTimeBudget:          opts.OperatorTimeBudget,
+		dropNaNInSetOps:             opts.DropNaNInSetOps,
+		roundSignificantDigits:      opts.RoundSignificantDigits,
+		maxOrSeries:                 opts.MaxOrSeries,
+		permissiveManyToOne:         opts.PermissiveManyToOne,
+		skipManyToManyMatches:       opts.SkipManyToManyMatches,
+		maxAnnotations:              opts.MaxAnnotations,
+		validateSeriesIDs:           opts.ValidateSeriesIDs,
+		maxOperandGoroutines:        opts.MaxOperandGoroutines,
+		enableSharedSubexpressions:  opts.EnableSharedSubexpressions,
 	}
 }
 
@@ -222,11 +351,30 @@ type Engine struct {
 	timeout            time.Duration
 	metrics            *engineMetrics
 
-	extLookbackDelta         time.Duration
-	decodingConcurrency      int
-	selectorBatchSize        int64
-	enableAnalysis           bool
-	noStepSubqueryIntervalFn func(time.Duration) time.Duration
+	extLookbackDelta            time.Duration
+	decodingConcurrency         int
+	selectorBatchSize           int64
+	enableAnalysis              bool
+	noStepSubqueryIntervalFn    func(time.Duration) time.Duration
+	absentLabelsLookback        time.Duration
+	maxHistogramBuckets         int
+	enableExperimentalFunctions bool
+	sortOrSeries                bool
+	enableSchemaReducedInfo     bool
+	enableDelayedNameRemoval    bool
+	histogramEqualityTolerance  float64
+	keepNaNComparisons          bool
+	nestedLoopJoinThreshold     int
+	operatorTimeBudget          time.Duration
+	dropNaNInSetOps             bool
+	roundSignificantDigits      int
+	maxOrSeries                 int
+	permissiveManyToOne         bool
+	skipManyToManyMatches       bool
+	maxAnnotations              int
+	validateSeriesIDs           bool
+	maxOperandGoroutines        int
+	enableSharedSubexpressions  bool
 }
 
 func (e *Engine) MakeInstantQuery(ctx context.Context, q storage.Queryable, opts *QueryOpts, qs string, ts time.Time) (promql.Query, error) {
@@ -259,7 +407,7 @@ func (e *Engine) MakeInstantQuery(ctx context.Context, q storage.Queryable, opts
 	}
 	optimizedPlan, warns := initialPlan.Optimize(e.getLogicalOptimizers(opts))
 
-	ctx = warnings.NewContext(ctx)
+	ctx = warnings.NewContextWithLimit(ctx, e.maxAnnotations)
 	defer func() { warns.Merge(warnings.FromContext(ctx)) }()
 
 	scanners, err := e.storageScanners(q, qOpts, optimizedPlan)
@@ -300,7 +448,7 @@ func (e *Engine) MakeInstantQueryFromPlan(ctx context.Context, q storage.Queryab
 	}
 	lplan, warns := logicalplan.New(root, qOpts, planOpts).Optimize(e.getLogicalOptimizers(opts))
 
-	ctx = warnings.NewContext(ctx)
+	ctx = warnings.NewContextWithLimit(ctx, e.maxAnnotations)
 	defer func() { warns.Merge(warnings.FromContext(ctx)) }()
 
 	scnrs, err := e.storageScanners(q, qOpts, lplan)
@@ -357,7 +505,7 @@ func (e *Engine) MakeRangeQuery(ctx context.Context, q storage.Queryable, opts *
 	}
 	optimizedPlan, warns := initialPlan.Optimize(e.getLogicalOptimizers(opts))
 
-	ctx = warnings.NewContext(ctx)
+	ctx = warnings.NewContextWithLimit(ctx, e.maxAnnotations)
 	defer func() { warns.Merge(warnings.FromContext(ctx)) }()
 
 	scnrs, err := e.storageScanners(q, qOpts, optimizedPlan)
@@ -402,7 +550,7 @@ func (e *Engine) MakeRangeQueryFromPlan(ctx context.Context, q storage.Queryable
 		return nil, errors.Wrap(err, "creating storage scanners")
 	}
 
-	ctx = warnings.NewContext(ctx)
+	ctx = warnings.NewContextWithLimit(ctx, e.maxAnnotations)
 	defer func() { warns.Merge(warnings.FromContext(ctx)) }()
 	exec, err := execution.New(ctx, lplan.Root(), scnrs, qOpts)
 	if err != nil {
@@ -434,16 +582,34 @@ func (e *Engine) NewRangeQuery(ctx context.Context, q storage.Queryable, opts pr
 
 func (e *Engine) makeQueryOpts(start time.Time, end time.Time, step time.Duration, opts *QueryOpts) *query.Options {
 	res := &query.Options{
-		Start:                    start,
-		End:                      end,
-		Step:                     step,
-		StepsBatch:               stepsBatch,
-		LookbackDelta:            e.lookbackDelta,
-		EnablePerStepStats:       e.enablePerStepStats,
-		ExtLookbackDelta:         e.extLookbackDelta,
-		EnableAnalysis:           e.enableAnalysis,
-		NoStepSubqueryIntervalFn: e.noStepSubqueryIntervalFn,
-		DecodingConcurrency:      e.decodingConcurrency,
+		Start:                       start,
+		End:                         end,
+		Step:                        step,
+		StepsBatch:                  stepsBatch,
+		LookbackDelta:               e.lookbackDelta,
+		EnablePerStepStats:          e.enablePerStepStats,
+		ExtLookbackDelta:            e.extLookbackDelta,
+		EnableAnalysis:              e.enableAnalysis,
+		NoStepSubqueryIntervalFn:    e.noStepSubqueryIntervalFn,
+		DecodingConcurrency:         e.decodingConcurrency,
+		AbsentLabelsLookback:        e.absentLabelsLookback,
+		MaxHistogramBuckets:         e.maxHistogramBuckets,
+		EnableExperimentalFunctions: e.enableExperimentalFunctions || parser.EnableExperimentalFunctions,
+		SortOrSeries:                e.sortOrSeries,
+		EnableSchemaReducedInfo:     e.enableSchemaReducedInfo,
+		EnableDelayedNameRemoval:    e.enableDelayedNameRemoval,
+		HistogramEqualityTolerance:  e.histogramEqualityTolerance,
+		KeepNaNComparisons:          e.keepNaNComparisons,
+		NestedLoopJoinThreshold:     e.nestedLoopJoinThreshold,
+		OperatorTimeBudget:          e.operatorTimeBudget,
+		DropNaNInSetOps:             e.dropNaNInSetOps,
+		RoundSignificantDigits:      e.roundSignificantDigits,
+		MaxOrSeries:                 e.maxOrSeries,
+		PermissiveManyToOne:         e.permissiveManyToOne,
+		SkipManyToManyMatches:       e.skipManyToManyMatches,
+		ValidateSeriesIDs:           e.validateSeriesIDs,
+		Goroutines:                  query.NewGoroutinePool(e.maxOperandGoroutines),
+		EnableSharedSubexpressions:  e.enableSharedSubexpressions,
 	}
 	if opts == nil {
 		return res
@@ -459,6 +625,9 @@ func (e *Engine) makeQueryOpts(start time.Time, end time.Time, step time.Duratio
 	if opts.DecodingConcurrency != 0 {
 		res.DecodingConcurrency = opts.DecodingConcurrency
 	}
+	if opts.Recorder != nil {
+		res.Recorder = opts.Recorder
+	}
 
 	return res
 }
@@ -489,6 +658,37 @@ type Query struct {
 	opts *query.Options
 }
 
+// EstimateMemory returns an estimate of the bytes which the operators of the query need to hold
+// one batch of steps each. It can be called before the query is executed, and does not require
+// analysis to be enabled, which allows rejecting expensive queries up front. The output series
+// of all operators are loaded for the estimate, but they are reused when the query is executed.
+// Samples are assumed to be floats since histograms are only known once samples are read.
+func (q *Query) EstimateMemory(ctx context.Context) (int64, error) {
+	return estimateMemory(ctx, q.exec, q.opts.NumStepsPerBatch(), make(map[model.VectorOperator]struct{}))
+}
+
+func estimateMemory(ctx context.Context, op model.VectorOperator, steps int, seen map[model.VectorOperator]struct{}) (int64, error) {
+	// Operators whose output is shared between subexpressions only hold it once.
+	if _, ok := seen[op]; ok {
+		return 0, nil
+	}
+	seen[op] = struct{}{}
+
+	series, err := op.Series(ctx)
+	if err != nil {
+		return 0, err
+	}
+	total := telemetry.EstimateMemory(len(series), steps, false)
+	for _, child := range op.Explain() {
+		childMemory, err := estimateMemory(ctx, child, steps, seen)
+		if err != nil {
+			return 0, err
+		}
+		total += childMemory
+	}
+	return total, nil
+}
+
 // Explain returns human-readable explanation of the created executor.
 func (q *Query) Explain() *ExplainOutputNode {
 	// TODO(bwplotka): Explain plan and steps.
@@ -497,7 +697,7 @@ func (q *Query) Explain() *ExplainOutputNode {
 
 func (q *Query) Analyze() *AnalyzeOutputNode {
 	if observableRoot, ok := q.exec.(telemetry.ObservableVectorOperator); ok {
-		return analyzeQuery(observableRoot)
+		return analyzeQuery(observableRoot, make(map[telemetry.ObservableVectorOperator]struct{}))
 	}
 	return nil
 }
@@ -523,7 +723,7 @@ func (q *compatibilityQuery) Exec(ctx context.Context) (ret *promql.Result) {
 	}
 	defer q.engine.activeQueryTracker.Delete(idx)
 
-	ctx = warnings.NewContext(ctx)
+	ctx = warnings.NewContextWithLimit(ctx, q.engine.maxAnnotations)
 	warnings.MergeToContext(q.warns, ctx)
 
 	// Handle case with strings early on as this does not need us to process samples.
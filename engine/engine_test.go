@@ -23,6 +23,7 @@ import (
 
 	"github.com/thanos-io/promql-engine/engine"
 	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/tap"
 	"github.com/thanos-io/promql-engine/extlabels"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
@@ -85,7 +86,11 @@ func TestPromqlAcceptance(t *testing.T) {
 			MaxSamples:               5e10,
 			Timeout:                  1 * time.Hour,
 			NoStepSubqueryIntervalFn: func(rangeMillis int64) int64 { return 30 * time.Second.Milliseconds() },
-		}})
+			// The acceptance tests expect the annotations of Prometheus with delayed name removal.
+			EnableDelayedNameRemoval: true,
+		},
+		ValidateSeriesIDs: true,
+	})
 
 	st := &skipTest{
 		skipTests: []string{
@@ -102,6 +107,45 @@ func TestPromqlAcceptance(t *testing.T) {
 	promqltest.RunBuiltinTests(st, engine)
 }
 
+func TestExperimentalFunctionsInPlans(t *testing.T) {
+	// Plans bypass the parser, so experimental functions are gated by the engine option only.
+	// The test is not parallel since it disables experimental functions in the parser.
+	parser.EnableExperimentalFunctions = false
+	t.Cleanup(func() { parser.EnableExperimentalFunctions = true })
+
+	for _, qs := range []string{`ts_of_max_over_time(foo[5m])`, `limitk(1, foo)`} {
+		t.Run(qs, func(t *testing.T) {
+			// The parser rejects experimental functions, so the expression is parsed with them enabled.
+			parser.EnableExperimentalFunctions = true
+			expr, err := parser.ParseExpr(qs)
+			parser.EnableExperimentalFunctions = false
+			testutil.Ok(t, err)
+			plan, err := logicalplan.NewFromAST(expr, &query.Options{}, logicalplan.PlanOptions{})
+			testutil.Ok(t, err)
+
+			for _, enabled := range []bool{false, true} {
+				ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}, EnableExperimentalFunctions: enabled})
+				q, err := ng.MakeInstantQueryFromPlan(context.Background(), storageWithSeries(), &engine.QueryOpts{}, plan.Root(), time.Unix(0, 0))
+				if enabled {
+					testutil.Ok(t, err)
+					q.Close()
+					continue
+				}
+				testutil.NotOk(t, err)
+				testutil.Assert(t, strings.Contains(err.Error(), "is experimental and must be enabled with EnableExperimentalFunctions"), "unexpected error: %v", err)
+			}
+
+			// The parser setting is read when a query is created, so it can be changed after the engine was created.
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+			parser.EnableExperimentalFunctions = true
+			q, err := ng.MakeInstantQueryFromPlan(context.Background(), storageWithSeries(), &engine.QueryOpts{}, plan.Root(), time.Unix(0, 0))
+			parser.EnableExperimentalFunctions = false
+			testutil.Ok(t, err)
+			q.Close()
+		})
+	}
+}
+
 func TestVectorSelectorWithGaps(t *testing.T) {
 	t.Parallel()
 	opts := promql.EngineOpts{
@@ -219,6 +263,21 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 		EnableAtModifier:     true,
 	}
 
+	scalarOfHistogramsLoad := `load 30s
+	    single_histogram {{schema:0 count:3 sum:6 buckets:[1 2]}}+{{schema:0 count:2 sum:4 buckets:[1 1]}}x10
+	    two_histograms{pod="nginx-1"} {{schema:0 count:3 sum:6 buckets:[1 2]}}x10
+	    two_histograms{pod="nginx-2"} {{schema:0 count:5 sum:10 buckets:[2 3]}}x10`
+	// The native histogram has 10 observations in negative buckets, 4 in the zero bucket [-0.5, 0.5]
+	// and 6 in positive buckets. The classic histogram has buckets on both sides of zero.
+	histogramsAcrossZeroLoad := `load 30s
+	    native_histogram {{schema:0 count:20 sum:-15 z_bucket:4 z_bucket_w:0.5 buckets:[2 3 1] n_buckets:[1 2 3 4]}}x10
+	    classic_histogram_bucket{le="-4"} 1x10
+	    classic_histogram_bucket{le="-1"} 4x10
+	    classic_histogram_bucket{le="0"} 8x10
+	    classic_histogram_bucket{le="1"} 12x10
+	    classic_histogram_bucket{le="4"} 18x10
+	    classic_histogram_bucket{le="+Inf"} 20x10`
+
 	cases := []struct {
 		load  string
 		name  string
@@ -294,6 +353,18 @@ timestamp(
 			    http_requests_total{pod="nginx-2", route="/"} -12+103.00x40`,
 			query: `timestamp((http_requests_total))`,
 		},
+		{
+			name: "timestamp of vector literal",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", route="/"} 1+1x40`,
+			query: `timestamp(vector(1))`,
+		},
+		{
+			name: "timestamp of vector of step time",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", route="/"} 1+1x40`,
+			query: `timestamp(vector(time()))`,
+		},
 		{
 			name: "subqueries in binary expression",
 			load: `load 30s
@@ -1256,6 +1327,20 @@ or
 			    http_requests_total{pod="nginx-2"} 1+2x18`,
 			query: `resets(http_requests_total[5m])`,
 		},
+		{
+			name: "resets with native histograms",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} {{schema:0 count:3 sum:5 buckets:[1 2]}} {{schema:0 count:5 sum:9 buckets:[2 3]}} {{schema:0 count:2 sum:3 buckets:[1 1]}} {{schema:0 count:4 sum:7 buckets:[2 2]}}
+			    http_requests_total{pod="nginx-2"} {{schema:0 count:3 sum:5 buckets:[1 2]}} {{schema:1 count:5 sum:9 buckets:[1 1 1 2]}} {{schema:0 count:7 sum:12 buckets:[3 4]}} 8`,
+			query: `resets(http_requests_total[2m])`,
+		},
+		{
+			name: "changes with native histograms",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} {{schema:0 count:3 sum:5 buckets:[1 2]}} {{schema:0 count:3 sum:5 buckets:[1 2]}} {{schema:0 count:4 sum:7 buckets:[2 2]}} {{schema:0 count:4 sum:7 buckets:[2 2]}}
+			    http_requests_total{pod="nginx-2"} {{schema:0 count:3 sum:5 buckets:[1 2]}} {{schema:1 count:3 sum:5 buckets:[0 1 1 1]}} {{schema:1 count:3 sum:5 buckets:[0 1 1 1]}} 3`,
+			query: `changes(http_requests_total[2m])`,
+		},
 		{
 			name: "present_over_time",
 			load: `load 30s
@@ -1429,6 +1514,97 @@ sum by (grpc_method, grpc_code) (
 			query: `max(http_requests_total @ end()) / max(http_responses_total)`,
 			end:   time.Unix(60000, 0),
 		},
+		{
+			name: "unless with histograms on the rhs",
+			load: `load 30s
+			    foo{pod="nginx-1"} 1+1x20
+			    foo{pod="nginx-2"} 2+2x20
+			    bar{pod="nginx-1"} {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x5 _x5 {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10
+			    bar{pod="nginx-2"} _x10 5x10`,
+			query: `foo unless ignoring(__name__) bar`,
+		},
+		{
+			name: "and with histograms on the rhs",
+			load: `load 30s
+			    foo{pod="nginx-1"} 1+1x20
+			    foo{pod="nginx-2"} 2+2x20
+			    bar{pod="nginx-1"} {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x5 _x5 {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10
+			    bar{pod="nginx-2"} _x10 5x10`,
+			query: `foo and ignoring(__name__) bar`,
+		},
+		{
+			name: "unless with histograms on the lhs",
+			load: `load 30s
+			    foo{pod="nginx-1"} 1+1x20
+			    foo{pod="nginx-2"} 2+2x20
+			    bar{pod="nginx-1"} {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x5 _x5 {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10
+			    bar{pod="nginx-2"} _x10 5x10`,
+			query: `bar unless ignoring(__name__) foo`,
+		},
+		{
+			name: "or with histograms on the rhs",
+			load: `load 30s
+			    foo{pod="nginx-1"} 1+1x20
+			    foo{pod="nginx-2"} 2+2x20
+			    bar{pod="nginx-1"} {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x5 _x5 {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10
+			    bar{pod="nginx-2"} _x10 5x10`,
+			query: `foo or ignoring(__name__) bar`,
+		},
+		{
+			name: "or with histogram-only series on either side",
+			load: `load 30s
+			    float_metric{pod="nginx-1"} 1+1x20
+			    histogram_metric{pod="nginx-2"} {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x20`,
+			query: `float_metric or histogram_metric`,
+		},
+		{
+			name: "or with histogram-only series on the lhs",
+			load: `load 30s
+			    float_metric{pod="nginx-1"} 1+1x20
+			    float_metric{pod="nginx-2"} 2+2x20
+			    histogram_metric{pod="nginx-2"} {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x20`,
+			query: `histogram_metric or ignoring(__name__) float_metric`,
+		},
+		{
+			name: "binop with @ end() pinned range aggregation on lhs",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 2+3x100
+			    http_requests_total{pod="nginx-2"} 1+2x100
+			    http_responses_total{pod="nginx-1"} 2+4x100
+			    http_responses_total{pod="nginx-2"} 3+1x100`,
+			query: `avg_over_time(http_requests_total[1h] @ end()) * http_responses_total`,
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "binop with @ end() pinned range aggregation on rhs",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 2+3x100
+			    http_requests_total{pod="nginx-2"} 1+2x100
+			    http_responses_total{pod="nginx-1"} 2+4x100
+			    http_responses_total{pod="nginx-2"} 3+1x100`,
+			query: `http_responses_total / avg_over_time(http_requests_total[10m] @ end())`,
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "binop with @ start() pinned scalar range aggregation on lhs",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 2+3x100
+			    http_requests_total{pod="nginx-2"} 1+2x100
+			    http_responses_total{pod="nginx-1"} 2+4x100
+			    http_responses_total{pod="nginx-2"} 3+1x100`,
+			query: `scalar(max(avg_over_time(http_requests_total[10m] @ start()))) * http_responses_total`,
+			end:   time.Unix(600, 0),
+		},
+		{
+			name: "binop with @ end() pinned scalar range aggregation on rhs",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 2+3x100
+			    http_requests_total{pod="nginx-2"} 1+2x100
+			    http_responses_total{pod="nginx-1"} 2+4x100
+			    http_responses_total{pod="nginx-2"} 3+1x100`,
+			query: `http_responses_total - scalar(max(avg_over_time(http_requests_total[1h] @ end())))`,
+			end:   time.Unix(600, 0),
+		},
 		{
 			name: "days_in_month with input",
 			load: `load 30s
@@ -1874,6 +2050,52 @@ topk(
 			    http_requests_total{pod="nginx-2", route="/"}  NaN`,
 			query: `topk by (route) (1, http_requests_total)`,
 		},
+		{
+			name: "topk with NaN samples in group",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", route="/"} NaN 1 NaN 4
+			    http_requests_total{pod="nginx-2", route="/"} 3 NaN NaN 2
+			    http_requests_total{pod="nginx-3", route="/"} 1 2 NaN NaN
+			    http_requests_total{pod="nginx-4", route="/api"} NaN NaN 5 NaN`,
+			query: `topk by (route) (2, http_requests_total)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(120, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name: "bottomk with NaN samples in group",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", route="/"} NaN 1 NaN 4
+			    http_requests_total{pod="nginx-2", route="/"} 3 NaN NaN 2
+			    http_requests_total{pod="nginx-3", route="/"} 1 2 NaN NaN
+			    http_requests_total{pod="nginx-4", route="/api"} NaN NaN 5 NaN`,
+			query: `bottomk by (route) (2, http_requests_total)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(120, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name: "topk with k exceeding the non-NaN samples",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} NaN 1 NaN
+			    http_requests_total{pod="nginx-2"} 3 NaN NaN
+			    http_requests_total{pod="nginx-3"} 1 NaN NaN`,
+			query: `topk(3, http_requests_total)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(60, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name: "bottomk with k exceeding the non-NaN samples",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} NaN 1 NaN
+			    http_requests_total{pod="nginx-2"} 3 NaN NaN
+			    http_requests_total{pod="nginx-3"} 1 NaN NaN`,
+			query: `bottomk(3, http_requests_total)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(60, 0),
+			step:  30 * time.Second,
+		},
 		{
 			name: "nested topk error that should not be skipped",
 			load: `load 30s
@@ -2334,6 +2556,210 @@ or
 			end:   time.UnixMilli(160000),
 			step:  time.Minute + 16*time.Second,
 		},
+		{
+			name: "predict_linear with @ modifier",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 1+1x15
+			    http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `predict_linear(http_requests_total[1m] @ 0 offset -4m14s, 1)`,
+			start: time.Unix(29, 0),
+			end:   time.Unix(147, 0),
+			step:  time.Second,
+		},
+		{
+			name: "fuzz predict_linear with @ modifier and folded scalar argument",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} 1+1x15
+			    http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: `max without () (-predict_linear({__name__="http_requests_total"}[1m] @ 0 offset -4m14s, 0.98 >= bool 0.56))`,
+			start: time.Unix(29, 0),
+			end:   time.Unix(147, 0),
+			step:  time.Second,
+		},
+		{
+			name:  "scalar of histogram functions: scalar(histogram_count(single_histogram))",
+			load:  scalarOfHistogramsLoad,
+			query: `scalar(histogram_count(single_histogram))`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(300, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "scalar of histogram functions: scalar(histogram_sum(single_histogram))",
+			load:  scalarOfHistogramsLoad,
+			query: `scalar(histogram_sum(single_histogram))`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(300, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "scalar of histogram functions: scalar(histogram_count(single_histogram)) * 2",
+			load:  scalarOfHistogramsLoad,
+			query: `scalar(histogram_count(single_histogram)) * 2`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(300, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "scalar of histogram functions: scalar(histogram_count(two_histograms))",
+			load:  scalarOfHistogramsLoad,
+			query: `scalar(histogram_count(two_histograms))`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(300, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "scalar of histogram functions: scalar(histogram_sum(two_histograms{pod=\"nginx-2\"}))",
+			load:  scalarOfHistogramsLoad,
+			query: `scalar(histogram_sum(two_histograms{pod="nginx-2"}))`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(300, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-10, 10, native_histogram) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-10, 10, native_histogram)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-3, 3, native_histogram) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-3, 3, native_histogram)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-1, 1, native_histogram) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-1, 1, native_histogram)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-0.25, 0.25, native_histogram) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-0.25, 0.25, native_histogram)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-0.25, 3, native_histogram) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-0.25, 3, native_histogram)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-3, -0.25, native_histogram) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-3, -0.25, native_histogram)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-Inf, 0, native_histogram) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-Inf, 0, native_histogram)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(0, +Inf, native_histogram) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(0, +Inf, native_histogram)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-Inf, +Inf, native_histogram) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-Inf, +Inf, native_histogram)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-10, 10, classic_histogram_bucket) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-10, 10, classic_histogram_bucket)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-3, 3, classic_histogram_bucket) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-3, 3, classic_histogram_bucket)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-1, 1, classic_histogram_bucket) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-1, 1, classic_histogram_bucket)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-0.25, 0.25, classic_histogram_bucket) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-0.25, 0.25, classic_histogram_bucket)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-0.25, 3, classic_histogram_bucket) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-0.25, 3, classic_histogram_bucket)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-3, -0.25, classic_histogram_bucket) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-3, -0.25, classic_histogram_bucket)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-Inf, 0, classic_histogram_bucket) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-Inf, 0, classic_histogram_bucket)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(0, +Inf, classic_histogram_bucket) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(0, +Inf, classic_histogram_bucket)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
+		{
+			name:  "histogram_fraction(-Inf, +Inf, classic_histogram_bucket) across zero",
+			load:  histogramsAcrossZeroLoad,
+			query: `histogram_fraction(-Inf, +Inf, classic_histogram_bucket)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(270, 0),
+			step:  30 * time.Second,
+		},
 	}
 
 	disableOptimizerOpts := []bool{true, false}
@@ -2366,6 +2792,7 @@ or
 							LogicalOptimizers: optimizers,
 							// Set to 1 to make sure batching is tested.
 							SelectorBatchSize: 1,
+							ValidateSeriesIDs: true,
 						})
 						ctx := context.Background()
 						q1, err := newEngine.NewRangeQuery(ctx, storage, nil, tc.query, tc.start, tc.end, tc.step)
@@ -2481,126 +2908,1744 @@ func TestWarnings(t *testing.T) {
 	}
 }
 
-type scannersWithWarns struct {
-	warn         error
-	promScanners *prometheus.Scanners
-}
+func TestHistogramIgnoredInFunctionInfo(t *testing.T) {
+	t.Parallel()
 
-func newScannersWithWarns(warn error, qOpts *query.Options, lplan logicalplan.Plan) (*scannersWithWarns, error) {
-	scanners, err := prometheus.NewPrometheusScanners(&storage.MockQueryable{
-		MockQuerier: storage.NoopQuerier(),
-	}, qOpts, lplan)
-	if err != nil {
-		return nil, err
+	load := `load 30s
+	    native_histogram {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10
+	    float_series 1+1x10`
+
+	cases := []struct {
+		query         string
+		expectedInfos []string
+	}{
+		{query: `sin(native_histogram)`, expectedInfos: []string{"PromQL info: ignored histogram in sin function"}},
+		{query: `atanh(native_histogram)`, expectedInfos: []string{"PromQL info: ignored histogram in atanh function"}},
+		{query: `deg(native_histogram)`, expectedInfos: []string{"PromQL info: ignored histogram in deg function"}},
+		{query: `sin(float_series)`},
+		{query: `abs(native_histogram)`},
+		{query: `clamp(native_histogram, 0, 1)`, expectedInfos: []string{"PromQL info: ignored histogram in clamp function"}},
+		{query: `clamp_min(native_histogram, 1)`, expectedInfos: []string{"PromQL info: ignored histogram in clamp_min function"}},
+		{query: `clamp_max(native_histogram, 1)`, expectedInfos: []string{"PromQL info: ignored histogram in clamp_max function"}},
+		{query: `clamp_min(float_series, 1)`},
+		{query: `clamp_min(histogram_count(native_histogram), 1)`},
+		{query: `scalar(native_histogram)`, expectedInfos: []string{"PromQL info: ignored histogram in scalar function"}},
+		{query: `scalar(histogram_count(native_histogram))`},
+		{query: `scalar({__name__=~"native_histogram|float_series"})`},
 	}
-	return &scannersWithWarns{
-		warn:         warn,
-		promScanners: scanners,
-	}, nil
-}
 
-func (s *scannersWithWarns) Close() error { return nil }
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
 
-func (s scannersWithWarns) NewVectorSelector(ctx context.Context, opts *query.Options, hints storage.SelectHints, selector logicalplan.VectorSelector) (model.VectorOperator, error) {
-	warnings.AddToContext(s.warn, ctx)
-	return s.promScanners.NewVectorSelector(ctx, opts, hints, selector)
-}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+			q, err := ng.NewInstantQuery(context.Background(), storage, nil, tc.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
 
-func (s scannersWithWarns) NewMatrixSelector(ctx context.Context, opts *query.Options, hints storage.SelectHints, selector logicalplan.MatrixSelector, call logicalplan.FunctionCall) (model.VectorOperator, error) {
-	warnings.AddToContext(s.warn, ctx)
-	return s.promScanners.NewMatrixSelector(ctx, opts, hints, selector, call)
+			res := q.Exec(context.Background())
+			testutil.Ok(t, res.Err)
+			_, infos := res.Warnings.AsStrings(tc.query, 0, 0)
+			testutil.Equals(t, len(tc.expectedInfos), len(infos))
+			for i := range tc.expectedInfos {
+				testutil.Equals(t, tc.expectedInfos[i], infos[i])
+			}
+		})
+	}
 }
 
-func TestWarningsPlanCreation(t *testing.T) {
-	var (
-		opts         = engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}}
-		expectedWarn = errors.New("test warning")
-	)
+func TestHistogramNaNSumInfo(t *testing.T) {
+	t.Parallel()
 
-	scnrs, err := newScannersWithWarns(expectedWarn, &query.Options{}, nil)
-	testutil.Ok(t, err)
-	newEngine := engine.NewWithScanners(opts, scnrs)
-	q1, err := newEngine.NewRangeQuery(context.Background(), nil, nil, "http_requests_total", time.UnixMilli(0), time.UnixMilli(600), 30*time.Second)
-	testutil.Ok(t, err)
+	load := `load 30s
+	    nan_sum_histogram {{schema:0 count:3 sum:NaN buckets:[1 2]}}x10
+	    native_histogram {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10`
 
-	res := q1.Exec(context.Background())
-	testutil.Ok(t, res.Err)
-	testutil.WithGoCmp(cmp.Comparer(func(err1, err2 error) bool {
-		return err1.Error() == err2.Error()
-	})).Equals(t, annotations.New().Add(expectedWarn), res.Warnings)
+	cases := []struct {
+		query         string
+		expectedInfos []string
+	}{
+		{query: `histogram_avg(nan_sum_histogram)`, expectedInfos: []string{`PromQL info: histogram with NaN sum in histogram_avg function for metric name "nan_sum_histogram"`}},
+		{query: `histogram_stddev(nan_sum_histogram)`, expectedInfos: []string{`PromQL info: histogram with NaN sum in histogram_stddev function for metric name "nan_sum_histogram"`}},
+		{query: `histogram_stdvar(nan_sum_histogram)`, expectedInfos: []string{`PromQL info: histogram with NaN sum in histogram_stdvar function for metric name "nan_sum_histogram"`}},
+		{query: `histogram_avg(native_histogram)`},
+		{query: `histogram_count(nan_sum_histogram)`},
+	}
 
-}
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+			q, err := ng.NewRangeQuery(context.Background(), storage, nil, tc.query, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(context.Background())
+			testutil.Ok(t, res.Err)
+			_, infos := res.Warnings.AsStrings(tc.query, 0, 0)
+			testutil.Equals(t, len(tc.expectedInfos), len(infos))
+			for i := range tc.expectedInfos {
+				testutil.Equals(t, tc.expectedInfos[i], infos[i])
+			}
+		})
+	}
+}
+
+func TestHistogramSumScaling(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    native_histogram{pod="nginx-1"} {{schema:0 count:3 sum:2048.00 buckets:[1 2]}}+{{schema:0 count:3 sum:1024.00 buckets:[1 2]}}x10
+	    native_histogram{pod="nginx-2"} {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10
+	    float_series{pod="nginx-1"} 1+1x10`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	cases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{name: "factor", query: `histogram_sum(native_histogram, 1/1024)`, expected: `histogram_sum(native_histogram) / 1024`},
+		{name: "no factor", query: `histogram_sum(native_histogram)`, expected: `histogram_sum(native_histogram) * 1`},
+		{name: "float series", query: `histogram_sum(float_series, 2)`, expected: `histogram_sum(float_series)`},
+	}
+
+	ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}, EnableExtendedFunctions: true})
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			run := func(query string) *promql.Result {
+				q, err := ng.NewRangeQuery(context.Background(), storage, nil, query, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				defer q.Close()
+
+				res := q.Exec(context.Background())
+				testutil.Ok(t, res.Err)
+				return res
+			}
+			testutil.WithGoCmp(comparer).Equals(t, run(tc.expected), run(tc.query))
+		})
+	}
+
+	t.Run("too many arguments", func(t *testing.T) {
+		_, err := ng.NewInstantQuery(context.Background(), storage, nil, `histogram_sum(native_histogram, 2, 3)`, time.Unix(0, 0))
+		testutil.NotOk(t, err)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+		_, err := ng.NewInstantQuery(context.Background(), storage, nil, `histogram_sum(native_histogram, 2)`, time.Unix(0, 0))
+		testutil.NotOk(t, err)
+	})
+}
+
+func TestCountValuesHistogramInfo(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    native_histogram {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10
+	    float_series 1+1x10`
+
+	cases := []struct {
+		query         string
+		expectedInfos []string
+	}{
+		{query: `count_values("v", native_histogram)`, expectedInfos: []string{`PromQL info: count_values used the string representation of native histograms as label values for metric name "native_histogram"`}},
+		{query: `count_values("v", float_series)`},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ctx := context.Background()
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			q1, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q1.Close()
+
+			newResult := q1.Exec(ctx)
+			testutil.Ok(t, newResult.Err)
+			_, infos := newResult.Warnings.AsStrings(tc.query, 0, 0)
+			testutil.Equals(t, len(tc.expectedInfos), len(infos))
+			for i := range tc.expectedInfos {
+				testutil.Equals(t, tc.expectedInfos[i], infos[i])
+			}
+
+			// Results still match Prometheus, which counts histograms by their string representation.
+			q2, err := promql.NewEngine(opts).NewRangeQuery(ctx, storage, nil, tc.query, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q2.Close()
+			testutil.WithGoCmp(comparer).Equals(t, q2.Exec(ctx), newResult, queryExplanation(q1))
+		})
+	}
+}
+
+func TestOperatorTimeBudgetExceededInfo(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    http_requests_total{pod="nginx-1"} 1+1x10
+	    http_requests_total{pod="nginx-2"} 1+2x10`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, budget := range []time.Duration{0, time.Nanosecond, time.Hour} {
+		t.Run(budget.String(), func(t *testing.T) {
+			ng := engine.New(engine.Opts{
+				EngineOpts:         promql.EngineOpts{Timeout: 1 * time.Hour},
+				OperatorTimeBudget: budget,
+			})
+			query := `sum(rate(http_requests_total[1m]))`
+			q, err := ng.NewRangeQuery(context.Background(), storage, nil, query, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(context.Background())
+			testutil.Ok(t, res.Err)
+			_, infos := res.Warnings.AsStrings(query, 0, 0)
+			if budget != time.Nanosecond {
+				testutil.Equals(t, 0, len(infos))
+				return
+			}
+			testutil.Assert(t, len(infos) > 0, "expected time budget annotations")
+			for _, info := range infos {
+				testutil.Assert(t, strings.HasPrefix(info, "PromQL info: operator exceeded its time budget of 1ns in "), "unexpected info %q", info)
+			}
+		})
+	}
+}
+
+func TestCustomBucketsHistogramScalarArithmetic(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    nhcb {{schema:-53 sum:10 count:6 custom_values:[5 10 20] buckets:[1 0 2 3]}}x10`
+
+	cases := []struct {
+		query           string
+		expectedBuckets []float64
+	}{
+		{query: `nhcb * 2`, expectedBuckets: []float64{2, 4, 6}},
+		{query: `2 * nhcb`, expectedBuckets: []float64{2, 4, 6}},
+		{query: `nhcb / 2`, expectedBuckets: []float64{0.5, 1, 1.5}},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+			q, err := ng.NewInstantQuery(context.Background(), storage, nil, tc.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(context.Background())
+			testutil.Ok(t, res.Err)
+			vector, err := res.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(vector))
+
+			h := vector[0].H
+			testutil.Assert(t, h != nil, "expected a histogram result")
+			testutil.Assert(t, h.UsesCustomBuckets(), "expected custom buckets to be preserved")
+			testutil.Equals(t, []float64{5, 10, 20}, h.CustomValues)
+
+			var buckets, upperBounds []float64
+			for it := h.PositiveBucketIterator(); it.Next(); {
+				if b := it.At(); b.Count != 0 {
+					buckets = append(buckets, b.Count)
+					upperBounds = append(upperBounds, b.Upper)
+				}
+			}
+			testutil.Equals(t, tc.expectedBuckets, buckets)
+			testutil.Equals(t, []float64{5, 20, math.Inf(1)}, upperBounds)
+		})
+	}
+}
+
+func TestTimestampOfOverTimeFunctions(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    floats -5 -3 -8 -3 _x4 1 2
+	    mixed -5 {{schema:0 count:3 sum:14.00 buckets:[1 2]}} -3 -8 {{schema:0 count:3 sum:14.00 buckets:[1 2]}} -4 _x2 3
+	    histograms {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x5`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	for _, fn := range []string{"max_over_time", "min_over_time", "ts_of_max_over_time", "ts_of_min_over_time", "ts_of_last_over_time"} {
+		for _, metric := range []string{"floats", "mixed", "histograms"} {
+			query := fmt.Sprintf("%s(%s[1m])", fn, metric)
+			t.Run(query, func(t *testing.T) {
+				ctx := context.Background()
+				ng := engine.New(engine.Opts{EngineOpts: opts, EnableExperimentalFunctions: true})
+				q1, err := ng.NewRangeQuery(ctx, storage, nil, query, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				defer q1.Close()
+				newResult := q1.Exec(ctx)
+				testutil.Ok(t, newResult.Err)
+
+				q2, err := promql.NewEngine(opts).NewRangeQuery(ctx, storage, nil, query, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+				testutil.Ok(t, err)
+				defer q2.Close()
+				testutil.WithGoCmp(comparer).Equals(t, q2.Exec(ctx), newResult, queryExplanation(q1))
+			})
+		}
+	}
+
+	t.Run("ts_of_max_over_time ignores histograms", func(t *testing.T) {
+		ctx := context.Background()
+		ng := engine.New(engine.Opts{EngineOpts: opts, EnableExperimentalFunctions: true})
+		q, err := ng.NewInstantQuery(ctx, storage, nil, `ts_of_max_over_time(mixed[2m])`, time.Unix(120, 0))
+		testutil.Ok(t, err)
+		defer q.Close()
+
+		res := q.Exec(ctx)
+		testutil.Ok(t, res.Err)
+		vector, err := res.Vector()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(vector))
+		testutil.Equals(t, 60.0, vector[0].F)
+	})
+}
+
+func TestAvgWithMixedFloatsAndHistograms(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    http_requests_total{job="floats", pod="nginx-1"} 1+1x10
+	    http_requests_total{job="floats", pod="nginx-2"} 4+2x10
+	    http_requests_total{job="histograms", pod="nginx-1"} {{schema:0 count:3 sum:6 buckets:[1 2]}}x10
+	    http_requests_total{job="histograms", pod="nginx-2"} {{schema:0 count:5 sum:10 buckets:[2 3]}}x10
+	    http_requests_total{job="mixed", pod="nginx-1"} 3x10
+	    http_requests_total{job="mixed", pod="nginx-2"} {{schema:0 count:1 sum:2 buckets:[1]}}x10`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	ctx := context.Background()
+	ng := engine.New(engine.Opts{EngineOpts: opts})
+
+	qs := `avg by (job) (http_requests_total)`
+	q1, err := ng.NewRangeQuery(ctx, storage, nil, qs, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer q1.Close()
+	newResult := q1.Exec(ctx)
+	testutil.Ok(t, newResult.Err)
+
+	// Floats and histograms are averaged separately, groups mixing both are dropped with a warning.
+	matrix, err := newResult.Matrix()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(matrix))
+	testutil.Equals(t, "floats", matrix[0].Metric.Get("job"))
+	testutil.Equals(t, 0, len(matrix[0].Histograms))
+	testutil.Equals(t, "histograms", matrix[1].Metric.Get("job"))
+	testutil.Equals(t, 0, len(matrix[1].Floats))
+	testutil.Equals(t, 4.0, matrix[1].Histograms[0].H.Count)
+	warns, _ := newResult.Warnings.AsStrings(qs, 0, 0)
+	testutil.Equals(t, []string{"PromQL warning: encountered a mix of histograms and floats for aggregation"}, warns)
+
+	q2, err := promql.NewEngine(opts).NewRangeQuery(ctx, storage, nil, qs, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer q2.Close()
+	testutil.WithGoCmp(comparer).Equals(t, q2.Exec(ctx), newResult, queryExplanation(q1))
+}
+
+func TestHistogramFractionAcrossZero(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    native_histogram {{schema:0 count:20 sum:-15 z_bucket:4 z_bucket_w:0.5 buckets:[2 3 1] n_buckets:[1 2 3 4]}}x10`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	// Bounds outside of all buckets include all observations.
+	ctx := context.Background()
+	ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}})
+	q, err := ng.NewInstantQuery(ctx, storage, nil, `histogram_fraction(-10, 10, native_histogram)`, time.Unix(0, 0))
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	res := q.Exec(ctx)
+	testutil.Ok(t, res.Err)
+	vector, err := res.Vector()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(vector))
+	testutil.Equals(t, 1.0, vector[0].F)
+}
+
+func TestSharedSubexpressions(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    http_requests_total{pod="nginx-1", job="a"} 1+1x120
+	    http_requests_total{pod="nginx-2", job="a"} 5+3x60 _x20 1+2x40
+	    http_requests_total{pod="nginx-3", job="b"} 2+4x120
+	    http_request_duration_seconds{pod="nginx-1"} {{schema:0 count:3 sum:14 buckets:[1 2]}}+{{schema:0 count:1 sum:2 buckets:[1]}}x120`
+
+	queries := []string{
+		`rate(http_requests_total[5m]) / on (job) group_left sum by (job) (rate(http_requests_total[5m]))`,
+		`http_requests_total - http_requests_total offset 1m + http_requests_total`,
+		`http_requests_total * 2 + http_requests_total`,
+		`-http_requests_total + http_requests_total`,
+		`(http_requests_total > 10) or (http_requests_total < 50)`,
+		`max_over_time(rate(http_requests_total[1m])[5m:1m]) / rate(http_requests_total[1m])`,
+		`http_request_duration_seconds * 2 + http_request_duration_seconds`,
+		`rate(http_request_duration_seconds[2m]) + rate(http_request_duration_seconds[2m]) / 2`,
+		`(http_requests_total and on () non_existent) or http_requests_total`,
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	for _, qs := range queries {
+		t.Run(qs, func(t *testing.T) {
+			ctx := context.Background()
+			ng := engine.New(engine.Opts{EngineOpts: opts, EnableSharedSubexpressions: true})
+			q1, err := ng.NewRangeQuery(ctx, storage, nil, qs, time.Unix(0, 0), time.Unix(3600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			newResult := q1.Exec(ctx)
+			testutil.Ok(t, newResult.Err)
+
+			q2, err := promql.NewEngine(opts).NewRangeQuery(ctx, storage, nil, qs, time.Unix(0, 0), time.Unix(3600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q2.Close()
+			testutil.WithGoCmp(comparer).Equals(t, q2.Exec(ctx), newResult, queryExplanation(q1))
+		})
+	}
+}
+
+func TestSetOperationsDuplicateLabelSet(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{job="a"} 1x10
+	    bar{job="a"} 2x10
+	    baz{job="b"} 3x10
+	    foo_odd{job="c"} _ 1 stale 1 stale 1 stale 1 stale 1
+	    bar_even{job="c"} 1 stale 1 stale 1 stale 1 stale 1 stale`
+
+	// Set operations match series without their metric name, so series which only differ
+	// by name cannot both come from different sides. Series from the same side can still
+	// collide once their names are dropped.
+	cases := []struct {
+		query       string
+		expected    int
+		expectedErr error
+	}{
+		{query: `foo or bar`, expected: 1},
+		{query: `(foo or bar) + 1`, expected: 1},
+		{query: `abs(foo or bar)`, expected: 1},
+		{query: `(foo or baz) + 1`, expected: 2},
+		{query: `{__name__=~"foo|bar"} or baz`, expected: 3},
+		{query: `({__name__=~"foo|bar"} or baz) + 1`, expectedErr: extlabels.ErrDuplicateLabelSet},
+		{query: `abs({__name__=~"foo|bar"} unless baz)`, expectedErr: extlabels.ErrDuplicateLabelSet},
+		{query: `rate(({__name__=~"foo|bar"} and {job="a"})[1m:30s])`, expectedErr: extlabels.ErrDuplicateLabelSet},
+		// Series which collide after dropping their names but never have samples at the same step.
+		{query: `sum by (job) ({__name__=~"foo_odd|bar_even"} + 1)`, expected: 1},
+		{query: `({__name__=~"foo_odd|bar_even|foo"} unless baz) + 1`, expectedErr: extlabels.ErrDuplicateLabelSet},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ctx := context.Background()
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			q, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(ctx)
+			if tc.expectedErr != nil {
+				testutil.NotOk(t, res.Err)
+				testutil.Equals(t, tc.expectedErr.Error(), res.Err.Error())
+				return
+			}
+			testutil.Ok(t, res.Err)
+			m, err := res.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expected, len(m))
+		})
+	}
+}
+
+func TestDuplicateLabelSetWithFloatsAndHistograms(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    float_total{job="a"} 1+1x10
+	    histogram_total{job="a"} {{schema:0 count:3 sum:6 buckets:[1 2]}}+{{schema:0 count:3 sum:6 buckets:[1 2]}}x10
+	    float_odd{job="b"} _ 1 stale 1 stale 1 stale 1 stale 1
+	    histogram_even{job="b"} {{schema:0 count:3 sum:6 buckets:[1 2]}} stale {{schema:0 count:3 sum:6 buckets:[1 2]}} stale {{schema:0 count:3 sum:6 buckets:[1 2]}} stale {{schema:0 count:3 sum:6 buckets:[1 2]}} stale {{schema:0 count:3 sum:6 buckets:[1 2]}} stale`
+
+	// A float and a histogram series which collide after dropping their names
+	// are duplicates when they have samples at the same step.
+	cases := []struct {
+		query       string
+		expected    int
+		expectedErr error
+	}{
+		{query: `{__name__=~"float_total|histogram_total"} * 2`, expectedErr: extlabels.ErrDuplicateLabelSet},
+		{query: `rate({__name__=~"float_total|histogram_total"}[1m])`, expectedErr: extlabels.ErrDuplicateLabelSet},
+		// The aggregations only return a single series, so the duplicates need to be found before them.
+		{query: `count by (job) (rate({__name__=~"float_total|histogram_total"}[1m]))`, expectedErr: extlabels.ErrDuplicateLabelSet},
+		{query: `count by (job) ({__name__=~"float_total|histogram_total"} * 2)`, expectedErr: extlabels.ErrDuplicateLabelSet},
+		{query: `count by (job) ({__name__=~"float_odd|histogram_even"} * 2)`, expected: 1},
+		// vector() cannot return duplicates, but its argument still needs to be checked.
+		{query: `vector(scalar(-{job="a"}))`, expectedErr: extlabels.ErrDuplicateLabelSet},
+		{query: `vector(scalar(label_replace({job="a"}, "__name__", "", "", "")))`, expectedErr: extlabels.ErrDuplicateLabelSet},
+	}
+
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ctx := context.Background()
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			q, err := ng.NewRangeQuery(ctx, tstorage, nil, tc.query, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+			res := q.Exec(ctx)
+
+			pq, err := promql.NewEngine(opts).NewRangeQuery(ctx, tstorage, nil, tc.query, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer pq.Close()
+			promResult := pq.Exec(ctx)
+
+			if tc.expectedErr != nil {
+				testutil.NotOk(t, res.Err)
+				testutil.Equals(t, tc.expectedErr.Error(), res.Err.Error())
+				testutil.NotOk(t, promResult.Err)
+				return
+			}
+			testutil.Ok(t, res.Err)
+			m, err := res.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expected, len(m))
+			testutil.WithGoCmp(comparer).Equals(t, promResult, res, queryExplanation(q))
+		})
+	}
+}
+
+func TestHistogramAvgOverTimeConsistency(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    native_histogram {{schema:0 count:3 sum:10.1 buckets:[1 2]}}+{{schema:0 count:3 sum:0.7 buckets:[1 2]}}x20
+	    native_histogram_gauge {{schema:0 count:7 sum:1.1 buckets:[3 4]}} {{schema:0 count:3 sum:-0.3 buckets:[1 2]}} {{schema:0 count:11 sum:5.9 buckets:[5 6]}}x18`
+
+	// Pairs of expressions which are mathematically equivalent. The range aggregation
+	// accumulates the per-step averages, so results may only differ by rounding.
+	cases := []struct {
+		query      string
+		equivalent string
+		// tolerance is the maximum relative difference between the two expressions.
+		tolerance float64
+	}{
+		{
+			query:      `histogram_avg(native_histogram)`,
+			equivalent: `histogram_sum(native_histogram) / histogram_count(native_histogram)`,
+		},
+		{
+			query:      `avg_over_time(histogram_avg(native_histogram)[5m:1m])`,
+			equivalent: `sum_over_time(histogram_avg(native_histogram)[5m:1m]) / count_over_time(histogram_avg(native_histogram)[5m:1m])`,
+			tolerance:  1e-12,
+		},
+		{
+			query:      `avg_over_time(histogram_avg(native_histogram_gauge)[5m:1m])`,
+			equivalent: `sum_over_time(histogram_avg(native_histogram_gauge)[5m:1m]) / count_over_time(histogram_avg(native_histogram_gauge)[5m:1m])`,
+			tolerance:  1e-12,
+		},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	var (
+		start = time.Unix(0, 0)
+		end   = time.Unix(600, 0)
+		step  = 30 * time.Second
+	)
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	rangeQuery := func(t *testing.T, ng promql.QueryEngine, query string) *promql.Result {
+		ctx := context.Background()
+		q, err := ng.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+		testutil.Ok(t, err)
+		// Closing the query returns the points of the result to a pool, so it
+		// can only be closed once the result is no longer used.
+		t.Cleanup(q.Close)
+
+		res := q.Exec(ctx)
+		testutil.Ok(t, res.Err)
+		return res
+	}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			promEngine := promql.NewEngine(opts)
+
+			res := rangeQuery(t, ng, tc.query)
+			testutil.WithGoCmp(comparer).Equals(t, rangeQuery(t, promEngine, tc.query), res)
+
+			result, err := res.Matrix()
+			testutil.Ok(t, err)
+			equivalent, err := rangeQuery(t, ng, tc.equivalent).Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, len(result), len(equivalent))
+			for i := range result {
+				testutil.Equals(t, len(result[i].Floats), len(equivalent[i].Floats))
+				for j, p := range result[i].Floats {
+					q := equivalent[i].Floats[j]
+					testutil.Equals(t, p.T, q.T)
+					testutil.Assert(t, math.Abs(p.F-q.F) <= tc.tolerance*math.Abs(q.F), "step %d: %v differs from %v", p.T, p.F, q.F)
+				}
+			}
+		})
+	}
+}
+
+func TestHistogramQuantileForcedMonotonicityInfo(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    monotonic_bucket{le="1"} 1x10
+	    monotonic_bucket{le="2"} 2x10
+	    monotonic_bucket{le="+Inf"} 3x10
+	    non_monotonic_bucket{le="1", job="a"} 3x10
+	    non_monotonic_bucket{le="2", job="a"} 2x10
+	    non_monotonic_bucket{le="+Inf", job="a"} 3x10
+	    native_histogram {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10`
+
+	cases := []struct {
+		query         string
+		expectedInfos int
+	}{
+		{query: `histogram_quantile(0.5, monotonic_bucket)`},
+		{query: `histogram_quantile(0.5, {__name__=~"monotonic_bucket|non_monotonic_bucket"})`, expectedInfos: 1},
+		{query: `histogram_quantile(0.5, native_histogram)`},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, tc := range cases {
+		// Prometheus only adds the metric name to the info when delayed name removal is enabled.
+		for _, delayedNameRemoval := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/delayedNameRemoval=%t", tc.query, delayedNameRemoval), func(t *testing.T) {
+				ctx := context.Background()
+				opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10, EnableDelayedNameRemoval: delayedNameRemoval}
+				ng := engine.New(engine.Opts{EngineOpts: opts})
+				q1, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(60, 0))
+				testutil.Ok(t, err)
+				defer q1.Close()
+				newResult := q1.Exec(ctx)
+				testutil.Ok(t, newResult.Err)
+
+				q2, err := promql.NewEngine(opts).NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(60, 0))
+				testutil.Ok(t, err)
+				defer q2.Close()
+				oldResult := q2.Exec(ctx)
+				testutil.Ok(t, oldResult.Err)
+
+				_, newInfos := newResult.Warnings.AsStrings("", 0, 0)
+				_, oldInfos := oldResult.Warnings.AsStrings("", 0, 0)
+				testutil.Equals(t, tc.expectedInfos, len(newInfos))
+				testutil.Equals(t, oldInfos, newInfos)
+			})
+		}
+	}
+}
+
+func TestHistogramSchemaReducedInfo(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    coarse_histogram{pod="nginx-1"} {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10
+	    fine_histogram{pod="nginx-1"} {{schema:2 count:9 sum:20.00 z_bucket:1 z_bucket_w:0.001 buckets:[1 2 3 2]}}x10`
+
+	cases := []struct {
+		query         string
+		expectedInfos []string
+	}{
+		{query: `coarse_histogram + ignoring(__name__) coarse_histogram`},
+		{query: `coarse_histogram + ignoring(__name__) fine_histogram`, expectedInfos: []string{
+			`PromQL info: reduced schema of histograms with different resolutions in + operation`,
+		}},
+		{query: `fine_histogram - ignoring(__name__) coarse_histogram`, expectedInfos: []string{
+			`PromQL info: reduced schema of histograms with different resolutions in - operation`,
+		}},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ctx := context.Background()
+			ng := engine.New(engine.Opts{EngineOpts: opts, EnableHistogramSchemaReducedInfo: true})
+			q, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+			res := q.Exec(ctx)
+			testutil.Ok(t, res.Err)
+
+			_, infos := res.Warnings.AsStrings("", 0, 0)
+			testutil.Equals(t, len(tc.expectedInfos), len(infos))
+			for i := range tc.expectedInfos {
+				testutil.Equals(t, tc.expectedInfos[i], infos[i])
+			}
+		})
+	}
+}
+
+type scannersWithWarns struct {
+	warn         error
+	promScanners *prometheus.Scanners
+}
+
+func newScannersWithWarns(warn error, qOpts *query.Options, lplan logicalplan.Plan) (*scannersWithWarns, error) {
+	scanners, err := prometheus.NewPrometheusScanners(&storage.MockQueryable{
+		MockQuerier: storage.NoopQuerier(),
+	}, qOpts, lplan)
+	if err != nil {
+		return nil, err
+	}
+	return &scannersWithWarns{
+		warn:         warn,
+		promScanners: scanners,
+	}, nil
+}
+
+func (s *scannersWithWarns) Close() error { return nil }
+
+func (s scannersWithWarns) NewVectorSelector(ctx context.Context, opts *query.Options, hints storage.SelectHints, selector logicalplan.VectorSelector) (model.VectorOperator, error) {
+	warnings.AddToContext(s.warn, ctx)
+	return s.promScanners.NewVectorSelector(ctx, opts, hints, selector)
+}
+
+func (s scannersWithWarns) NewMatrixSelector(ctx context.Context, opts *query.Options, hints storage.SelectHints, selector logicalplan.MatrixSelector, call logicalplan.FunctionCall) (model.VectorOperator, error) {
+	warnings.AddToContext(s.warn, ctx)
+	return s.promScanners.NewMatrixSelector(ctx, opts, hints, selector, call)
+}
+
+func TestWarningsPlanCreation(t *testing.T) {
+	var (
+		opts         = engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}}
+		expectedWarn = errors.New("test warning")
+	)
+
+	scnrs, err := newScannersWithWarns(expectedWarn, &query.Options{}, nil)
+	testutil.Ok(t, err)
+	newEngine := engine.NewWithScanners(opts, scnrs)
+	q1, err := newEngine.NewRangeQuery(context.Background(), nil, nil, "http_requests_total", time.UnixMilli(0), time.UnixMilli(600), 30*time.Second)
+	testutil.Ok(t, err)
+
+	res := q1.Exec(context.Background())
+	testutil.Ok(t, res.Err)
+	testutil.WithGoCmp(cmp.Comparer(func(err1, err2 error) bool {
+		return err1.Error() == err2.Error()
+	})).Equals(t, annotations.New().Add(expectedWarn), res.Warnings)
+
+}
 
 func TestEdgeCases(t *testing.T) {
 	t.Parallel()
-	testCases := []struct {
-		name   string
-		series []storage.Series
-		query  string
-		start  time.Time
-		end    time.Time
+	testCases := []struct {
+		name   string
+		series []storage.Series
+		query  string
+		start  time.Time
+		end    time.Time
+	}{
+		{
+			name: "binop edge case",
+			series: []storage.Series{
+				newMockSeries(
+					[]string{labels.MetricName, "foo"},
+					[]int64{0, 30, 60, 1200, 1500, 1800},
+					[]float64{1, 2, 3, 4, 5, 6},
+				),
+				newMockSeries(
+					[]string{labels.MetricName, "bar", "id", "1"},
+					[]int64{0, 30},
+					[]float64{1, 2},
+				),
+				newMockSeries(
+					[]string{labels.MetricName, "bar", "id", "2"},
+					[]int64{1200, 1500},
+					[]float64{3, 4},
+				),
+			},
+			query: `foo * on () group_left () bar`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(30000, 0),
+		},
+		{
+			name: "absent with gaps in series",
+			series: []storage.Series{
+				newMockSeries(
+					[]string{labels.MetricName, "foo"},
+					[]int64{30, 300, 3000, 6000, 12000, 18000},
+					[]float64{1, 2, 3, 4, 5, 6},
+				),
+			},
+			query: `absent(foo)`,
+			start: time.Unix(0, 0),
+			end:   time.Unix(30000, 0),
+		},
+	}
+
+	opts := promql.EngineOpts{
+		Timeout:              1 * time.Hour,
+		MaxSamples:           1e10,
+		EnableNegativeOffset: true,
+		EnableAtModifier:     true,
+	}
+	step := time.Second * 30
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			oldEngine := promql.NewEngine(opts)
+			q1, err := oldEngine.NewRangeQuery(ctx, storageWithSeries(tc.series...), nil, tc.query, tc.start, tc.end, step)
+			testutil.Ok(t, err)
+
+			newEngine := engine.New(engine.Opts{EngineOpts: opts})
+			q2, err := newEngine.NewRangeQuery(ctx, storageWithSeries(tc.series...), nil, tc.query, tc.start, tc.end, step)
+			testutil.Ok(t, err)
+
+			oldResult := q1.Exec(ctx)
+			newResult := q2.Exec(ctx)
+
+			testutil.WithGoCmp(comparer).Equals(t, oldResult, newResult, queryExplanation(q1))
+		})
+	}
+}
+
+func TestAbsentLabelsLookback(t *testing.T) {
+	t.Parallel()
+
+	load := `load 1m
+	    http_requests_total{job="api", env="prod", instance="a"} 1x10
+	    http_requests_total{job="api", env="prod", instance="b"} 1x10
+	    up{job="api", env="prod", zone="eu", instance="a"} 1x10
+	    up{job="api", env="dev", instance="b"} 1x10`
+
+	cases := []struct {
+		name     string
+		query    string
+		lookback time.Duration
+		expected labels.Labels
+	}{
+		{
+			name:     "disabled",
+			query:    `absent(http_requests_total{job="api"})`,
+			expected: labels.FromStrings("job", "api"),
+		},
+		{
+			name:     "enriched with common labels",
+			query:    `absent(http_requests_total{job="api"})`,
+			lookback: time.Hour,
+			expected: labels.FromStrings("env", "prod", "job", "api"),
+		},
+		{
+			name:     "only some labels are shared",
+			query:    `absent(up{job="api"})`,
+			lookback: time.Hour,
+			expected: labels.FromStrings("job", "api"),
+		},
+		{
+			name:     "matchers take precedence",
+			query:    `absent(http_requests_total{job="api", env="dev"})`,
+			lookback: time.Hour,
+			expected: labels.FromStrings("env", "dev", "job", "api"),
+		},
+		{
+			name:     "no series in lookback window",
+			query:    `absent(http_requests_total{job="api"})`,
+			lookback: time.Minute,
+			expected: labels.FromStrings("job", "api"),
+		},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ng := engine.New(engine.Opts{
+				EngineOpts:           promql.EngineOpts{Timeout: 1 * time.Hour},
+				AbsentLabelsLookback: tc.lookback,
+			})
+			ctx := context.Background()
+			q, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(1800, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			vector, err := res.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(vector))
+			testutil.Equals(t, tc.expected, vector[0].Metric)
+		})
+	}
+}
+
+func TestMaxHistogramBuckets(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    lhs {{schema:0 count:10 sum:10 offset:1 buckets:[1 2 3 4]}}x10
+	    rhs {{schema:0 count:4 sum:4 offset:5 buckets:[1 1 1 1]}}x10`
+
+	cases := []struct {
+		name            string
+		maxBuckets      int
+		expectedSchema  int32
+		expectedBuckets int
+		expectedInfos   int
+	}{
+		{name: "disabled", expectedSchema: 0, expectedBuckets: 8},
+		{name: "within limit", maxBuckets: 8, expectedSchema: 0, expectedBuckets: 8},
+		{name: "exceeds limit", maxBuckets: 4, expectedSchema: -1, expectedBuckets: 4, expectedInfos: 1},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ng := engine.New(engine.Opts{
+				EngineOpts:          promql.EngineOpts{Timeout: 1 * time.Hour},
+				MaxHistogramBuckets: tc.maxBuckets,
+			})
+			ctx := context.Background()
+			q, err := ng.NewInstantQuery(ctx, storage, nil, `lhs + ignoring(__name__) rhs`, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			vector, err := res.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(vector))
+
+			h := vector[0].H
+			testutil.Assert(t, h != nil, "expected histogram result")
+			testutil.Equals(t, tc.expectedSchema, h.Schema)
+			testutil.Equals(t, tc.expectedBuckets, len(h.PositiveBuckets))
+			testutil.Equals(t, 14.0, h.Count)
+
+			_, infos := res.Warnings.AsStrings("", 0, 0)
+			testutil.Equals(t, tc.expectedInfos, len(infos))
+		})
+	}
+}
+
+func TestMaxHistogramBucketsDoesNotModifyOperands(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    lhs {{schema:0 count:10 sum:10 offset:1 buckets:[1 2 3 4]}}x10`
+
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	ng := engine.New(engine.Opts{
+		EngineOpts:          promql.EngineOpts{Timeout: 1 * time.Hour, EnableAtModifier: true},
+		MaxHistogramBuckets: 2,
+	})
+	ctx := context.Background()
+	// Comparisons return the lhs histogram, which step invariant operands reuse for every step.
+	// Reducing it in place would make it unequal to the rhs, which has the same value, in the following steps.
+	q, err := ng.NewRangeQuery(ctx, tstorage, nil, `lhs @ 60 == lhs`, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	defer q.Close()
+
+	res := q.Exec(ctx)
+	testutil.Ok(t, res.Err)
+	matrix, err := res.Matrix()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(matrix))
+	testutil.Equals(t, 5, len(matrix[0].Histograms))
+	for _, h := range matrix[0].Histograms {
+		testutil.Equals(t, 2, len(h.H.PositiveBuckets))
+		testutil.Equals(t, 10.0, h.H.Count)
+	}
+}
+
+func TestLabelReplaceSortsSeries(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    http_requests_total{pod="nginx-1"} 1x10
+	    http_requests_total{pod="nginx-2"} 2x10
+	    http_requests_total{pod="nginx-3"} {{schema:0 count:3 sum:3 buckets:[3]}}x10`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, 0)
+		end   = time.Unix(300, 0)
+		step  = 30 * time.Second
+		// Renaming nginx-1 moves it from the first to the last position in the sort order.
+		expr = `label_replace(http_requests_total, "pod", "nginx-9", "pod", "nginx-1")`
+	)
+	ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+
+	recorder := tap.NewBuffer(expr)
+	q, err := ng.MakeRangeQuery(ctx, storage, &engine.QueryOpts{Recorder: recorder}, expr, start, end, step)
+	testutil.Ok(t, err)
+	defer q.Close()
+	newResult := q.Exec(ctx)
+	testutil.Ok(t, newResult.Err)
+
+	recording := recorder.Recording(expr)
+	testutil.Equals(t, []labels.Labels{
+		labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-2"),
+		labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-3"),
+		labels.FromStrings(labels.MetricName, "http_requests_total", "pod", "nginx-9"),
+	}, recording.Series)
+
+	// Sample IDs need to refer to the sorted series.
+	for _, v := range recording.Vectors {
+		testutil.Equals(t, 2, len(v.Samples))
+		for i, id := range v.SampleIDs {
+			switch id {
+			case 0:
+				testutil.Equals(t, 2.0, v.Samples[i])
+			case 2:
+				testutil.Equals(t, 1.0, v.Samples[i])
+			default:
+				t.Fatalf("unexpected float sample for series %d", id)
+			}
+		}
+		testutil.Equals(t, []uint64{1}, v.HistogramIDs)
+	}
+
+	oldQ, err := promql.NewEngine(promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}).NewRangeQuery(ctx, storage, nil, expr, start, end, step)
+	testutil.Ok(t, err)
+	defer oldQ.Close()
+	testutil.WithGoCmp(comparer).Equals(t, oldQ.Exec(ctx), newResult, queryExplanation(q))
+}
+
+func TestRecorderCapturesSubexpression(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    http_requests_total{pod="nginx-1"} 1+1x20
+	    http_requests_total{pod="nginx-2"} 1+2x20
+	    http_requests_total{pod="nginx-3"} {{schema:0 count:1 sum:1 buckets:[1]}}+{{schema:0 count:1 sum:1 buckets:[1]}}x20`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	var (
+		ctx   = context.Background()
+		start = time.Unix(60, 0)
+		end   = time.Unix(300, 0)
+		step  = 30 * time.Second
+		subq  = `rate(http_requests_total[1m])`
+	)
+	ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+
+	recorder := tap.NewBuffer(subq)
+	q, err := ng.MakeRangeQuery(ctx, storage, &engine.QueryOpts{Recorder: recorder}, `sum(`+subq+`)`, start, end, step)
+	testutil.Ok(t, err)
+	defer q.Close()
+	res := q.Exec(ctx)
+	testutil.Ok(t, res.Err)
+
+	q, err = ng.NewRangeQuery(ctx, storage, nil, subq, start, end, step)
+	testutil.Ok(t, err)
+	defer q.Close()
+	expected := q.Exec(ctx)
+	testutil.Ok(t, expected.Err)
+	expectedMatrix, err := expected.Matrix()
+	testutil.Ok(t, err)
+
+	recording := recorder.Recording(subq)
+	testutil.Equals(t, len(expectedMatrix), len(recording.Series))
+
+	var floats, histograms int
+	for _, v := range recording.Vectors {
+		floats += len(v.Samples)
+		histograms += len(v.Histograms)
+	}
+	var expectedFloats, expectedHistograms int
+	for _, s := range expectedMatrix {
+		expectedFloats += len(s.Floats)
+		expectedHistograms += len(s.Histograms)
+	}
+	testutil.Equals(t, expectedFloats, floats)
+	testutil.Equals(t, expectedHistograms, histograms)
+}
+
+func TestSortOrSeries(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1"} 1x10
+	    foo{pod="nginx-2"} 2x10
+	    bar{pod="nginx-3"} 3x10
+	    bar{pod="nginx-4"} 4x10
+	    bar{pod="nginx-5"} 5x10`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	ctx := context.Background()
+	ng := engine.New(engine.Opts{
+		EngineOpts:   promql.EngineOpts{Timeout: 1 * time.Hour},
+		SortOrSeries: true,
+	})
+
+	var results []promql.Vector
+	for _, qry := range []string{`foo or bar`, `bar or foo`} {
+		q, err := ng.NewInstantQuery(ctx, storage, nil, qry, time.Unix(60, 0))
+		testutil.Ok(t, err)
+		defer q.Close()
+
+		res := q.Exec(ctx)
+		testutil.Ok(t, res.Err)
+		vector, err := res.Vector()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 5, len(vector))
+		for i := 1; i < len(vector); i++ {
+			testutil.Assert(t, vector[i-1].Metric.Hash() < vector[i].Metric.Hash(), "expected series to be sorted by hash")
+		}
+		results = append(results, vector)
+	}
+	testutil.Equals(t, results[0], results[1])
+}
+
+func TestEmptySetOperations(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1"} 1+1x10
+	    foo{pod="nginx-2"} 2+2x10
+	    bar{pod="nginx-3"} 3+3x10`
+
+	cases := []struct {
+		query         string
+		expectSamples bool
+	}{
+		{query: `nonexistent and foo`},
+		{query: `foo and nonexistent`},
+		{query: `foo and on(pod) bar`},
+		{query: `nonexistent unless foo`},
+		{query: `foo and ignoring(__name__) foo`, expectSamples: true},
+		{query: `foo unless nonexistent`, expectSamples: true},
+		{query: `sum(foo and nonexistent) or bar`, expectSamples: true},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	start, end, step := time.Unix(0, 0), time.Unix(300, 0), 30*time.Second
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ctx := context.Background()
+			promEngine := promql.NewEngine(opts)
+			q1, err := promEngine.NewRangeQuery(ctx, storage, nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			expected := q1.Exec(ctx)
+			testutil.Ok(t, expected.Err)
+
+			ng := engine.New(engine.Opts{EngineOpts: opts, EnableAnalysis: true})
+			q2, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			defer q2.Close()
+			res := q2.Exec(ctx)
+			testutil.WithGoCmp(comparer).Equals(t, expected, res)
+
+			// Operands of set operations without output series are not evaluated.
+			totalSamples := q2.(engine.ExplainableQuery).Analyze().TotalSamples()
+			testutil.Equals(t, tc.expectSamples, totalSamples > 0)
+		})
+	}
+}
+
+func TestOrWithIdenticalSeriesOnBothSides(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1"} 1 2 _ 4 5 _ 7 8 9 10
+	    foo{pod="nginx-2"} 10 _ _ 40 50 60 _ 80 90 100
+	    bar{pod="nginx-1"} 1x10`
+
+	queries := []string{
+		`foo or foo`,
+		`foo{pod="nginx-1"} or foo`,
+		`foo > 4 or foo`,
+		`foo or foo offset 30s`,
+		`foo offset 30s or foo`,
+		`sum by (pod) (foo) or sum by (pod) (foo offset 1m)`,
+		`foo or on(pod) bar`,
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	start, end, step := time.Unix(0, 0), time.Unix(300, 0), 30*time.Second
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			ctx := context.Background()
+			promEngine := promql.NewEngine(opts)
+			q1, err := promEngine.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			expected := q1.Exec(ctx)
+			testutil.Ok(t, expected.Err)
+
+			for _, sortOrSeries := range []bool{false, true} {
+				ng := engine.New(engine.Opts{EngineOpts: opts, SortOrSeries: sortOrSeries})
+				q2, err := ng.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+				testutil.Ok(t, err)
+				defer q2.Close()
+				res := q2.Exec(ctx)
+				testutil.Ok(t, res.Err)
+
+				matrix, err := res.Matrix()
+				testutil.Ok(t, err)
+				seen := make(map[uint64]struct{}, len(matrix))
+				for _, series := range matrix {
+					_, ok := seen[series.Metric.Hash()]
+					testutil.Assert(t, !ok, "duplicate output series %s", series.Metric)
+					seen[series.Metric.Hash()] = struct{}{}
+				}
+				testutil.WithGoCmp(comparer).Equals(t, expected, res, "sortOrSeries %v", sortOrSeries)
+			}
+		})
+	}
+}
+
+func TestHistogramEqualityTolerance(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1"} {{schema:0 count:3 sum:14 buckets:[1 2]}}x10
+	    bar{pod="nginx-1"} {{schema:0 count:3 sum:14.0000001 buckets:[1 2]}}x10`
+
+	cases := []struct {
+		query     string
+		tolerance float64
+		expected  int
+	}{
+		{query: `foo == ignoring(__name__) bar`, expected: 0},
+		{query: `foo != ignoring(__name__) bar`, expected: 1},
+		{query: `foo == ignoring(__name__) bar`, tolerance: 1e-6, expected: 1},
+		{query: `foo != ignoring(__name__) bar`, tolerance: 1e-6, expected: 0},
+		{query: `foo == ignoring(__name__) bar`, tolerance: 1e-12, expected: 0},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%s/tolerance=%v", tc.query, tc.tolerance), func(t *testing.T) {
+			ng := engine.New(engine.Opts{
+				EngineOpts:                 promql.EngineOpts{Timeout: 1 * time.Hour},
+				HistogramEqualityTolerance: tc.tolerance,
+			})
+			ctx := context.Background()
+			q, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			vector, err := res.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expected, len(vector))
+		})
+	}
+}
+
+func TestKeepNaNComparisons(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1"} NaN
+	    foo{pod="nginx-2"} 1
+	    bar{pod="nginx-1"} 1
+	    bar{pod="nginx-2"} NaN`
+
+	cases := []struct {
+		query    string
+		keepNaN  bool
+		expected []float64
+	}{
+		{query: `foo > ignoring(__name__) bar`},
+		{query: `foo > ignoring(__name__) bar`, keepNaN: true, expected: []float64{math.NaN(), 1}},
+		{query: `foo > bool ignoring(__name__) bar`, expected: []float64{0, 0}},
+		{query: `foo > bool ignoring(__name__) bar`, keepNaN: true, expected: []float64{1, 1}},
+		{query: `foo == 0`},
+		{query: `foo == 0`, keepNaN: true, expected: []float64{math.NaN()}},
+		{query: `0 < foo`, expected: []float64{1}},
+		{query: `0 < foo`, keepNaN: true, expected: []float64{math.NaN(), 1}},
+		{query: `foo == bool NaN`, expected: []float64{0, 0}},
+		{query: `foo == bool NaN`, keepNaN: true, expected: []float64{1, 1}},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%s/keepNaN=%v", tc.query, tc.keepNaN), func(t *testing.T) {
+			ng := engine.New(engine.Opts{
+				EngineOpts:         promql.EngineOpts{Timeout: 1 * time.Hour},
+				KeepNaNComparisons: tc.keepNaN,
+			})
+			ctx := context.Background()
+			q, err := ng.NewInstantQuery(ctx, storage, nil, `sort_by_label(`+tc.query+`, "pod")`, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			vector, err := res.Vector()
+			testutil.Ok(t, err)
+
+			values := make([]float64, 0, len(vector))
+			for _, s := range vector {
+				values = append(values, s.F)
+			}
+			testutil.Equals(t, len(tc.expected), len(values))
+			for i := range tc.expected {
+				testutil.Assert(t, tc.expected[i] == values[i] || math.IsNaN(tc.expected[i]) && math.IsNaN(values[i]),
+					"expected %v, got %v", tc.expected[i], values[i])
+			}
+		})
+	}
+}
+
+func TestDropNaNInSetOps(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1"} NaN
+	    foo{pod="nginx-2"} 1
+	    bar{pod="nginx-1"} 1
+	    bar{pod="nginx-2"} NaN`
+
+	cases := []struct {
+		query    string
+		dropNaN  bool
+		expected []string
+	}{
+		{query: `foo and ignoring(__name__) bar`, expected: []string{`{__name__="foo", pod="nginx-1"} NaN`, `{__name__="foo", pod="nginx-2"} 1`}},
+		{query: `foo and ignoring(__name__) bar`, dropNaN: true},
+		{query: `foo or ignoring(__name__) bar`, expected: []string{`{__name__="foo", pod="nginx-1"} NaN`, `{__name__="foo", pod="nginx-2"} 1`}},
+		{query: `foo or ignoring(__name__) bar`, dropNaN: true, expected: []string{`{__name__="bar", pod="nginx-1"} 1`, `{__name__="foo", pod="nginx-2"} 1`}},
+		{query: `foo unless ignoring(__name__) bar`},
+		{query: `foo unless ignoring(__name__) bar`, dropNaN: true},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%s/dropNaN=%v", tc.query, tc.dropNaN), func(t *testing.T) {
+			ng := engine.New(engine.Opts{
+				EngineOpts:      promql.EngineOpts{Timeout: 1 * time.Hour},
+				DropNaNInSetOps: tc.dropNaN,
+			})
+			ctx := context.Background()
+			q, err := ng.NewInstantQuery(ctx, storage, nil, `sort_by_label(`+tc.query+`, "__name__", "pod")`, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			vector, err := res.Vector()
+			testutil.Ok(t, err)
+
+			var got []string
+			for _, s := range vector {
+				got = append(got, fmt.Sprintf("%s %v", s.Metric.String(), s.F))
+			}
+			testutil.Equals(t, tc.expected, got)
+		})
+	}
+}
+
+func TestPermissiveManyToOne(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1", container="a"} 1
+	    foo{pod="nginx-1", container="b"} 2
+	    foo{pod="nginx-2", container="a"} 3
+	    bar{pod="nginx-1"} 10
+	    bar{pod="nginx-2"} 20`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	const query = `foo * on (pod) bar`
+	for _, permissive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("permissive=%v", permissive), func(t *testing.T) {
+			ng := engine.New(engine.Opts{
+				EngineOpts:          promql.EngineOpts{Timeout: 1 * time.Hour},
+				PermissiveManyToOne: permissive,
+			})
+			ctx := context.Background()
+			q, err := ng.NewInstantQuery(ctx, storage, nil, query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(ctx)
+			if !permissive {
+				testutil.NotOk(t, res.Err)
+				testutil.Equals(t, "multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)", res.Err.Error())
+				return
+			}
+			testutil.Ok(t, res.Err)
+			vector, err := res.Vector()
+			testutil.Ok(t, err)
+
+			var got []string
+			for _, s := range vector {
+				got = append(got, fmt.Sprintf("%s %v", s.Metric.String(), s.F))
+			}
+			slices.Sort(got)
+			testutil.Equals(t, []string{`{pod="nginx-1"} 10`, `{pod="nginx-2"} 60`}, got)
+
+			_, infos := res.Warnings.AsStrings(query, 0, 0)
+			testutil.Equals(t, []string{"PromQL info: multiple matches for labels, many-to-one matching must be explicit (group_left/group_right), keeping the first match in * operation"}, infos)
+		})
+	}
+}
+
+func TestSkipManyToManyMatches(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1"} 1 1
+	    foo{pod="nginx-2"} 2 2
+	    bar{pod="nginx-1", container="a"} 10 10
+	    bar{pod="nginx-1", container="b"} 20 20
+	    bar{pod="nginx-2", container="a"} 30 40
+	    histogram_bar{pod="nginx-1"} {{schema:0 count:3 sum:6 buckets:[1 2]}} {{schema:0 count:3 sum:6 buckets:[1 2]}}
+	    histogram_bar{pod="nginx-2"} {{schema:0 count:5 sum:10 buckets:[2 3]}} {{schema:0 count:5 sum:10 buckets:[2 3]}}
+	    histogram_baz{pod="nginx-1"} {{schema:0 count:3 sum:6 buckets:[1 2]}} {{schema:0 count:3 sum:6 buckets:[1 2]}}`
+
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	ctx := context.Background()
+	exec := func(t *testing.T, skip bool, qs string) *promql.Result {
+		ng := engine.New(engine.Opts{
+			EngineOpts:            promql.EngineOpts{Timeout: 1 * time.Hour},
+			SkipManyToManyMatches: skip,
+		})
+		q, err := ng.NewRangeQuery(ctx, tstorage, nil, qs, time.Unix(0, 0), time.Unix(30, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		t.Cleanup(q.Close)
+		return q.Exec(ctx)
+	}
+
+	t.Run("floats", func(t *testing.T) {
+		const qs = `foo * on (pod) bar`
+		res := exec(t, false, qs)
+		testutil.NotOk(t, res.Err)
+		strictErr := res.Err.Error()
+
+		// The group of nginx-2 has a single match, so it is still evaluated.
+		res = exec(t, true, qs)
+		testutil.Ok(t, res.Err)
+		matrix, err := res.Matrix()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(matrix))
+		testutil.Equals(t, labels.FromStrings("pod", "nginx-2"), matrix[0].Metric)
+		testutil.Equals(t, []promql.FPoint{{T: 0, F: 60}, {T: 30000, F: 80}}, matrix[0].Floats)
+
+		warns, _ := res.Warnings.AsStrings(qs, 0, 0)
+		testutil.Equals(t, []string{"PromQL warning: skipped matching group with multiple matches in * operation: " + strictErr}, warns)
+	})
+
+	t.Run("histograms", func(t *testing.T) {
+		const qs = `foo * on (pod) group_left {__name__=~"histogram_.*"}`
+		testutil.NotOk(t, exec(t, false, qs).Err)
+
+		res := exec(t, true, qs)
+		testutil.Ok(t, res.Err)
+		matrix, err := res.Matrix()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(matrix))
+		testutil.Equals(t, labels.FromStrings("pod", "nginx-2"), matrix[0].Metric)
+		testutil.Equals(t, 2, len(matrix[0].Histograms))
+		for _, h := range matrix[0].Histograms {
+			testutil.Equals(t, 10.0, h.H.Count)
+		}
+		warns, _ := res.Warnings.AsStrings(qs, 0, 0)
+		testutil.Equals(t, 1, len(warns))
+	})
+}
+
+func TestOrWithHistogramOnlySeries(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    float_metric{pod="nginx-1"} 1
+	    histogram_metric{pod="nginx-2"} {{schema:0 count:3 sum:14.00 buckets:[1 2]}}`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, query := range []string{`float_metric or histogram_metric`, `histogram_metric or float_metric`} {
+		t.Run(query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+			ctx := context.Background()
+			q, err := ng.NewInstantQuery(ctx, storage, nil, query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			vector, err := res.Vector()
+			testutil.Ok(t, err)
+			slices.SortFunc(vector, func(a, b promql.Sample) int { return labels.Compare(a.Metric, b.Metric) })
+
+			testutil.Equals(t, 2, len(vector))
+			testutil.Equals(t, `{__name__="float_metric", pod="nginx-1"}`, vector[0].Metric.String())
+			testutil.Equals(t, 1.0, vector[0].F)
+			testutil.Equals(t, `{__name__="histogram_metric", pod="nginx-2"}`, vector[1].Metric.String())
+			testutil.Assert(t, vector[1].H != nil, "expected a histogram sample")
+			testutil.Equals(t, 14.0, vector[1].H.Sum)
+		})
+	}
+}
+
+func TestMaxOrSeries(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1"} 1
+	    foo{pod="nginx-2"} 2
+	    bar{pod="nginx-3"} 3`
+
+	cases := []struct {
+		query       string
+		maxOrSeries int
+		expectedErr string
 	}{
-		{
-			name: "binop edge case",
-			series: []storage.Series{
-				newMockSeries(
-					[]string{labels.MetricName, "foo"},
-					[]int64{0, 30, 60, 1200, 1500, 1800},
-					[]float64{1, 2, 3, 4, 5, 6},
-				),
-				newMockSeries(
-					[]string{labels.MetricName, "bar", "id", "1"},
-					[]int64{0, 30},
-					[]float64{1, 2},
-				),
-				newMockSeries(
-					[]string{labels.MetricName, "bar", "id", "2"},
-					[]int64{1200, 1500},
-					[]float64{3, 4},
-				),
-			},
-			query: `foo * on () group_left () bar`,
-			start: time.Unix(0, 0),
-			end:   time.Unix(30000, 0),
-		},
-		{
-			name: "absent with gaps in series",
-			series: []storage.Series{
-				newMockSeries(
-					[]string{labels.MetricName, "foo"},
-					[]int64{30, 300, 3000, 6000, 12000, 18000},
-					[]float64{1, 2, 3, 4, 5, 6},
-				),
-			},
-			query: `absent(foo)`,
-			start: time.Unix(0, 0),
-			end:   time.Unix(30000, 0),
-		},
+		{query: `foo or bar`},
+		{query: `foo or bar`, maxOrSeries: 3},
+		{query: `foo or bar`, maxOrSeries: 2, expectedErr: `"or" operation exceeds the limit of 2 series: lhs has 2 series, rhs has 1 series`},
+		{query: `foo and bar`, maxOrSeries: 2},
+		{query: `foo unless bar`, maxOrSeries: 2},
 	}
 
-	opts := promql.EngineOpts{
-		Timeout:              1 * time.Hour,
-		MaxSamples:           1e10,
-		EnableNegativeOffset: true,
-		EnableAtModifier:     true,
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%s/maxOrSeries=%d", tc.query, tc.maxOrSeries), func(t *testing.T) {
+			ng := engine.New(engine.Opts{
+				EngineOpts:  promql.EngineOpts{Timeout: 1 * time.Hour},
+				MaxOrSeries: tc.maxOrSeries,
+			})
+			ctx := context.Background()
+			q, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(ctx)
+			if tc.expectedErr != "" {
+				testutil.NotOk(t, res.Err)
+				testutil.Equals(t, tc.expectedErr, res.Err.Error())
+				return
+			}
+			testutil.Ok(t, res.Err)
+		})
 	}
-	step := time.Second * 30
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			t.Parallel()
+}
+
+func TestRoundSignificantDigits(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1"} 1.23456789
+	    foo{pod="nginx-2"} -98765.4321
+	    native_histogram {{schema:0 count:3 sum:14.123456 buckets:[1 2]}}`
+
+	cases := []struct {
+		query     string
+		digits    int
+		expected  []float64
+		histogram bool
+	}{
+		{query: `foo`, expected: []float64{1.23456789, -98765.4321}},
+		{query: `foo`, digits: 3, expected: []float64{1.23, -98800}},
+		{query: `foo / 3`, digits: 5, expected: []float64{0.41152, -32922}},
+		{query: `scalar(foo{pod="nginx-1"})`, digits: 2, expected: []float64{1.2}},
+		{query: `native_histogram`, digits: 2, histogram: true},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%s/digits=%d", tc.query, tc.digits), func(t *testing.T) {
+			ng := engine.New(engine.Opts{
+				EngineOpts:             promql.EngineOpts{Timeout: 1 * time.Hour},
+				RoundSignificantDigits: tc.digits,
+			})
 			ctx := context.Background()
-			oldEngine := promql.NewEngine(opts)
-			q1, err := oldEngine.NewRangeQuery(ctx, storageWithSeries(tc.series...), nil, tc.query, tc.start, tc.end, step)
+			q, err := ng.NewInstantQuery(ctx, storage, nil, tc.query, time.Unix(0, 0))
 			testutil.Ok(t, err)
+			defer q.Close()
 
-			newEngine := engine.New(engine.Opts{EngineOpts: opts})
-			q2, err := newEngine.NewRangeQuery(ctx, storageWithSeries(tc.series...), nil, tc.query, tc.start, tc.end, step)
+			res := q.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			if scalar, err := res.Scalar(); err == nil {
+				testutil.Equals(t, tc.expected, []float64{scalar.V})
+				return
+			}
+			vector, err := res.Vector()
 			testutil.Ok(t, err)
+			if tc.histogram {
+				testutil.Equals(t, 1, len(vector))
+				testutil.Equals(t, 14.123456, vector[0].H.Sum)
+				return
+			}
+			slices.SortFunc(vector, func(a, b promql.Sample) int { return labels.Compare(a.Metric, b.Metric) })
+			values := make([]float64, 0, len(vector))
+			for _, s := range vector {
+				values = append(values, s.F)
+			}
+			testutil.Equals(t, tc.expected, values)
+		})
+	}
+}
 
-			oldResult := q1.Exec(ctx)
-			newResult := q2.Exec(ctx)
+func TestManyToManyMatchErrorOnLowCardSide(t *testing.T) {
+	t.Parallel()
 
-			testutil.WithGoCmp(comparer).Equals(t, oldResult, newResult, queryExplanation(q1))
+	load := `load 30s
+	    foo{pod="nginx-1"} 1
+	    bar{pod="nginx-1", container="a"} 1
+	    bar{pod="nginx-1", container="b"} 2
+	    baz{pod="nginx-1", container="a"} 1
+	    baz{pod="nginx-1", container="b"} 2
+	    baz{pod="nginx-1", container="c"} 3`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	ctx := context.Background()
+
+	t.Run("two series", func(t *testing.T) {
+		// With two series the error matches the one returned by Prometheus.
+		query := `foo * on (pod) group_left bar`
+		q1, err := engine.New(engine.Opts{EngineOpts: opts}).NewInstantQuery(ctx, storage, nil, query, time.Unix(0, 0))
+		testutil.Ok(t, err)
+		defer q1.Close()
+		q2, err := promql.NewEngine(opts).NewInstantQuery(ctx, storage, nil, query, time.Unix(0, 0))
+		testutil.Ok(t, err)
+		defer q2.Close()
+
+		newResult, oldResult := q1.Exec(ctx), q2.Exec(ctx)
+		testutil.NotOk(t, newResult.Err)
+		testutil.NotOk(t, oldResult.Err)
+		testutil.Equals(t, oldResult.Err.Error(), newResult.Err.Error())
+	})
+
+	t.Run("more than two series", func(t *testing.T) {
+		query := `foo * on (pod) group_left baz`
+		q, err := engine.New(engine.Opts{EngineOpts: opts}).NewInstantQuery(ctx, storage, nil, query, time.Unix(0, 0))
+		testutil.Ok(t, err)
+		defer q.Close()
+
+		res := q.Exec(ctx)
+		testutil.NotOk(t, res.Err)
+		for _, container := range []string{"a", "b", "c"} {
+			series := fmt.Sprintf(`{__name__="baz", container="%s", pod="nginx-1"}`, container)
+			testutil.Assert(t, strings.Contains(res.Err.Error(), series), "expected %s in error %q", series, res.Err.Error())
+		}
+	})
+}
+
+func TestNestedLoopJoin(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    http_requests_total{pod="nginx-1", job="api"} 1+1x20
+	    http_requests_total{pod="nginx-2", job="api"} 2+2x20
+	    http_requests_total{pod="nginx-3", job="web"} 3+3x20
+	    http_requests_total{pod="nginx-4", job="web"} _ _ 4+4x18
+	    job_info{job="api", team="a"} 1x20
+	    job_info{job="web", team="b"} 1x10
+	    scale{pod="nginx-1", job="api"} 10x20
+	    dup{job="api", instance="a"} 1x20
+	    dup{job="api", instance="b"} 1x20`
+
+	queries := []string{
+		`http_requests_total * on(job) group_left(team) job_info`,
+		`job_info * on(job) group_right(team) http_requests_total`,
+		`http_requests_total * ignoring(__name__) scale`,
+		`http_requests_total > bool on(pod) scale`,
+		`http_requests_total and on(job) job_info`,
+		`http_requests_total or scale`,
+		`http_requests_total unless on(pod) scale`,
+		`http_requests_total + on(job) dup`,
+		`http_requests_total * on(job) group_left dup`,
+		`http_requests_total + on(job) job_info`,
+		`http_requests_total * on() group_left sum(scale)`,
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	start, end, step := time.Unix(0, 0), time.Unix(600, 0), 30*time.Second
+	for _, query := range queries {
+		t.Run(query, func(t *testing.T) {
+			ctx := context.Background()
+			promEngine := promql.NewEngine(opts)
+			q1, err := promEngine.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			expected := q1.Exec(ctx)
+
+			for _, threshold := range []int{1, 2, 100} {
+				ng := engine.New(engine.Opts{EngineOpts: opts, NestedLoopJoinThreshold: threshold})
+				q2, err := ng.NewRangeQuery(ctx, storage, nil, query, start, end, step)
+				testutil.Ok(t, err)
+				defer q2.Close()
+				testutil.WithGoCmp(comparer).Equals(t, expected, q2.Exec(ctx), "threshold %d", threshold)
+			}
 		})
 	}
 }
@@ -3357,11 +5402,60 @@ func TestInstantQuery(t *testing.T) {
 	t.Parallel()
 
 	defaultQueryTime := time.Unix(50, 0)
+	schemaExtremesLoad := `load 30s
+	    coarse {{schema:-2 count:4 sum:10 buckets:[2 2]}}x10
+	    fine {{schema:8 count:4 sum:8 offset:256 buckets:[2 2]}}x10`
+	floatEdgeCasesLoad := `load 30s
+	    zero 0
+	    half 0.5
+	    neg_one -1
+	    not_a_number NaN
+	    pos_inf Inf
+	    neg_inf -Inf`
+	nanLoad := `load 30s
+	    http_requests_total{pod="nginx-1", job="a"} NaN NaN NaN NaN NaN NaN NaN NaN NaN NaN NaN
+	    http_requests_total{pod="nginx-2", job="a"} 1+1x10
+	    http_requests_total{pod="nginx-3", job="b"} -1-1x10
+	    http_requests_total{pod="nginx-4", job="b"} NaN NaN NaN NaN NaN NaN NaN NaN NaN NaN NaN
+	    http_requests_total{pod="nginx-5", job="c"} NaN NaN NaN NaN NaN NaN NaN NaN NaN NaN NaN`
+	floatsAndHistogramsLoad := `load 30s
+	    histograms_only {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10
+	    floats_then_histograms 1 2 3 {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x7
+	    histograms_then_floats {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x3 1 2 3 4 5 6 7`
+	gaugeHistogramLoad := `load 30s
+	    gauge_histogram {{schema:0 count:3 sum:14.00 buckets:[1 2] counter_reset_hint:gauge}}+{{schema:0 count:1 sum:2.00 buckets:[0 1] counter_reset_hint:gauge}}x10
+	    counter_histogram {{schema:0 count:3 sum:14.00 buckets:[1 2]}}+{{schema:0 count:1 sum:2.00 buckets:[0 1]}}x10`
+	histogramQuantileLoad := `load 30s
+	    classic_bucket{le="1"} 1x10
+	    classic_bucket{le="2"} 2x10
+	    classic_bucket{le="+Inf"} 3x10
+	    native_histogram {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10`
+	linearRegressionLoad := `load 30s
+	    floats_then_histograms 1 2 3 {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x3
+	    histograms_then_floats {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x3 1 2 3
+	    only_histograms {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x6
+	    only_floats 1+1x6`
+	histogramFractionLoad := `load 30s
+	    classic_bucket{le="1"} 1x10
+	    classic_bucket{le="2"} 2x10
+	    classic_bucket{le="+Inf"} 3x10
+	    native_histogram {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10
+	    float_series 1x10`
+	histogramSchemasLoad := `load 30s
+	    coarse_histogram{pod="nginx-1"} {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10
+	    fine_histogram{pod="nginx-1"} {{schema:2 count:9 sum:20.00 z_bucket:1 z_bucket_w:0.001 buckets:[1 2 3 2]}}x10`
+	absentLoad := `load 30s
+	    float_series{job="api"} 1+1x10
+	    native_histogram{job="api"} {{schema:0 count:3 sum:14.00 buckets:[1 2]}}x10`
 	cases := []struct {
 		load      string
 		name      string
 		query     string
 		queryTime time.Time
+		// compareAnnotations compares the warnings and infos of the query with the ones of Prometheus.
+		compareAnnotations bool
+		// additionalInfos are infos which the engine returns in addition to the ones of Prometheus.
+		additionalInfos []string
 	}{
 		{
 			name: "eval instant at 2m ts_of_min_over_time, with 2m lookback",
@@ -3786,58 +5880,112 @@ min without () (
 			query:     `label_join(http_requests_total, "label", "-", "pod", "series")`,
 		},
 		{
-			name: "label_join with non-existing src labels",
+			name: "label_join with non-existing src labels",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+			    http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+			    http_requests_total{pod="nginx-4", series="3"} 5+2.4x50`,
+			queryTime: time.Unix(160, 0),
+			query:     `label_join(http_requests_total, "label", "-", "test", "fake")`,
+		},
+		{
+			name: "label_join with overwrite dst label if exists",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", series="1", label="test-1"} 1+1.1x40
+			    http_requests_total{pod="nginx-2", series="2", label="test-2"} 2+2.3x50
+			    http_requests_total{pod="nginx-4", series="3", label="test-3"} 5+2.4x50`,
+			queryTime: time.Unix(160, 0),
+			query:     `label_join(http_requests_total, "label", "-", "pod", "series")`,
+		},
+		{
+			name: "label_join with no src labels provided",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+			    http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+			    http_requests_total{pod="nginx-4", series="3"} 5+2.4x50`,
+			queryTime: time.Unix(160, 0),
+			query:     `label_join(http_requests_total, "label", "-")`,
+		},
+		{
+			name: "label_replace",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+			    http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+			    http_requests_total{pod="nginx-4", series="3"} 5+2.4x50`,
+			queryTime: time.Unix(160, 0),
+			query:     `label_replace(http_requests_total, "foo", "$1", "series", ".*")`,
+		},
+		{
+			name: "label_replace with bad regular expression",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+			    http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+			    http_requests_total{pod="nginx-4", series="3"} 5+2.4x50`,
+			queryTime: time.Unix(160, 0),
+			query:     `label_replace(http_requests_total, "foo", "$1", "series", "]]")`,
+		},
+		{
+			name: "label_replace non-existing src label",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+			    http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+			    http_requests_total{pod="nginx-4", series="3"} 5+2.4x50`,
+			queryTime: time.Unix(160, 0),
+			query:     `label_replace(http_requests_total, "foo", "$1", "bar", ".*")`,
+		},
+		{
+			name: "label_replace with capture group",
 			load: `load 30s
 			    http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
 			    http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
 			    http_requests_total{pod="nginx-4", series="3"} 5+2.4x50`,
 			queryTime: time.Unix(160, 0),
-			query:     `label_join(http_requests_total, "label", "-", "test", "fake")`,
+			query:     `label_replace(http_requests_total, "idx", "$1", "pod", "nginx-(.*)")`,
 		},
 		{
-			name: "label_join with overwrite dst label if exists",
+			name: "label_replace with named capture group",
 			load: `load 30s
-			    http_requests_total{pod="nginx-1", series="1", label="test-1"} 1+1.1x40
-			    http_requests_total{pod="nginx-2", series="2", label="test-2"} 2+2.3x50
-			    http_requests_total{pod="nginx-4", series="3", label="test-3"} 5+2.4x50`,
+			    http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
+			    http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
+			    http_requests_total{pod="nginx-4", series="3"} 5+2.4x50`,
 			queryTime: time.Unix(160, 0),
-			query:     `label_join(http_requests_total, "label", "-", "pod", "series")`,
+			query:     `label_replace(http_requests_total, "idx", "${num}-${num}", "pod", "nginx-(?P<num>.*)")`,
 		},
 		{
-			name: "label_join with no src labels provided",
+			name: "label_replace with non-matching regular expression",
 			load: `load 30s
 			    http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
 			    http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
 			    http_requests_total{pod="nginx-4", series="3"} 5+2.4x50`,
 			queryTime: time.Unix(160, 0),
-			query:     `label_join(http_requests_total, "label", "-")`,
+			query:     `label_replace(http_requests_total, "idx", "$1", "pod", "apache-(.*)")`,
 		},
 		{
-			name: "label_replace",
+			name: "label_replace with partially matching regular expression",
 			load: `load 30s
 			    http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
 			    http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
 			    http_requests_total{pod="nginx-4", series="3"} 5+2.4x50`,
 			queryTime: time.Unix(160, 0),
-			query:     `label_replace(http_requests_total, "foo", "$1", "series", ".*")`,
+			query:     `label_replace(http_requests_total, "idx", "$1", "pod", "nginx")`,
 		},
 		{
-			name: "label_replace with bad regular expression",
+			name: "label_replace in place",
 			load: `load 30s
 			    http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
 			    http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
 			    http_requests_total{pod="nginx-4", series="3"} 5+2.4x50`,
 			queryTime: time.Unix(160, 0),
-			query:     `label_replace(http_requests_total, "foo", "$1", "series", "]]")`,
+			query:     `label_replace(http_requests_total, "pod", "web-$1", "pod", "nginx-(.*)")`,
 		},
 		{
-			name: "label_replace non-existing src label",
+			name: "label_replace with empty replacement",
 			load: `load 30s
 			    http_requests_total{pod="nginx-1", series="1"} 1+1.1x40
 			    http_requests_total{pod="nginx-2", series="2"} 2+2.3x50
 			    http_requests_total{pod="nginx-4", series="3"} 5+2.4x50`,
 			queryTime: time.Unix(160, 0),
-			query:     `label_replace(http_requests_total, "foo", "$1", "bar", ".*")`,
+			query:     `label_replace(http_requests_total, "series", "", "pod", "nginx-.*")`,
 		},
 		{
 			name: "topk",
@@ -4313,6 +6461,20 @@ min without () (
 			    http_requests_total{pod="nginx-2"} 1+2x18`,
 			query: `resets(http_requests_total[5m])`,
 		},
+		{
+			name: "resets with native histograms",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} {{schema:0 count:3 sum:5 buckets:[1 2]}} {{schema:0 count:5 sum:9 buckets:[2 3]}} {{schema:0 count:2 sum:3 buckets:[1 1]}} {{schema:0 count:4 sum:7 buckets:[2 2]}}
+			    http_requests_total{pod="nginx-2"} {{schema:0 count:3 sum:5 buckets:[1 2]}} {{schema:1 count:5 sum:9 buckets:[1 1 1 2]}} {{schema:0 count:7 sum:12 buckets:[3 4]}} 8`,
+			query: `resets(http_requests_total[2m])`,
+		},
+		{
+			name: "changes with native histograms",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1"} {{schema:0 count:3 sum:5 buckets:[1 2]}} {{schema:0 count:3 sum:5 buckets:[1 2]}} {{schema:0 count:4 sum:7 buckets:[2 2]}} {{schema:0 count:4 sum:7 buckets:[2 2]}}
+			    http_requests_total{pod="nginx-2"} {{schema:0 count:3 sum:5 buckets:[1 2]}} {{schema:1 count:3 sum:5 buckets:[0 1 1 1]}} {{schema:1 count:3 sum:5 buckets:[0 1 1 1]}} 3`,
+			query: `changes(http_requests_total[2m])`,
+		},
 		{
 			name: "present_over_time",
 			load: `load 30s
@@ -4592,29 +6754,614 @@ min without () (
 			query: `absent_over_time(http_requests_total @ start()[1h:1m])`,
 		},
 		{
-			name: "absent_over_time fuzzer findings",
-			load: `load 30s
-			    http_requests_total{pod="nginx-1", route="/"} 0.02+1.00x40
-			    http_requests_total{pod="nginx-2", route="/"} -24+0.67x40`,
-			query: `
-  count without (route, pod) ({__name__="http_requests_total"} @ 153.689)
->
-  absent_over_time({__name__="http_requests_total",route="/"}[3m] offset 1m45s)`,
+			name: "absent_over_time fuzzer findings",
+			load: `load 30s
+			    http_requests_total{pod="nginx-1", route="/"} 0.02+1.00x40
+			    http_requests_total{pod="nginx-2", route="/"} -24+0.67x40`,
+			query: `
+  count without (route, pod) ({__name__="http_requests_total"} @ 153.689)
+>
+  absent_over_time({__name__="http_requests_total",route="/"}[3m] offset 1m45s)`,
+		},
+		{
+			name: "sort_by_label",
+			load: `load 30s
+			    http_requests{job="api-server", instance="0", group="production"}	0+10x10
+			    http_requests{job="api-server", instance="1", group="production"}	0+20x10
+			    http_requests{job="api-server", instance="0", group="canary"}		0+30x10
+			    http_requests{job="api-server", instance="1", group="canary"}		0+40x10
+			    http_requests{job="api-server", instance="2", group="canary"}		NaN NaN NaN NaN NaN NaN NaN NaN NaN NaN
+			    http_requests{job="app-server", instance="0", group="production"}	0+50x10
+			    http_requests{job="app-server", instance="1", group="production"}	0+60x10
+			    http_requests{job="app-server", instance="0", group="canary"}		0+70x10
+			    http_requests{job="app-server", instance="1", group="canary"}		0+80x10
+			    http_requests{job="api-server", instance="2", group="production"}	0+10x10`,
+			query: `sort_by_label_desc(http_requests, "instance")`,
+		},
+		{
+			name: "sort_by_label with multiple labels",
+			load: `load 30s
+			    http_requests{job="api-server", instance="1", group="production"}	0+10x10
+			    http_requests{job="api-server", instance="0", group="production"}	0+20x10
+			    http_requests{job="api-server", instance="10", group="canary"}		0+30x10
+			    http_requests{job="api-server", instance="2", group="canary"}		0+40x10
+			    http_requests{job="app-server", instance="1", group="canary"}		0+50x10
+			    http_requests{job="app-server", instance="0", group="production"}	0+60x10
+			    http_requests{job="app-server", instance="0", group="canary", env="prod"}	0+70x10
+			    http_requests{job="app-server", instance="0", group="canary"}		0+80x10`,
+			query: `sort_by_label(http_requests, "group", "instance")`,
+		},
+		{
+			name: "sort_by_label_desc with multiple labels",
+			load: `load 30s
+			    http_requests{job="api-server", instance="1", group="production"}	0+10x10
+			    http_requests{job="api-server", instance="0", group="production"}	0+20x10
+			    http_requests{job="api-server", instance="10", group="canary"}		0+30x10
+			    http_requests{job="api-server", instance="2", group="canary"}		0+40x10
+			    http_requests{job="app-server", instance="1", group="canary"}		0+50x10
+			    http_requests{job="app-server", instance="0", group="production"}	0+60x10
+			    http_requests{job="app-server", instance="0", group="canary", env="prod"}	0+70x10
+			    http_requests{job="app-server", instance="0", group="canary"}		0+80x10`,
+			query: `sort_by_label_desc(http_requests, "group", "instance")`,
+		},
+		{
+			name: "sort_by_label with missing labels",
+			load: `load 30s
+			    http_requests{job="api-server", instance="1"}				0+10x10
+			    http_requests{job="api-server", group="canary"}				0+20x10
+			    http_requests{job="app-server", instance="0", group="canary"}	0+30x10
+			    http_requests{job="app-server"}								0+40x10
+			    http_requests{job="app-server", group="production"}			0+50x10`,
+			query: `sort_by_label(http_requests, "group", "instance")`,
+		},
+		{
+			name:      "histogram_quantile with schema -2: 0.25",
+			load:      schemaExtremesLoad,
+			query:     `histogram_quantile(0.25, coarse)`,
+			queryTime: time.Unix(60, 0),
+		},
+		{
+			name:      "histogram_quantile with schema -2: 0.5",
+			load:      schemaExtremesLoad,
+			query:     `histogram_quantile(0.5, coarse)`,
+			queryTime: time.Unix(60, 0),
+		},
+		{
+			name:      "histogram_quantile with schema -2: 0.75",
+			load:      schemaExtremesLoad,
+			query:     `histogram_quantile(0.75, coarse)`,
+			queryTime: time.Unix(60, 0),
+		},
+		{
+			name:      "histogram_quantile with schema -2: 1",
+			load:      schemaExtremesLoad,
+			query:     `histogram_quantile(1, coarse)`,
+			queryTime: time.Unix(60, 0),
+		},
+		{
+			name:      "histogram_quantile with schema 8: 0.25",
+			load:      schemaExtremesLoad,
+			query:     `histogram_quantile(0.25, fine)`,
+			queryTime: time.Unix(60, 0),
+		},
+		{
+			name:      "histogram_quantile with schema 8: 0.5",
+			load:      schemaExtremesLoad,
+			query:     `histogram_quantile(0.5, fine)`,
+			queryTime: time.Unix(60, 0),
+		},
+		{
+			name:      "histogram_quantile with schema 8: 0.75",
+			load:      schemaExtremesLoad,
+			query:     `histogram_quantile(0.75, fine)`,
+			queryTime: time.Unix(60, 0),
+		},
+		{
+			name:      "histogram_quantile with schema 8: 1",
+			load:      schemaExtremesLoad,
+			query:     `histogram_quantile(1, fine)`,
+			queryTime: time.Unix(60, 0),
+		},
+		{
+			name:      "float edge case zero ^ zero",
+			load:      floatEdgeCasesLoad,
+			query:     `zero ^ zero`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case not_a_number ^ zero",
+			load:      floatEdgeCasesLoad,
+			query:     `not_a_number ^ zero`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case not_a_number ^ 0",
+			load:      floatEdgeCasesLoad,
+			query:     `not_a_number ^ 0`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case zero ^ not_a_number",
+			load:      floatEdgeCasesLoad,
+			query:     `zero ^ not_a_number`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case 0 ^ not_a_number",
+			load:      floatEdgeCasesLoad,
+			query:     `0 ^ not_a_number`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case zero ^ neg_one",
+			load:      floatEdgeCasesLoad,
+			query:     `zero ^ neg_one`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case zero ^ pos_inf",
+			load:      floatEdgeCasesLoad,
+			query:     `zero ^ pos_inf`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case zero ^ neg_inf",
+			load:      floatEdgeCasesLoad,
+			query:     `zero ^ neg_inf`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case neg_one ^ pos_inf",
+			load:      floatEdgeCasesLoad,
+			query:     `neg_one ^ pos_inf`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case neg_one ^ half",
+			load:      floatEdgeCasesLoad,
+			query:     `neg_one ^ half`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case half ^ pos_inf",
+			load:      floatEdgeCasesLoad,
+			query:     `half ^ pos_inf`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case half ^ neg_inf",
+			load:      floatEdgeCasesLoad,
+			query:     `half ^ neg_inf`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case pos_inf ^ neg_one",
+			load:      floatEdgeCasesLoad,
+			query:     `pos_inf ^ neg_one`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case neg_inf ^ half",
+			load:      floatEdgeCasesLoad,
+			query:     `neg_inf ^ half`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case neg_inf ^ 3",
+			load:      floatEdgeCasesLoad,
+			query:     `neg_inf ^ 3`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case exp(pos_inf)",
+			load:      floatEdgeCasesLoad,
+			query:     `exp(pos_inf)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case exp(neg_inf)",
+			load:      floatEdgeCasesLoad,
+			query:     `exp(neg_inf)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case exp(not_a_number)",
+			load:      floatEdgeCasesLoad,
+			query:     `exp(not_a_number)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case ln(zero)",
+			load:      floatEdgeCasesLoad,
+			query:     `ln(zero)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case ln(neg_one)",
+			load:      floatEdgeCasesLoad,
+			query:     `ln(neg_one)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case ln(pos_inf)",
+			load:      floatEdgeCasesLoad,
+			query:     `ln(pos_inf)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case log2(zero)",
+			load:      floatEdgeCasesLoad,
+			query:     `log2(zero)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case log2(neg_inf)",
+			load:      floatEdgeCasesLoad,
+			query:     `log2(neg_inf)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case log2(half)",
+			load:      floatEdgeCasesLoad,
+			query:     `log2(half)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case log10(zero)",
+			load:      floatEdgeCasesLoad,
+			query:     `log10(zero)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case log10(neg_one)",
+			load:      floatEdgeCasesLoad,
+			query:     `log10(neg_one)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "float edge case log10(pos_inf)",
+			load:      floatEdgeCasesLoad,
+			query:     `log10(pos_inf)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "topk(1, http_requests_total) with NaN at 0s",
+			load:      nanLoad,
+			query:     `topk(1, http_requests_total)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "topk(1, http_requests_total) with NaN at 150s",
+			load:      nanLoad,
+			query:     `topk(1, http_requests_total)`,
+			queryTime: time.Unix(150, 0),
+		},
+		{
+			name:      "bottomk(1, http_requests_total) with NaN at 0s",
+			load:      nanLoad,
+			query:     `bottomk(1, http_requests_total)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "bottomk(1, http_requests_total) with NaN at 150s",
+			load:      nanLoad,
+			query:     `bottomk(1, http_requests_total)`,
+			queryTime: time.Unix(150, 0),
+		},
+		{
+			name:      "topk by (job) (1, http_requests_total) with NaN at 0s",
+			load:      nanLoad,
+			query:     `topk by (job) (1, http_requests_total)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "topk by (job) (1, http_requests_total) with NaN at 150s",
+			load:      nanLoad,
+			query:     `topk by (job) (1, http_requests_total)`,
+			queryTime: time.Unix(150, 0),
+		},
+		{
+			name:      "bottomk by (job) (1, http_requests_total) with NaN at 0s",
+			load:      nanLoad,
+			query:     `bottomk by (job) (1, http_requests_total)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "bottomk by (job) (1, http_requests_total) with NaN at 150s",
+			load:      nanLoad,
+			query:     `bottomk by (job) (1, http_requests_total)`,
+			queryTime: time.Unix(150, 0),
+		},
+		{
+			name:      "topk(2, http_requests_total) with NaN at 0s",
+			load:      nanLoad,
+			query:     `topk(2, http_requests_total)`,
+			queryTime: time.Unix(0, 0),
+		},
+		{
+			name:      "topk(2, http_requests_total) with NaN at 150s",
+			load:      nanLoad,
+			query:     `topk(2, http_requests_total)`,
+			queryTime: time.Unix(150, 0),
+		},
+		{
+			name:               "quantile_over_time(0.5, histograms_only[1m])",
+			load:               floatsAndHistogramsLoad,
+			query:              `quantile_over_time(0.5, histograms_only[1m])`,
+			queryTime:          time.Unix(120, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "quantile_over_time(0.5, floats_then_histograms[2m])",
+			load:               floatsAndHistogramsLoad,
+			query:              `quantile_over_time(0.5, floats_then_histograms[2m])`,
+			queryTime:          time.Unix(120, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "quantile_over_time(0.5, histograms_then_floats[2m])",
+			load:               floatsAndHistogramsLoad,
+			query:              `quantile_over_time(0.5, histograms_then_floats[2m])`,
+			queryTime:          time.Unix(150, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "quantile_over_time(0.5, histograms_then_floats[1m])",
+			load:               floatsAndHistogramsLoad,
+			query:              `quantile_over_time(0.5, histograms_then_floats[1m])`,
+			queryTime:          time.Unix(270, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "rate(gauge_histogram[2m])",
+			load:               gaugeHistogramLoad,
+			query:              `rate(gauge_histogram[2m])`,
+			queryTime:          time.Unix(240, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "increase(gauge_histogram[2m])",
+			load:               gaugeHistogramLoad,
+			query:              `increase(gauge_histogram[2m])`,
+			queryTime:          time.Unix(240, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "irate(gauge_histogram[2m])",
+			load:               gaugeHistogramLoad,
+			query:              `irate(gauge_histogram[2m])`,
+			queryTime:          time.Unix(240, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "rate(gauge_histogram[2m:30s])",
+			load:               gaugeHistogramLoad,
+			query:              `rate(gauge_histogram[2m:30s])`,
+			queryTime:          time.Unix(240, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "irate(gauge_histogram[2m:30s])",
+			load:               gaugeHistogramLoad,
+			query:              `irate(gauge_histogram[2m:30s])`,
+			queryTime:          time.Unix(240, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "rate(counter_histogram[2m])",
+			load:               gaugeHistogramLoad,
+			query:              `rate(counter_histogram[2m])`,
+			queryTime:          time.Unix(240, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "rate(counter_histogram[2m:30s])",
+			load:               gaugeHistogramLoad,
+			query:              `rate(counter_histogram[2m:30s])`,
+			queryTime:          time.Unix(240, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "delta(counter_histogram[2m:30s])",
+			load:               gaugeHistogramLoad,
+			query:              `delta(counter_histogram[2m:30s])`,
+			queryTime:          time.Unix(240, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "histogram_quantile(-0.5, classic_bucket)",
+			load:               histogramQuantileLoad,
+			query:              `histogram_quantile(-0.5, classic_bucket)`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "histogram_quantile(1.5, classic_bucket)",
+			load:               histogramQuantileLoad,
+			query:              `histogram_quantile(1.5, classic_bucket)`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "histogram_quantile(-0.5, native_histogram)",
+			load:               histogramQuantileLoad,
+			query:              `histogram_quantile(-0.5, native_histogram)`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "histogram_quantile(1.5, native_histogram)",
+			load:               histogramQuantileLoad,
+			query:              `histogram_quantile(1.5, native_histogram)`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "histogram_quantile(0.5, native_histogram)",
+			load:               histogramQuantileLoad,
+			query:              `histogram_quantile(0.5, native_histogram)`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "deriv(floats_then_histograms[3m])",
+			load:               linearRegressionLoad,
+			query:              `deriv(floats_then_histograms[3m])`,
+			queryTime:          time.Unix(180, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "deriv(histograms_then_floats[3m])",
+			load:               linearRegressionLoad,
+			query:              `deriv(histograms_then_floats[3m])`,
+			queryTime:          time.Unix(180, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "deriv(only_histograms[3m])",
+			load:               linearRegressionLoad,
+			query:              `deriv(only_histograms[3m])`,
+			queryTime:          time.Unix(180, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "deriv(only_floats[3m])",
+			load:               linearRegressionLoad,
+			query:              `deriv(only_floats[3m])`,
+			queryTime:          time.Unix(180, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "predict_linear(floats_then_histograms[3m], 60)",
+			load:               linearRegressionLoad,
+			query:              `predict_linear(floats_then_histograms[3m], 60)`,
+			queryTime:          time.Unix(180, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "predict_linear(histograms_then_floats[3m], 60)",
+			load:               linearRegressionLoad,
+			query:              `predict_linear(histograms_then_floats[3m], 60)`,
+			queryTime:          time.Unix(180, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "predict_linear(only_histograms[3m], 60)",
+			load:               linearRegressionLoad,
+			query:              `predict_linear(only_histograms[3m], 60)`,
+			queryTime:          time.Unix(180, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "predict_linear(only_floats[3m], 60)",
+			load:               linearRegressionLoad,
+			query:              `predict_linear(only_floats[3m], 60)`,
+			queryTime:          time.Unix(180, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "histogram_fraction(0, 2, native_histogram)",
+			load:               histogramFractionLoad,
+			query:              `histogram_fraction(0, 2, native_histogram)`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			// The engine adds the metric name to the warning about the missing bucket label.
+			name:      "histogram_fraction(2, 0, float_series)",
+			load:      histogramFractionLoad,
+			query:     `histogram_fraction(2, 0, float_series)`,
+			queryTime: time.Unix(60, 0),
+		},
+		{
+			name:               "histogram_fraction(2, 0, non_existent)",
+			load:               histogramFractionLoad,
+			query:              `histogram_fraction(2, 0, non_existent)`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "histogram_fraction(1, 1, native_histogram)",
+			load:               histogramFractionLoad,
+			query:              `histogram_fraction(1, 1, native_histogram)`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "histogram_fraction(2, 0, native_histogram)",
+			load:               histogramFractionLoad,
+			query:              `histogram_fraction(2, 0, native_histogram)`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+			additionalInfos: []string{
+				`PromQL info: lower bound of histogram_fraction is greater than its upper bound, got lower bound 2 and upper bound 0`,
+			},
+		},
+		{
+			name:               "histogram_fraction(2, 0.5, classic_bucket)",
+			load:               histogramFractionLoad,
+			query:              `histogram_fraction(2, 0.5, classic_bucket)`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+			additionalInfos: []string{
+				`PromQL info: lower bound of histogram_fraction is greater than its upper bound, got lower bound 2 and upper bound 0.5`,
+			},
+		},
+		{
+			name:               "coarse_histogram + ignoring(__name__) coarse_histogram",
+			load:               histogramSchemasLoad,
+			query:              `coarse_histogram + ignoring(__name__) coarse_histogram`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "coarse_histogram + ignoring(__name__) fine_histogram",
+			load:               histogramSchemasLoad,
+			query:              `coarse_histogram + ignoring(__name__) fine_histogram`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "fine_histogram - ignoring(__name__) coarse_histogram",
+			load:               histogramSchemasLoad,
+			query:              `fine_histogram - ignoring(__name__) coarse_histogram`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "absent(histogram_count(float_series))",
+			load:               absentLoad,
+			query:              `absent(histogram_count(float_series))`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "absent(histogram_quantile(2, native_histogram))",
+			load:               absentLoad,
+			query:              `absent(histogram_quantile(2, native_histogram))`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "absent(histogram_quantile(-1, native_histogram{job=\"web\"}))",
+			load:               absentLoad,
+			query:              `absent(histogram_quantile(-1, native_histogram{job="web"}))`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
+		},
+		{
+			name:               "absent(rate(float_series[1m]))",
+			load:               absentLoad,
+			query:              `absent(rate(float_series[1m]))`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
 		},
 		{
-			name: "sort_by_label",
-			load: `load 30s
-			    http_requests{job="api-server", instance="0", group="production"}	0+10x10
-			    http_requests{job="api-server", instance="1", group="production"}	0+20x10
-			    http_requests{job="api-server", instance="0", group="canary"}		0+30x10
-			    http_requests{job="api-server", instance="1", group="canary"}		0+40x10
-			    http_requests{job="api-server", instance="2", group="canary"}		NaN NaN NaN NaN NaN NaN NaN NaN NaN NaN
-			    http_requests{job="app-server", instance="0", group="production"}	0+50x10
-			    http_requests{job="app-server", instance="1", group="production"}	0+60x10
-			    http_requests{job="app-server", instance="0", group="canary"}		0+70x10
-			    http_requests{job="app-server", instance="1", group="canary"}		0+80x10
-			    http_requests{job="api-server", instance="2", group="production"}	0+10x10`,
-			query: `sort_by_label_desc(http_requests, "instance")`,
+			name:               "absent_over_time(histogram_quantile(2, native_histogram)[1m:30s])",
+			load:               absentLoad,
+			query:              `absent_over_time(histogram_quantile(2, native_histogram)[1m:30s])`,
+			queryTime:          time.Unix(60, 0),
+			compareAnnotations: true,
 		},
 	}
 
@@ -4651,6 +7398,7 @@ min without () (
 						newEngine := engine.New(engine.Opts{
 							EngineOpts:        opts,
 							LogicalOptimizers: optimizers,
+							ValidateSeriesIDs: true,
 						})
 
 						ctx := context.Background()
@@ -4666,6 +7414,18 @@ min without () (
 						defer q2.Close()
 
 						oldResult := q2.Exec(ctx)
+						if tc.compareAnnotations {
+							// The comparer discards annotations, so they need to be compared first.
+							oldWarnings, oldInfos := oldResult.Warnings.AsStrings("", 0, 0)
+							newWarnings, newInfos := newResult.Warnings.AsStrings("", 0, 0)
+							oldInfos = append(oldInfos, tc.additionalInfos...)
+							slices.Sort(oldWarnings)
+							slices.Sort(newWarnings)
+							slices.Sort(oldInfos)
+							slices.Sort(newInfos)
+							testutil.Equals(t, oldWarnings, newWarnings, queryExplanation(q1))
+							testutil.Equals(t, oldInfos, newInfos, queryExplanation(q1))
+						}
 						testutil.WithGoCmp(comparer).Equals(t, oldResult, newResult, queryExplanation(q1))
 					}
 				})
@@ -4674,6 +7434,210 @@ min without () (
 	}
 }
 
+func TestSetOperationsRejectGrouping(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		card        parser.VectorMatchCardinality
+		include     []string
+		expectedErr string
+	}{
+		{name: "group_left with labels", card: parser.CardManyToOne, include: []string{"instance"}, expectedErr: "no grouping allowed for %q operation"},
+		{name: "empty group_left", card: parser.CardManyToOne, expectedErr: "no grouping allowed for %q operation"},
+		{name: "empty group_right", card: parser.CardOneToMany, expectedErr: "no grouping allowed for %q operation"},
+		{name: "one-to-one", card: parser.CardOneToOne, expectedErr: "set operations must always be many-to-many"},
+	}
+	for _, tc := range cases {
+		for _, op := range []string{"and", "or", "unless"} {
+			t.Run(fmt.Sprintf("%s/%s", tc.name, op), func(t *testing.T) {
+				expr, err := parser.ParseExpr(fmt.Sprintf("foo %s on (job) bar", op))
+				testutil.Ok(t, err)
+				plan, err := logicalplan.NewFromAST(expr, &query.Options{}, logicalplan.PlanOptions{})
+				testutil.Ok(t, err)
+
+				// Grouping modifiers are rejected by the parser for set operations,
+				// so we need to add them to the logical plan directly.
+				var binary *logicalplan.Binary
+				root := plan.Root()
+				logicalplan.Traverse(&root, func(node *logicalplan.Node) {
+					if b, ok := (*node).(*logicalplan.Binary); ok {
+						binary = b
+					}
+				})
+				testutil.Assert(t, binary != nil, "expected binary expression in plan")
+				binary.VectorMatching.Card = tc.card
+				binary.VectorMatching.Include = tc.include
+
+				ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+				_, err = ng.MakeInstantQueryFromPlan(context.Background(), storageWithSeries(), &engine.QueryOpts{}, root, time.Unix(0, 0))
+				testutil.NotOk(t, err)
+				testutil.Equals(t, strings.ReplaceAll(tc.expectedErr, "%q", strconv.Quote(op)), err.Error())
+			})
+		}
+	}
+}
+
+func TestArithmeticOperationsRejectReturnBool(t *testing.T) {
+	t.Parallel()
+
+	for _, op := range []string{"+", "-", "*", "/", "%", "^", "atan2"} {
+		for _, format := range []string{"foo %s bar", "foo %s 2", "2 %s foo"} {
+			qs := fmt.Sprintf(format, op)
+			t.Run(qs, func(t *testing.T) {
+				expr, err := parser.ParseExpr(qs)
+				testutil.Ok(t, err)
+				plan, err := logicalplan.NewFromAST(expr, &query.Options{}, logicalplan.PlanOptions{})
+				testutil.Ok(t, err)
+
+				// The bool modifier is rejected by the parser for arithmetic operations,
+				// so we need to add it to the logical plan directly.
+				root := plan.Root()
+				binary, ok := root.(*logicalplan.Binary)
+				testutil.Assert(t, ok, "expected binary expression as root of the plan")
+				binary.ReturnBool = true
+
+				ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+				_, err = ng.MakeInstantQueryFromPlan(context.Background(), storageWithSeries(), &engine.QueryOpts{}, root, time.Unix(0, 0))
+				testutil.NotOk(t, err)
+				testutil.Equals(t, fmt.Sprintf("bool modifier can only be used on comparison operators, got %q", op), err.Error())
+			})
+		}
+	}
+}
+
+func TestSetOperationsRejectReturnBool(t *testing.T) {
+	t.Parallel()
+
+	for _, op := range []string{"and", "or", "unless"} {
+		qs := fmt.Sprintf("foo %s bar", op)
+		t.Run(qs, func(t *testing.T) {
+			expr, err := parser.ParseExpr(qs)
+			testutil.Ok(t, err)
+			plan, err := logicalplan.NewFromAST(expr, &query.Options{}, logicalplan.PlanOptions{})
+			testutil.Ok(t, err)
+
+			// The bool modifier is rejected by the parser for set operations,
+			// so we need to add it to the logical plan directly.
+			root := plan.Root()
+			binary, ok := root.(*logicalplan.Binary)
+			testutil.Assert(t, ok, "expected binary expression as root of the plan")
+			binary.ReturnBool = true
+
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+			_, err = ng.MakeInstantQueryFromPlan(context.Background(), storageWithSeries(), &engine.QueryOpts{}, root, time.Unix(0, 0))
+			testutil.NotOk(t, err)
+			testutil.Equals(t, fmt.Sprintf("bool modifier can only be used on comparison operators, got %q", op), err.Error())
+		})
+	}
+}
+
+func TestBinaryKeepMetricName(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1"} 1+1x10
+	    bar{pod="nginx-1"} 2+2x10`
+
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{query: `foo * 2`, expected: `{__name__="foo", pod="nginx-1"}`},
+		{query: `2 * foo`, expected: `{__name__="foo", pod="nginx-1"}`},
+		{query: `foo * bar`, expected: `{__name__="foo", pod="nginx-1"}`},
+		{query: `foo < bool bar`, expected: `{__name__="foo", pod="nginx-1"}`},
+		{query: `foo > bool 0`, expected: `{__name__="foo", pod="nginx-1"}`},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tc.query)
+			testutil.Ok(t, err)
+			plan, err := logicalplan.NewFromAST(expr, &query.Options{}, logicalplan.PlanOptions{})
+			testutil.Ok(t, err)
+
+			// There is no PromQL syntax for keeping the metric name, so we need to set it on the logical plan directly.
+			root := plan.Root()
+			binary, ok := root.(*logicalplan.Binary)
+			testutil.Assert(t, ok, "expected binary expression as root of the plan")
+			binary.KeepMetricName = true
+			// The flag is not part of the string representation, which needs to stay valid PromQL.
+			testutil.Equals(t, tc.query, binary.String())
+
+			ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}})
+			q, err := ng.MakeInstantQueryFromPlan(context.Background(), storage, &engine.QueryOpts{}, root, time.Unix(60, 0))
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(context.Background())
+			testutil.Ok(t, res.Err)
+			vector, err := res.Vector()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(vector))
+			testutil.Equals(t, tc.expected, vector[0].Metric.String())
+		})
+	}
+}
+
+func TestScalarOperandWithNegativeOffsetPinnedByAt(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    metric{pod="nginx-1"} 1+1x240
+	    metric{pod="nginx-2"} 2+2x240
+	    x 1+3x240`
+
+	cases := []struct {
+		query         string
+		stepInvariant bool
+	}{
+		// The @ modifier makes the scalar operand step-invariant, regardless of the offset.
+		{query: `metric / scalar(x offset -1h @ end())`, stepInvariant: true},
+		{query: `metric / scalar(x @ start() offset -1h)`, stepInvariant: true},
+		// A negative offset alone still selects different samples at each step.
+		{query: `metric / scalar(x offset -1h)`},
+	}
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10, EnableNegativeOffset: true, EnableAtModifier: true}
+	start, end, step := time.Unix(0, 0), time.Unix(3600, 0), 30*time.Second
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ctx := context.Background()
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			q1, err := ng.NewRangeQuery(ctx, storage, nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			newResult := q1.Exec(ctx)
+			testutil.Ok(t, newResult.Err)
+
+			q2, err := promql.NewEngine(opts).NewRangeQuery(ctx, storage, nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			defer q2.Close()
+			testutil.WithGoCmp(comparer).Equals(t, q2.Exec(ctx), newResult, queryExplanation(q1))
+
+			var stepInvariant bool
+			var find func(engine.ExplainOutputNode)
+			find = func(n engine.ExplainOutputNode) {
+				if n.OperatorName == "[stepInvariant]" {
+					stepInvariant = true
+				}
+				for _, c := range n.Children {
+					find(c)
+				}
+			}
+			find(*q1.(engine.ExplainableQuery).Explain())
+			testutil.Equals(t, tc.stepInvariant, stepInvariant)
+		})
+	}
+}
+
 func TestQueryCancellation(t *testing.T) {
 	twelveHours := int64(12 * time.Hour.Seconds())
 
@@ -5820,6 +8784,18 @@ histogram_sum(
 			name:  "histogram_count * histogram aggregation",
 			query: `scalar(histogram_count(sum(native_histogram_series))) * sum(native_histogram_series)`,
 		},
+		{
+			name:  "per-step scalar * histogram",
+			query: `time() * native_histogram_series`,
+		},
+		{
+			name:  "histogram * per-step scalar",
+			query: `native_histogram_series * time()`,
+		},
+		{
+			name:  "histogram / per-step scalar",
+			query: `native_histogram_series / (time() + 1)`,
+		},
 		{
 			name:  "histogram_fraction",
 			query: `histogram_fraction(0, 0.2, native_histogram_series)`,
@@ -5894,6 +8870,26 @@ and
 			name:  "limit_ratio by",
 			query: `limit_ratio(0.33, native_histogram_series) by (foo) or native_histogram_series`,
 		},
+		{
+			name:  "histogram equality",
+			query: `native_histogram_series == native_histogram_series`,
+		},
+		{
+			name:  "histogram inequality",
+			query: `native_histogram_series != native_histogram_series`,
+		},
+		{
+			name:  "histogram equality with group_left",
+			query: `native_histogram_series == on (foo) group_left sum by (foo) (native_histogram_series)`,
+		},
+		{
+			name:  "histogram equality with group_right",
+			query: `sum by (foo) (native_histogram_series) == on (foo) group_right native_histogram_series`,
+		},
+		{
+			name:  "float division by histogram with group_right",
+			query: `histogram_count(sum by (foo) (native_histogram_series)) / on (foo) group_right native_histogram_series`,
+		},
 	}
 
 	defer pprof.StopCPUProfile()
@@ -6613,3 +9609,367 @@ func TestDoubleExponentialSmoothing(t *testing.T) {
 		})
 	}
 }
+
+func TestMaxAnnotations(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    gauge_a{pod="a"} 1+1x10
+	    gauge_b{pod="b"} 1+1x10
+	    gauge_c{pod="c"} 1+1x10
+	    gauge_d{pod="d"} 1+1x10
+	    gauge_e{pod="e"} 1+1x10`
+
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	// Each selector produces its own "might not be a counter" info annotation.
+	qs := `rate(gauge_a[1m]) or rate(gauge_b[1m]) or rate(gauge_c[1m]) or rate(gauge_d[1m]) or rate(gauge_e[1m])`
+	truncated := "PromQL warning: annotations truncated, only the first 3 annotations were retained"
+
+	cases := []struct {
+		name           string
+		maxAnnotations int
+		expectedInfos  int
+		expectedWarns  []string
+	}{
+		{name: "no limit", maxAnnotations: 0, expectedInfos: 5},
+		{name: "limit not reached", maxAnnotations: 5, expectedInfos: 5},
+		{name: "limit exceeded", maxAnnotations: 3, expectedInfos: 3, expectedWarns: []string{truncated}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			ng := engine.New(engine.Opts{
+				EngineOpts:     promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10},
+				MaxAnnotations: tc.maxAnnotations,
+			})
+			q, err := ng.NewRangeQuery(ctx, tstorage, nil, qs, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+
+			res := q.Exec(ctx)
+			testutil.Ok(t, res.Err)
+			matrix, err := res.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 5, len(matrix))
+
+			warns, infos := res.Warnings.AsStrings(qs, 0, 0)
+			testutil.Equals(t, tc.expectedInfos, len(infos))
+			testutil.Equals(t, len(tc.expectedWarns), len(warns))
+			if len(tc.expectedWarns) > 0 {
+				testutil.Equals(t, tc.expectedWarns, warns)
+			}
+		})
+	}
+}
+
+func TestComparisonWithBoolModifier(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    up{job="api"} 1 0 1 0 1
+	    up{job="db"} 0 0 1 1 1
+	    expected_up{job="api"} 1 1 1 1 1
+	    expected_up{job="db"} 0 1 0 1 0
+	    native_histogram{job="api"} {{schema:0 count:3 sum:6 buckets:[1 2]}}x4
+	    native_histogram{job="db"} {{schema:0 count:5 sum:10 buckets:[2 3]}}x4`
+
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	ctx := context.Background()
+	start, end, step := time.Unix(0, 0), time.Unix(120, 0), 30*time.Second
+
+	t.Run("values", func(t *testing.T) {
+		ng := engine.New(engine.Opts{EngineOpts: opts})
+		q, err := ng.NewRangeQuery(ctx, tstorage, nil, `up == bool 1`, start, end, step)
+		testutil.Ok(t, err)
+		defer q.Close()
+		res := q.Exec(ctx)
+		testutil.Ok(t, res.Err)
+
+		// False comparisons emit 0 instead of dropping the sample, and the metric name is dropped.
+		matrix, err := res.Matrix()
+		testutil.Ok(t, err)
+		sort.Sort(matrix)
+		testutil.Equals(t, 2, len(matrix))
+		expected := map[string][]float64{
+			"api": {1, 0, 1, 0, 1},
+			"db":  {0, 0, 1, 1, 1},
+		}
+		for _, s := range matrix {
+			testutil.Equals(t, labels.FromStrings("job", s.Metric.Get("job")), s.Metric)
+			testutil.Equals(t, 0, len(s.Histograms))
+			values := make([]float64, 0, len(s.Floats))
+			for _, f := range s.Floats {
+				values = append(values, f.F)
+			}
+			testutil.Equals(t, expected[s.Metric.Get("job")], values)
+		}
+	})
+
+	for _, qs := range []string{
+		`up == bool 1`,
+		`1 == bool up`,
+		`up == bool expected_up`,
+		`up != bool on(job) expected_up`,
+		`native_histogram == bool native_histogram`,
+		`native_histogram{job="api"} == bool ignoring(job) native_histogram{job="db"}`,
+	} {
+		t.Run(qs, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			q1, err := ng.NewRangeQuery(ctx, tstorage, nil, qs, start, end, step)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			newResult := q1.Exec(ctx)
+			testutil.Ok(t, newResult.Err)
+
+			q2, err := promql.NewEngine(opts).NewRangeQuery(ctx, tstorage, nil, qs, start, end, step)
+			testutil.Ok(t, err)
+			defer q2.Close()
+			testutil.WithGoCmp(comparer).Equals(t, q2.Exec(ctx), newResult, queryExplanation(q1))
+		})
+	}
+}
+
+func TestRateExtrapolationClampedAtZero(t *testing.T) {
+	t.Parallel()
+
+	load := `load 1m
+	    sparse_counter_total _ 5 15 25 _ _ _ 45
+	    zero_counter_total _ 0 10 20 _ _ _ 60
+	    reset_counter_total _ 30 5 15 _ 25 _ _ 40
+	    sparse_histogram _ {{schema:0 count:2 sum:4 buckets:[1 1]}} {{schema:0 count:10 sum:20 buckets:[5 5]}} _ _ {{schema:0 count:18 sum:36 buckets:[9 9]}}`
+
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	ctx := context.Background()
+
+	t.Run("value", func(t *testing.T) {
+		// The extrapolated start of the range would be below zero, so extrapolation stops
+		// where the counter reaches zero: 20 * (120s + 30s) / 120s.
+		qs := `increase(sparse_counter_total[3m])`
+		ng := engine.New(engine.Opts{EngineOpts: opts})
+		q, err := ng.NewInstantQuery(ctx, tstorage, nil, qs, time.Unix(180, 0))
+		testutil.Ok(t, err)
+		defer q.Close()
+		res := q.Exec(ctx)
+		testutil.Ok(t, res.Err)
+		vector, err := res.Vector()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(vector))
+		testutil.Equals(t, 25.0, vector[0].F)
+	})
+
+	for _, qs := range []string{
+		`increase(sparse_counter_total[3m])`,
+		`rate(sparse_counter_total[3m])`,
+		`increase(sparse_counter_total[5m])`,
+		`increase(zero_counter_total[3m])`,
+		`rate(zero_counter_total[4m])`,
+		`increase(reset_counter_total[3m])`,
+		`rate(reset_counter_total[5m])`,
+		`increase(sparse_histogram[3m])`,
+		`rate(sparse_histogram[5m])`,
+		`delta(sparse_counter_total[3m])`,
+	} {
+		t.Run(qs, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			q1, err := ng.NewRangeQuery(ctx, tstorage, nil, qs, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			newResult := q1.Exec(ctx)
+			testutil.Ok(t, newResult.Err)
+
+			q2, err := promql.NewEngine(opts).NewRangeQuery(ctx, tstorage, nil, qs, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q2.Close()
+			testutil.WithGoCmp(comparer).Equals(t, q2.Exec(ctx), newResult, queryExplanation(q1))
+		})
+	}
+}
+
+func TestBinaryWithNestedScalarOperands(t *testing.T) {
+	t.Parallel()
+
+	load := `load 30s
+	    foo{pod="nginx-1"} 1+1x10
+	    foo{pod="nginx-2"} 5+2x10
+	    bar{pod="nginx-1"} 2+1x10
+	    bar{pod="nginx-2"} 6+3x10`
+
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10, EnableAtModifier: true}
+	ctx := context.Background()
+	start, end, step := time.Unix(0, 0), time.Unix(300, 0), 30*time.Second
+
+	// The series of both operands are resolved concurrently, so the queries are executed
+	// concurrently to find data races when running with the race detector.
+	const concurrency = 4
+	for _, qs := range []string{
+		`foo * scalar(sum(bar))`,
+		`scalar(sum(bar)) - foo`,
+		`foo / (scalar(bar{pod="nginx-1"}) + scalar(sum(bar)))`,
+		`foo > bool scalar(max(bar @ 60))`,
+		`(foo * 2) + (scalar(sum(rate(bar[1m]))) * 3)`,
+		`scalar(sum(foo)) * scalar(sum(bar))`,
+	} {
+		t.Run(qs, func(t *testing.T) {
+			q, err := promql.NewEngine(opts).NewRangeQuery(ctx, tstorage, nil, qs, start, end, step)
+			testutil.Ok(t, err)
+			defer q.Close()
+			promResult := q.Exec(ctx)
+			testutil.Ok(t, promResult.Err)
+
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			var wg sync.WaitGroup
+			results := make([]*promql.Result, concurrency)
+			queries := make([]promql.Query, concurrency)
+			for i := range concurrency {
+				queries[i], err = ng.NewRangeQuery(ctx, tstorage, nil, qs, start, end, step)
+				testutil.Ok(t, err)
+				defer queries[i].Close()
+			}
+			for i := range concurrency {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					results[i] = queries[i].Exec(ctx)
+				}()
+			}
+			wg.Wait()
+			for i := range concurrency {
+				testutil.WithGoCmp(comparer).Equals(t, promResult, results[i], queryExplanation(queries[i]))
+			}
+		})
+	}
+}
+
+func TestHistogramCountOverRanges(t *testing.T) {
+	t.Parallel()
+
+	// The count of the histogram grows by 6 every 30s.
+	load := `load 30s
+	    native_histogram {{schema:0 count:6 sum:12 buckets:[2 4]}}+{{schema:0 count:6 sum:12 buckets:[2 4]}}x40`
+
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	ctx := context.Background()
+	start, end, step := time.Unix(300, 0), time.Unix(900, 0), 30*time.Second
+
+	t.Run("values", func(t *testing.T) {
+		ng := engine.New(engine.Opts{EngineOpts: opts})
+		q, err := ng.NewRangeQuery(ctx, tstorage, nil, `histogram_count(rate(native_histogram[5m]))`, start, end, step)
+		testutil.Ok(t, err)
+		defer q.Close()
+		res := q.Exec(ctx)
+		testutil.Ok(t, res.Err)
+
+		matrix, err := res.Matrix()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(matrix))
+		testutil.Equals(t, 0, len(matrix[0].Histograms))
+		testutil.Equals(t, 21, len(matrix[0].Floats))
+		for _, f := range matrix[0].Floats {
+			testutil.Assert(t, math.Abs(f.F-0.2) < 1e-9, "unexpected rate of observations %v at %d", f.F, f.T)
+		}
+	})
+
+	for _, qs := range []string{
+		`histogram_count(rate(native_histogram[5m]))`,
+		`histogram_count(increase(native_histogram[5m]))`,
+		`histogram_count(native_histogram[5m:1m])`,
+		`histogram_count(last_over_time(native_histogram[5m:1m]))`,
+		`max_over_time(histogram_count(native_histogram)[5m:1m])`,
+		`histogram_count(rate(native_histogram[5m:1m]))`,
+		`histogram_count(sum(rate(native_histogram[5m]))) / histogram_sum(sum(rate(native_histogram[5m])))`,
+	} {
+		t.Run(qs, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			q1, err := ng.NewRangeQuery(ctx, tstorage, nil, qs, start, end, step)
+			q2, perr := promql.NewEngine(opts).NewRangeQuery(ctx, tstorage, nil, qs, start, end, step)
+			if perr != nil {
+				// histogram_count only accepts instant vectors, so both engines need to reject range vectors.
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			defer q1.Close()
+			defer q2.Close()
+			newResult := q1.Exec(ctx)
+			testutil.Ok(t, newResult.Err)
+			testutil.WithGoCmp(comparer).Equals(t, q2.Exec(ctx), newResult, queryExplanation(q1))
+		})
+	}
+}
+
+func TestHistogramComparisonFilters(t *testing.T) {
+	t.Parallel()
+
+	// The histograms of nginx-1 are equal at the first and third step, the ones of nginx-2 are never equal.
+	load := `load 30s
+	    lhs_histogram{pod="nginx-1"} {{schema:0 count:3 sum:6 buckets:[1 2]}} {{schema:0 count:3 sum:6 buckets:[1 2]}} {{schema:0 count:5 sum:10 buckets:[2 3]}}
+	    rhs_histogram{pod="nginx-1"} {{schema:0 count:3 sum:6 buckets:[1 2]}} {{schema:0 count:4 sum:8 buckets:[2 2]}} {{schema:0 count:5 sum:10 buckets:[2 3]}}
+	    lhs_histogram{pod="nginx-2"} {{schema:0 count:7 sum:14 buckets:[3 4]}}x2
+	    rhs_histogram{pod="nginx-2"} {{schema:0 count:8 sum:16 buckets:[4 4]}}x2`
+
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour, MaxSamples: 1e10}
+	ctx := context.Background()
+	start, end, step := time.Unix(0, 0), time.Unix(60, 0), 30*time.Second
+
+	cases := []struct {
+		query string
+		// expected are the counts of the returned histograms of each pod.
+		expected map[string][]float64
+	}{
+		{
+			query:    `lhs_histogram == on (pod) rhs_histogram`,
+			expected: map[string][]float64{"nginx-1": {3, 5}},
+		},
+		{
+			query: `lhs_histogram != on (pod) rhs_histogram`,
+			expected: map[string][]float64{
+				"nginx-1": {3},
+				"nginx-2": {7, 7, 7},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts})
+			q1, err := ng.NewRangeQuery(ctx, tstorage, nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			defer q1.Close()
+			newResult := q1.Exec(ctx)
+			testutil.Ok(t, newResult.Err)
+
+			// Only the lhs histograms for which the comparison is true are returned.
+			matrix, err := newResult.Matrix()
+			testutil.Ok(t, err)
+			got := make(map[string][]float64)
+			for _, s := range matrix {
+				testutil.Equals(t, 0, len(s.Floats))
+				for _, h := range s.Histograms {
+					got[s.Metric.Get("pod")] = append(got[s.Metric.Get("pod")], h.H.Count)
+				}
+			}
+			testutil.Equals(t, tc.expected, got)
+
+			q2, err := promql.NewEngine(opts).NewRangeQuery(ctx, tstorage, nil, tc.query, start, end, step)
+			testutil.Ok(t, err)
+			defer q2.Close()
+			testutil.WithGoCmp(comparer).Equals(t, q2.Exec(ctx), newResult, queryExplanation(q1))
+		})
+	}
+}
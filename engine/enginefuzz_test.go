@@ -67,6 +67,13 @@ func shouldValidateSamples(expr parser.Expr) bool {
 				valid = false
 				return errors.New("error")
 			}
+		case *parser.BinaryExpr:
+			if n.Op == parser.LAND || n.Op == parser.LUNLESS {
+				// Operands are not evaluated in Thanos engine when the result has no series
+				// and will return smaller samples than Prometheus engine.
+				valid = false
+				return errors.New("error")
+			}
 		}
 		return nil
 	})
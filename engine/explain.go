@@ -4,6 +4,8 @@
 package engine
 
 import (
+	"context"
+	"slices"
 	"sync"
 
 	"github.com/thanos-io/promql-engine/execution/model"
@@ -18,12 +20,17 @@ type ExplainableQuery interface {
 
 	Explain() *ExplainOutputNode
 	Analyze() *AnalyzeOutputNode
+	EstimateMemory(ctx context.Context) (int64, error)
 }
 
 type AnalyzeOutputNode struct {
 	OperatorTelemetry telemetry.OperatorTelemetry `json:"telemetry,omitempty"`
 	Children          []*AnalyzeOutputNode        `json:"children,omitempty"`
 
+	// shared is set for all but the first occurrence of an operator whose output is shared
+	// between subexpressions, so that its samples are only counted once.
+	shared bool
+
 	once                sync.Once
 	totalSamples        int64
 	peakSamples         int64
@@ -57,12 +64,16 @@ func (a *AnalyzeOutputNode) aggregateSamples() {
 		if nodeSamples := a.OperatorTelemetry.Samples(); nodeSamples != nil {
 			a.totalSamples += nodeSamples.TotalSamples
 			a.peakSamples += int64(nodeSamples.PeakSamples)
-			a.totalSamplesPerStep = nodeSamples.TotalSamplesPerStep
+			// Operators shared between subexpressions have one node per consumer, so their samples are not modified in place.
+			a.totalSamplesPerStep = slices.Clone(nodeSamples.TotalSamplesPerStep)
 		}
 
 		for _, child := range a.Children {
 			childPeak := child.PeakSamples()
 			a.peakSamples = max(a.peakSamples, childPeak)
+			if child.shared {
+				continue
+			}
 
 			switch a.OperatorTelemetry.LogicalNode().(type) {
 			case *logicalplan.Subquery:
@@ -83,18 +94,22 @@ func (a *AnalyzeOutputNode) aggregateSamples() {
 	})
 }
 
-func analyzeQuery(obsv telemetry.ObservableVectorOperator) *AnalyzeOutputNode {
+func analyzeQuery(obsv telemetry.ObservableVectorOperator, seen map[telemetry.ObservableVectorOperator]struct{}) *AnalyzeOutputNode {
+	_, shared := seen[obsv]
+	seen[obsv] = struct{}{}
+
 	children := obsv.Explain()
 	var childTelemetry []*AnalyzeOutputNode
 	for _, child := range children {
 		if obsChild, ok := child.(telemetry.ObservableVectorOperator); ok {
-			childTelemetry = append(childTelemetry, analyzeQuery(obsChild))
+			childTelemetry = append(childTelemetry, analyzeQuery(obsChild, seen))
 		}
 	}
 
 	return &AnalyzeOutputNode{
 		OperatorTelemetry: obsv,
 		Children:          childTelemetry,
+		shared:            shared,
 	}
 }
 
@@ -5,6 +5,7 @@ package engine_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"runtime"
 	"strings"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
 
 	"github.com/efficientgo/core/testutil"
 	"github.com/prometheus/prometheus/model/labels"
@@ -61,6 +63,18 @@ func TestQueryExplain(t *testing.T) {
 			query:    `foo`,
 			expected: &engine.ExplainOutputNode{OperatorName: "[coalesce]", Children: concurrencyOperators},
 		},
+		{
+			query: `vector(time())`,
+			expected: &engine.ExplainOutputNode{OperatorName: "[function] vector([time()])", Children: []engine.ExplainOutputNode{
+				{OperatorName: "[duplicateLabelCheck]", Children: []engine.ExplainOutputNode{
+					{OperatorName: "[noArgFunction]"},
+				}},
+			}},
+		},
+		{
+			query:    `2 > bool 3`,
+			expected: &engine.ExplainOutputNode{OperatorName: "[numberLiteral] 0"},
+		},
 		{
 			query: `sum by (job) (foo)`,
 			expected: &engine.ExplainOutputNode{
@@ -108,6 +122,480 @@ func TestQueryExplain(t *testing.T) {
 	}
 }
 
+func TestQueryExplainJoinSides(t *testing.T) {
+	t.Parallel()
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	series := []storage.Series{
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "foo"}),
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "bar", "pod", "nginx-1"}),
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "bar", "pod", "nginx-2"}),
+	}
+
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    `bar * on () group_left foo`,
+			expected: "[vectorBinary] * - many-to-one, on: [], group: [], high-card: left (2 series), low-card: right (1 series), signature: on []",
+		},
+		{
+			query:    `foo * on () group_right bar`,
+			expected: "[vectorBinary] * - one-to-many, on: [], group: [], high-card: right (2 series), low-card: left (1 series), signature: on []",
+		},
+		{
+			query:    `bar * on (pod, job) bar`,
+			expected: "[vectorBinary] * - one-to-one, on: [pod job], group: [], high-card: left (2 series), low-card: right (2 series), signature: on [job pod]",
+		},
+		{
+			query:    `bar * ignoring (pod) group_left foo`,
+			expected: "[vectorBinary] * - many-to-one, ignoring: [pod], group: [], high-card: left (2 series), low-card: right (1 series), signature: ignoring [__name__ pod]",
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts, DisableDuplicateLabelChecks: true})
+			ctx := context.Background()
+
+			query, err := ng.NewInstantQuery(ctx, storageWithSeries(series...), nil, tc.query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer query.Close()
+
+			explainableQuery := query.(engine.ExplainableQuery)
+			// The resolved join sides are only known after the operator has been initialized.
+			testutil.Assert(t, !strings.Contains(explainableQuery.Explain().OperatorName, "high-card"))
+
+			testutil.Ok(t, query.Exec(ctx).Err)
+			testutil.Equals(t, tc.expected, explainableQuery.Explain().OperatorName)
+		})
+	}
+}
+
+func TestQueryExplainScalarOperands(t *testing.T) {
+	t.Parallel()
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	series := []storage.Series{
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "foo"}),
+		storage.MockSeries([]int64{0}, []float64{0.5}, []string{labels.MetricName, "bar"}),
+	}
+
+	for _, tc := range []struct {
+		query   string
+		scalars int
+	}{
+		{query: `quantile_over_time(scalar(bar), foo[5m:1m])`, scalars: 1},
+		{query: `predict_linear(foo[5m:1m], scalar(bar))`, scalars: 1},
+		{query: `double_exponential_smoothing(foo[5m:1m], scalar(bar), scalar(bar))`, scalars: 2},
+		{query: `quantile(scalar(bar), foo)`, scalars: 1},
+		{query: `topk(scalar(bar), foo)`, scalars: 1},
+		{query: `histogram_fraction(scalar(bar), scalar(bar), foo)`, scalars: 2},
+		{query: `clamp(foo, scalar(bar), scalar(bar))`, scalars: 2},
+		{query: `foo * scalar(bar)`, scalars: 1},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts, EnableExperimentalFunctions: true})
+			ctx := context.Background()
+
+			query, err := ng.NewInstantQuery(ctx, storageWithSeries(series...), nil, tc.query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer query.Close()
+
+			var countScalars func(node engine.ExplainOutputNode) int
+			countScalars = func(node engine.ExplainOutputNode) int {
+				var n int
+				if node.OperatorName == "[scalar]" {
+					n++
+				}
+				for _, child := range node.Children {
+					n += countScalars(child)
+				}
+				return n
+			}
+			explainableQuery := query.(engine.ExplainableQuery)
+			testutil.Equals(t, tc.scalars, countScalars(*explainableQuery.Explain()))
+		})
+	}
+}
+
+func TestQueryExplainSharedSubexpressions(t *testing.T) {
+	t.Parallel()
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	series := []storage.Series{
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "foo", "pod", "nginx-1"}),
+		storage.MockSeries([]int64{0}, []float64{2}, []string{labels.MetricName, "foo", "pod", "nginx-2"}),
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "bar", "pod", "nginx-1"}),
+	}
+
+	for _, tc := range []struct {
+		query    string
+		fanOuts  int
+		disabled bool
+	}{
+		{query: `rate(foo[5m]) / on () group_left sum(rate(foo[5m]))`, fanOuts: 2},
+		{query: `foo + foo`, fanOuts: 2},
+		{query: `foo + foo`, fanOuts: 0, disabled: true},
+		{query: `foo + bar`, fanOuts: 0},
+		{query: `rate(foo[5m]) + rate(foo[10m])`, fanOuts: 0},
+		{query: `max_over_time(foo[5m:1m]) + foo`, fanOuts: 0},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts, EnableSharedSubexpressions: !tc.disabled})
+			ctx := context.Background()
+
+			query, err := ng.NewInstantQuery(ctx, storageWithSeries(series...), nil, tc.query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer query.Close()
+
+			var countFanOuts func(node engine.ExplainOutputNode) int
+			countFanOuts = func(node engine.ExplainOutputNode) int {
+				var n int
+				if node.OperatorName == "[fanout(consumers=2)]" {
+					n++
+				}
+				for _, child := range node.Children {
+					n += countFanOuts(child)
+				}
+				return n
+			}
+			explainableQuery := query.(engine.ExplainableQuery)
+			testutil.Equals(t, tc.fanOuts, countFanOuts(*explainableQuery.Explain()))
+			testutil.Ok(t, query.Exec(ctx).Err)
+		})
+	}
+}
+
+func TestQueryAnalyzeSharedSubexpressions(t *testing.T) {
+	t.Parallel()
+	load := `load 30s
+	    foo{pod="nginx-1"} 1+1x10
+	    foo{pod="nginx-2"} 1+2x10`
+
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	totalSamples := func(qs string, shared bool) int64 {
+		ng := engine.New(engine.Opts{EngineOpts: promql.EngineOpts{Timeout: 1 * time.Hour}, EnableAnalysis: true, EnableSharedSubexpressions: shared})
+		ctx := context.Background()
+
+		query, err := ng.NewRangeQuery(ctx, tstorage, nil, qs, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer query.Close()
+		testutil.Ok(t, query.Exec(ctx).Err)
+		return query.(engine.ExplainableQuery).Analyze().TotalSamples()
+	}
+
+	// The shared selector is only evaluated once, so its samples are only counted once.
+	selectorSamples := totalSamples(`foo`, false)
+	testutil.Assert(t, selectorSamples > 0, "expected the selector to have samples")
+	testutil.Equals(t, totalSamples(`foo + foo`, false)-selectorSamples, totalSamples(`foo + foo`, true))
+}
+
+func TestQueryAnalyzeHashCollisions(t *testing.T) {
+	t.Parallel()
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	series := []storage.Series{
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "foo", "pod", "nginx-1"}),
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "foo", "pod", "nginx-2"}),
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "bar", "pod", "nginx-1"}),
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "bar", "pod", "nginx-2"}),
+	}
+
+	ng := engine.New(engine.Opts{EngineOpts: opts, EnableAnalysis: true})
+	ctx := context.Background()
+
+	query, err := ng.NewInstantQuery(ctx, storageWithSeries(series...), nil, `foo * on (pod) bar`, time.Unix(0, 0))
+	testutil.Ok(t, err)
+	defer query.Close()
+	testutil.Ok(t, query.Exec(ctx).Err)
+
+	var binaryNode *engine.AnalyzeOutputNode
+	var find func(*engine.AnalyzeOutputNode)
+	find = func(n *engine.AnalyzeOutputNode) {
+		if strings.HasPrefix(n.OperatorTelemetry.String(), "[vectorBinary]") {
+			binaryNode = n
+		}
+		for _, c := range n.Children {
+			find(c)
+		}
+	}
+	find(query.(engine.ExplainableQuery).Analyze())
+	testutil.Assert(t, binaryNode != nil, "expected a binary operator in the analysis tree")
+	testutil.Equals(t, 0, binaryNode.OperatorTelemetry.HashCollisions())
+}
+
+func TestQueryAnalyzeJoinBucketCount(t *testing.T) {
+	t.Parallel()
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	series := []storage.Series{
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "foo", "pod", "nginx-1"}),
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "foo", "pod", "nginx-2"}),
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "foo", "pod", "nginx-3"}),
+		// Unmatched series with the same signature share a bucket regardless of the join strategy.
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "foo", "container", "sidecar", "pod", "nginx-3"}),
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "bar", "pod", "nginx-1"}),
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "bar", "pod", "nginx-2"}),
+	}
+
+	for _, threshold := range []int{0, 10} {
+		t.Run(fmt.Sprintf("nestedLoopJoinThreshold=%d", threshold), func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts, EnableAnalysis: true, NestedLoopJoinThreshold: threshold})
+			ctx := context.Background()
+
+			query, err := ng.NewInstantQuery(ctx, storageWithSeries(series...), nil, `foo * on (pod) bar`, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer query.Close()
+			testutil.Ok(t, query.Exec(ctx).Err)
+
+			var binaryNode *engine.AnalyzeOutputNode
+			var find func(*engine.AnalyzeOutputNode)
+			find = func(n *engine.AnalyzeOutputNode) {
+				if strings.HasPrefix(n.OperatorTelemetry.String(), "[vectorBinary]") {
+					binaryNode = n
+				}
+				for _, c := range n.Children {
+					find(c)
+				}
+			}
+			find(query.(engine.ExplainableQuery).Analyze())
+			testutil.Assert(t, binaryNode != nil, "expected a binary operator in the analysis tree")
+			testutil.Equals(t, 3, binaryNode.OperatorTelemetry.JoinBucketCount())
+			testutil.Equals(t, 3, binaryNode.OperatorTelemetry.Snapshot().JoinBuckets)
+			testutil.Equals(t, 2, binaryNode.OperatorTelemetry.MaxSeriesCount())
+		})
+	}
+}
+
+func TestQueryAnalyzeEstimatedMemory(t *testing.T) {
+	t.Parallel()
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	load := `load 30s
+	    foo{pod="nginx-1"} 1+1x20
+	    foo{pod="nginx-2"} 5+1x20
+	    foo{pod="nginx-3"} 10+1x20
+	    bar{pod="nginx-1"} 2+1x20
+	    bar{pod="nginx-2"} 6+1x20
+	    baz{pod="nginx-1"} {{schema:0 sum:1 count:1}}x20`
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	findNode := func(root *engine.AnalyzeOutputNode, prefix string) *engine.AnalyzeOutputNode {
+		var node *engine.AnalyzeOutputNode
+		var find func(*engine.AnalyzeOutputNode)
+		find = func(n *engine.AnalyzeOutputNode) {
+			if node == nil && strings.HasPrefix(n.OperatorTelemetry.String(), prefix) {
+				node = n
+			}
+			for _, c := range n.Children {
+				find(c)
+			}
+		}
+		find(root)
+		testutil.Assert(t, node != nil, "expected a %s operator in the analysis tree", prefix)
+		return node
+	}
+	totalMemory := func(root *engine.AnalyzeOutputNode) int64 {
+		var total int64
+		seen := make(map[telemetry.OperatorTelemetry]struct{})
+		var sum func(*engine.AnalyzeOutputNode)
+		sum = func(n *engine.AnalyzeOutputNode) {
+			if _, ok := seen[n.OperatorTelemetry]; !ok {
+				seen[n.OperatorTelemetry] = struct{}{}
+				total += n.OperatorTelemetry.EstimatedMemory()
+			}
+			for _, c := range n.Children {
+				sum(c)
+			}
+		}
+		sum(root)
+		return total
+	}
+
+	ng := engine.New(engine.Opts{EngineOpts: opts, EnableAnalysis: true})
+	ctx := context.Background()
+
+	t.Run("floats", func(t *testing.T) {
+		// The query is evaluated over 21 steps, but operators only hold 10 steps at a time.
+		qs, err := ng.NewRangeQuery(ctx, tstorage, nil, `foo * on (pod) bar`, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer qs.Close()
+
+		estimate, err := qs.(engine.ExplainableQuery).EstimateMemory(ctx)
+		testutil.Ok(t, err)
+		testutil.Ok(t, qs.Exec(ctx).Err)
+
+		analysis := qs.(engine.ExplainableQuery).Analyze()
+		binaryNode := findNode(analysis, "[vectorBinary]")
+		testutil.Equals(t, 2, binaryNode.OperatorTelemetry.MaxSeriesCount())
+		testutil.Equals(t, telemetry.EstimateMemory(2, 10, false), binaryNode.OperatorTelemetry.EstimatedMemory())
+		testutil.Equals(t, int64(2*10*16), binaryNode.OperatorTelemetry.Snapshot().EstimatedMemory)
+		testutil.Equals(t, totalMemory(analysis), estimate)
+	})
+	t.Run("histograms", func(t *testing.T) {
+		qs, err := ng.NewRangeQuery(ctx, tstorage, nil, `baz * on (pod) bar`, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer qs.Close()
+		testutil.Ok(t, qs.Exec(ctx).Err)
+
+		binaryNode := findNode(qs.(engine.ExplainableQuery).Analyze(), "[vectorBinary]")
+		testutil.Equals(t, telemetry.EstimateMemory(1, 10, true), binaryNode.OperatorTelemetry.EstimatedMemory())
+		testutil.Assert(t, telemetry.EstimateMemory(1, 10, true) > telemetry.EstimateMemory(1, 10, false))
+	})
+	t.Run("analysis disabled", func(t *testing.T) {
+		ng := engine.New(engine.Opts{EngineOpts: opts})
+		qs, err := ng.NewRangeQuery(ctx, tstorage, nil, `foo * on (pod) bar`, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		defer qs.Close()
+
+		estimate, err := qs.(engine.ExplainableQuery).EstimateMemory(ctx)
+		testutil.Ok(t, err)
+		testutil.Assert(t, estimate >= telemetry.EstimateMemory(2+3+2, 10, false), "unexpected estimate %d", estimate)
+
+		res := qs.Exec(ctx)
+		testutil.Ok(t, res.Err)
+		testutil.Equals(t, 2, len(res.Value.(promql.Matrix)))
+	})
+}
+
+func TestQueryAnalyzePeakGoroutines(t *testing.T) {
+	t.Parallel()
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	load := `load 30s
+	    foo{pod="nginx-1"} 1+1x10
+	    foo{pod="nginx-2"} 5+1x10
+	    bar{pod="nginx-1"} 2+1x10
+	    bar{pod="nginx-2"} 6+1x10`
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	// Every binary operation reads its lhs in a separate goroutine.
+	const qs = `(foo * on (pod) bar) + on (pod) ((foo - on (pod) bar) / on (pod) (foo + 2))`
+	ctx := context.Background()
+	var expected *promql.Result
+	for _, limit := range []int{0, 1, 2} {
+		t.Run(fmt.Sprintf("maxOperandGoroutines=%d", limit), func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts, EnableAnalysis: true, MaxOperandGoroutines: limit})
+			q, err := ng.NewRangeQuery(ctx, tstorage, nil, qs, time.Unix(0, 0), time.Unix(300, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer q.Close()
+			res := q.Exec(ctx)
+			testutil.Ok(t, res.Err)
+
+			// Operands which do not get a goroutine are read sequentially, which does not change the result.
+			if expected == nil {
+				expected = res
+			} else {
+				testutil.WithGoCmp(comparer).Equals(t, expected, res)
+			}
+
+			peak := 0
+			var visit func(*engine.AnalyzeOutputNode)
+			visit = func(n *engine.AnalyzeOutputNode) {
+				peak = max(peak, n.OperatorTelemetry.PeakGoroutines())
+				testutil.Equals(t, n.OperatorTelemetry.PeakGoroutines(), n.OperatorTelemetry.Snapshot().PeakGoroutines)
+				for _, c := range n.Children {
+					visit(c)
+				}
+			}
+			visit(q.(engine.ExplainableQuery).Analyze())
+			testutil.Assert(t, peak >= 1, "expected at least one operand goroutine, got %d", peak)
+			if limit > 0 {
+				testutil.Assert(t, peak <= limit, "peak of %d operand goroutines exceeds the limit of %d", peak, limit)
+			}
+		})
+	}
+}
+
+func TestQueryAnalyzeDroppedSamples(t *testing.T) {
+	t.Parallel()
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	load := `load 30s
+	    foo{pod="nginx-1"} 1
+	    foo{pod="nginx-2"} 5
+	    foo{pod="nginx-3"} 10
+	    bar{pod="nginx-1"} 2
+	    bar{pod="nginx-2"} 6
+	    bar{pod="nginx-3"} 6`
+	tstorage := promqltest.LoadedStorage(t, load)
+	defer tstorage.Close()
+
+	for _, tc := range []struct {
+		query    string
+		operator string
+		dropped  int64
+	}{
+		{query: `foo > 4`, operator: "[vectorScalarBinary]", dropped: 1},
+		{query: `4 < foo`, operator: "[vectorScalarBinary]", dropped: 1},
+		{query: `foo > bool 4`, operator: "[vectorScalarBinary]", dropped: 0},
+		{query: `foo * 4`, operator: "[vectorScalarBinary]", dropped: 0},
+		{query: `foo > on (pod) bar`, operator: "[vectorBinary]", dropped: 2},
+		{query: `foo < on (pod) bar`, operator: "[vectorBinary]", dropped: 1},
+		{query: `foo != bool on (pod) bar`, operator: "[vectorBinary]", dropped: 0},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts, EnableAnalysis: true})
+			ctx := context.Background()
+
+			query, err := ng.NewInstantQuery(ctx, tstorage, nil, tc.query, time.Unix(0, 0))
+			testutil.Ok(t, err)
+			defer query.Close()
+			testutil.Ok(t, query.Exec(ctx).Err)
+
+			var binaryNode *engine.AnalyzeOutputNode
+			var find func(*engine.AnalyzeOutputNode)
+			find = func(n *engine.AnalyzeOutputNode) {
+				if strings.HasPrefix(n.OperatorTelemetry.String(), tc.operator) {
+					binaryNode = n
+				}
+				for _, c := range n.Children {
+					find(c)
+				}
+			}
+			analysis := query.(engine.ExplainableQuery).Analyze()
+			find(analysis)
+			testutil.Assert(t, binaryNode != nil, "expected a binary operator in the analysis tree")
+			testutil.Equals(t, tc.dropped, binaryNode.OperatorTelemetry.DroppedSamples())
+			testutil.Equals(t, tc.dropped, binaryNode.OperatorTelemetry.Snapshot().DroppedSamples)
+
+			out, err := json.Marshal(analysis)
+			testutil.Ok(t, err)
+			testutil.Assert(t, strings.Contains(string(out), fmt.Sprintf(`"Dropped":%d`, tc.dropped)))
+		})
+	}
+}
+
+func TestQueryAnalyzeOperatorNames(t *testing.T) {
+	t.Parallel()
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	series := []storage.Series{
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "foo", "pod", "nginx-1"}),
+		storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, "bar", "pod", "nginx-1"}),
+	}
+
+	ng := engine.New(engine.Opts{EngineOpts: opts, EnableAnalysis: true})
+	ctx := context.Background()
+
+	query, err := ng.NewInstantQuery(ctx, storageWithSeries(series...), nil, `foo * on (pod) bar + absent(baz)`, time.Unix(0, 0))
+	testutil.Ok(t, err)
+	defer query.Close()
+	testutil.Ok(t, query.Exec(ctx).Err)
+
+	names := make(map[string]struct{})
+	var collect func(*engine.AnalyzeOutputNode)
+	collect = func(n *engine.AnalyzeOutputNode) {
+		name := n.OperatorTelemetry.Name()
+		testutil.Assert(t, !strings.ContainsAny(name, "[]( "), "unexpected operator name %q for %s", name, n.OperatorTelemetry.String())
+		names[name] = struct{}{}
+		for _, c := range n.Children {
+			collect(c)
+		}
+	}
+	collect(query.(engine.ExplainableQuery).Analyze())
+
+	for _, name := range []string{"vectorBinary", "absent", "vectorSelector", "concurrent"} {
+		_, ok := names[name]
+		testutil.Assert(t, ok, "expected operator %q in %v", name, names)
+	}
+}
+
 func assertExecutionTimeNonZero(t *testing.T, got *engine.AnalyzeOutputNode) bool {
 	if got != nil {
 		if got.OperatorTelemetry.ExecutionTimeTaken() <= 0 {
@@ -140,28 +140,28 @@ func (s sortFuncResultSort) comparer(samples *promql.Vector) func(i, j int) bool
 
 func (s sortByLabelFuncResult) comparer(samples *promql.Vector) func(i, j int) bool {
 	return func(i, j int) bool {
-		iLb := labels.NewBuilder((*samples)[i].Metric)
-		jLb := labels.NewBuilder((*samples)[j].Metric)
+		iLbls := (*samples)[i].Metric
+		jLbls := (*samples)[j].Metric
 
+		// Missing labels compare as empty strings, matching Prometheus.
 		for _, label := range s.sortingLabels {
-			lv1 := iLb.Get(label)
-			lv2 := jLb.Get(label)
+			lv1 := iLbls.Get(label)
+			lv2 := jLbls.Get(label)
 
 			if lv1 == lv2 {
 				continue
 			}
 			if natsort.Compare(lv1, lv2) {
 				return s.sortOrder == sortOrderAsc
-			} else {
-				return s.sortOrder == sortOrderDesc
 			}
+			return s.sortOrder == sortOrderDesc
 		}
 		// If all labels provided as arguments were equal, sort by the full label set. This ensures a consistent ordering.
-		if lblsCmp := labels.Compare(iLb.Labels(), jLb.Labels()); lblsCmp < 0 {
-			return s.sortOrder == sortOrderAsc
-		} else {
-			return s.sortOrder == sortOrderDesc
+		lblsCmp := labels.Compare(iLbls, jLbls)
+		if s.sortOrder == sortOrderDesc {
+			return lblsCmp > 0
 		}
+		return lblsCmp < 0
 	}
 }
 
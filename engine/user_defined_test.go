@@ -5,12 +5,16 @@ package engine_test
 
 import (
 	"context"
+	"errors"
 	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/thanos-io/promql-engine/engine"
 	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/scan"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
 
@@ -58,7 +62,160 @@ load 30s
 	testutil.Equals(t, expected, mat)
 }
 
-type injectVectorSelector struct{}
+func TestUserDefinedOperatorsOutOfOrderSteps(t *testing.T) {
+	opts := promql.EngineOpts{
+		Timeout:    1 * time.Hour,
+		MaxSamples: 1e10,
+	}
+
+	load := `
+load 30s
+	http_requests_total{container="a"} 1x30`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	newEngine := engine.New(engine.Opts{
+		EngineOpts:        opts,
+		LogicalOptimizers: append(slices.Clone(logicalplan.DefaultOptimizers), &injectVectorSelector{reverseSteps: true}),
+	})
+	query := "http_requests_total * http_requests_total"
+	qry, err := newEngine.NewRangeQuery(context.Background(), storage, nil, query, time.Unix(0, 0), time.Unix(90, 0), 30*time.Second)
+	testutil.Ok(t, err)
+
+	result := qry.Exec(context.Background())
+	testutil.NotOk(t, result.Err)
+	testutil.Equals(t, `unexpected out of order steps in "*" operation`, result.Err.Error())
+}
+
+func TestUserDefinedOperatorsBinaryWaitTime(t *testing.T) {
+	opts := promql.EngineOpts{
+		Timeout:    1 * time.Hour,
+		MaxSamples: 1e10,
+	}
+
+	load := `
+load 30s
+	http_requests_total{container="a"} 1x30`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	const delay = 10 * time.Millisecond
+	newEngine := engine.New(engine.Opts{
+		EngineOpts:        opts,
+		EnableAnalysis:    true,
+		LogicalOptimizers: append(slices.Clone(logicalplan.DefaultOptimizers), &injectVectorSelector{delay: delay}),
+	})
+	query := "http_requests_total + on() group_left vector(1)"
+	qry, err := newEngine.NewRangeQuery(context.Background(), storage, nil, query, time.Unix(0, 0), time.Unix(90, 0), 30*time.Second)
+	testutil.Ok(t, err)
+
+	result := qry.Exec(context.Background())
+	testutil.Ok(t, result.Err)
+
+	var findBinary func(node *engine.AnalyzeOutputNode) *engine.AnalyzeOutputNode
+	findBinary = func(node *engine.AnalyzeOutputNode) *engine.AnalyzeOutputNode {
+		if strings.HasPrefix(node.OperatorTelemetry.String(), "[vectorBinary]") {
+			return node
+		}
+		for _, child := range node.Children {
+			if n := findBinary(child); n != nil {
+				return n
+			}
+		}
+		return nil
+	}
+	binary := findBinary(qry.(engine.ExplainableQuery).Analyze())
+	testutil.Assert(t, binary != nil)
+	// The vector() side returns immediately, so the operator waits for the delayed selector.
+	testutil.Assert(t, binary.OperatorTelemetry.WaitTime() >= delay, "wait time %v is lower than the delay", binary.OperatorTelemetry.WaitTime())
+}
+
+func TestUserDefinedOperatorsCancelLHSOnRHSError(t *testing.T) {
+	opts := promql.EngineOpts{
+		Timeout:    1 * time.Hour,
+		MaxSamples: 1e10,
+	}
+
+	load := `
+load 30s
+	slow_metric{container="a"} 1x30
+	failing_metric{container="a"} 1x30`
+
+	storage := promqltest.LoadedStorage(t, load)
+	defer storage.Close()
+
+	newEngine := engine.New(engine.Opts{
+		EngineOpts: opts,
+		LogicalOptimizers: append(slices.Clone(logicalplan.DefaultOptimizers), &injectVectorSelector{
+			blockingMetric: "slow_metric",
+			failingMetric:  "failing_metric",
+		}),
+	})
+	query := "slow_metric + failing_metric"
+	qry, err := newEngine.NewRangeQuery(context.Background(), storage, nil, query, time.Unix(0, 0), time.Unix(90, 0), 30*time.Second)
+	testutil.Ok(t, err)
+
+	// Without cancelling the lhs, the query would only return once the context times out.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	start := time.Now()
+	result := qry.Exec(ctx)
+	testutil.NotOk(t, result.Err)
+	testutil.Equals(t, errSelectorFailed, result.Err)
+	testutil.Assert(t, time.Since(start) < 10*time.Second, "query took %v to return the rhs error", time.Since(start))
+}
+
+func TestUserDefinedOperatorsConstantFolding(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		query    string
+		expected float64
+	}{
+		{query: `2 + 3`, expected: 5},
+		{query: `2 > bool 3`, expected: 0},
+		{query: `(1 + 1) == bool 2`, expected: 1},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			t.Parallel()
+
+			counter := &nextCounter{calls: make(map[float64]int)}
+			newEngine := engine.New(engine.Opts{
+				EngineOpts:        promql.EngineOpts{Timeout: 1 * time.Hour},
+				LogicalOptimizers: append(slices.Clone(logicalplan.DefaultOptimizers), &injectNumberLiteral{counter: counter}),
+			})
+			qry, err := newEngine.NewRangeQuery(context.Background(), storageWithSeries(), nil, tc.query, time.Unix(0, 0), time.Unix(90, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			defer qry.Close()
+
+			result := qry.Exec(context.Background())
+			testutil.Ok(t, result.Err)
+			mat, err := result.Matrix()
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(mat))
+			for _, p := range mat[0].Floats {
+				testutil.Equals(t, tc.expected, p.F)
+			}
+
+			// Only the folded literal is evaluated, the operands of the original expression are never read.
+			testutil.Equals(t, 1, len(counter.calls), "unexpected literals %v", counter.calls)
+			testutil.Assert(t, counter.calls[tc.expected] > 0, "expected the folded literal %v to be read", tc.expected)
+		})
+	}
+}
+
+var errSelectorFailed = errors.New("selector failed")
+
+type injectVectorSelector struct {
+	reverseSteps bool
+	delay        time.Duration
+	// blockingMetric is the name of the selector which blocks until its context is cancelled.
+	blockingMetric string
+	// failingMetric is the name of the selector which returns errSelectorFailed.
+	failingMetric string
+}
 
 func (i injectVectorSelector) Optimize(plan logicalplan.Node, _ *query.Options) (logicalplan.Node, annotations.Annotations) {
 	logicalplan.TraverseBottomUp(nil, &plan, func(_, current *logicalplan.Node) bool {
@@ -66,6 +223,10 @@ func (i injectVectorSelector) Optimize(plan logicalplan.Node, _ *query.Options)
 		case *logicalplan.VectorSelector:
 			*current = &logicalVectorSelector{
 				VectorSelector: t,
+				reverseSteps:   i.reverseSteps,
+				delay:          i.delay,
+				block:          i.blockingMetric != "" && t.Name == i.blockingMetric,
+				fail:           i.failingMetric != "" && t.Name == i.failingMetric,
 			}
 		}
 		return false
@@ -75,6 +236,10 @@ func (i injectVectorSelector) Optimize(plan logicalplan.Node, _ *query.Options)
 
 type logicalVectorSelector struct {
 	*logicalplan.VectorSelector
+	reverseSteps bool
+	delay        time.Duration
+	block        bool
+	fail         bool
 }
 
 func (c logicalVectorSelector) MakeExecutionOperator(_ context.Context, opts *query.Options, _ storage.SelectHints) (model.VectorOperator, error) {
@@ -85,6 +250,11 @@ func (c logicalVectorSelector) MakeExecutionOperator(_ context.Context, opts *qu
 		maxt:        opts.End.UnixMilli(),
 		step:        opts.Step.Milliseconds(),
 		currentStep: opts.Start.UnixMilli(),
+
+		reverseSteps: c.reverseSteps,
+		delay:        c.delay,
+		block:        c.block,
+		fail:         c.fail,
 	}
 
 	return oper, nil
@@ -101,9 +271,26 @@ type vectorSelectorOperator struct {
 	maxt        int64
 	step        int64
 	currentStep int64
+
+	// reverseSteps emits each batch in descending timestamp order.
+	reverseSteps bool
+	// delay is the time each call to Next blocks for.
+	delay time.Duration
+	// block makes Next block until the context is cancelled.
+	block bool
+	// fail makes Next return errSelectorFailed.
+	fail bool
 }
 
 func (c *vectorSelectorOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	if c.block {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	if c.fail {
+		return 0, errSelectorFailed
+	}
+	time.Sleep(c.delay)
 	if c.currentStep > c.maxt {
 		return 0, nil
 	}
@@ -111,11 +298,14 @@ func (c *vectorSelectorOperator) Next(ctx context.Context, buf []model.StepVecto
 	n := 0
 	for i := 0; i < c.stepsBatch && c.currentStep <= c.maxt && n < len(buf); i++ {
 		buf[n].Reset(c.currentStep)
+		buf[n].AppendSample(0, 7)
 		buf[n].AppendSample(1, 7)
-		buf[n].AppendSample(2, 7)
 		c.currentStep += c.step
 		n++
 	}
+	if c.reverseSteps {
+		slices.Reverse(buf[:n])
+	}
 	return n, nil
 }
 
@@ -129,3 +319,49 @@ func (c *vectorSelectorOperator) Series(ctx context.Context) ([]labels.Labels, e
 func (c *vectorSelectorOperator) Explain() (next []model.VectorOperator) {
 	return nil
 }
+
+// nextCounter counts the calls to Next of number literals by their value.
+type nextCounter struct {
+	mu    sync.Mutex
+	calls map[float64]int
+}
+
+func (c *nextCounter) inc(val float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[val]++
+}
+
+type injectNumberLiteral struct {
+	counter *nextCounter
+}
+
+func (i injectNumberLiteral) Optimize(plan logicalplan.Node, _ *query.Options) (logicalplan.Node, annotations.Annotations) {
+	logicalplan.TraverseBottomUp(nil, &plan, func(_, current *logicalplan.Node) bool {
+		if t, ok := (*current).(*logicalplan.NumberLiteral); ok {
+			*current = &logicalNumberLiteral{NumberLiteral: t, counter: i.counter}
+		}
+		return false
+	})
+	return plan, nil
+}
+
+type logicalNumberLiteral struct {
+	*logicalplan.NumberLiteral
+	counter *nextCounter
+}
+
+func (c logicalNumberLiteral) MakeExecutionOperator(_ context.Context, opts *query.Options, _ storage.SelectHints) (model.VectorOperator, error) {
+	return &countingOperator{VectorOperator: scan.NewNumberLiteralSelector(opts, c.Val), val: c.Val, counter: c.counter}, nil
+}
+
+type countingOperator struct {
+	model.VectorOperator
+	val     float64
+	counter *nextCounter
+}
+
+func (c *countingOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	c.counter.inc(c.val)
+	return c.VectorOperator.Next(ctx, buf)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/execution/telemetry"
 	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/warnings"
 
 	"github.com/efficientgo/core/errors"
 	prommodel "github.com/prometheus/common/model"
@@ -49,7 +50,7 @@ func NewCountValues(next model.VectorOperator, param string, by bool, grouping [
 		by:         by,
 		grouping:   grouping,
 	}
-	return telemetry.NewOperator(telemetry.NewTelemetry(op, opts), op)
+	return telemetry.NewOperator(telemetry.NewTelemetry(op, "countValues", opts), op)
 }
 
 func (c *countValuesOperator) Explain() []model.VectorOperator {
@@ -140,6 +141,8 @@ func (c *countValuesOperator) initSeriesOnce(ctx context.Context) error {
 	ts := make([]int64, 0)
 	counts := make([]map[int]int, 0)
 	series := make([]labels.Labels, 0)
+	// histogramSeries tracks input series for which the histogram annotation was already added.
+	histogramSeries := make(map[uint64]struct{})
 
 	b := labels.NewBuilder(labels.EmptyLabels())
 	for {
@@ -171,6 +174,10 @@ func (c *countValuesOperator) initSeriesOnce(ctx context.Context) error {
 			}
 
 			for j := range in[i].Histograms {
+				if _, ok := histogramSeries[in[i].HistogramIDs[j]]; !ok {
+					histogramSeries[in[i].HistogramIDs[j]] = struct{}{}
+					warnings.AddToContext(warnings.NewCountValuesHistogramInfo(nextSeries[in[i].HistogramIDs[j]].Get(labels.MetricName)), ctx)
+				}
 				hash := inputIdToHashBucket[int(in[i].HistogramIDs[j])]
 				if _, ok := countPerHashbucket[hash]; !ok {
 					countPerHashbucket[hash] = make(map[string]int)
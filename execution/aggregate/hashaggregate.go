@@ -69,7 +69,7 @@ func NewHashAggregate(
 		params:      make([]float64, opts.StepsBatch),
 	}
 
-	return telemetry.NewOperator(telemetry.NewTelemetry(a, opts), a), nil
+	return telemetry.NewOperator(telemetry.NewTelemetry(a, "aggregate", opts), a), nil
 }
 
 func (a *aggregate) String() string {
@@ -80,12 +80,10 @@ func (a *aggregate) String() string {
 }
 
 func (a *aggregate) Explain() (next []model.VectorOperator) {
-	switch a.aggregation {
-	case parser.QUANTILE:
+	if a.paramOp != nil {
 		return []model.VectorOperator{a.paramOp, a.next}
-	default:
-		return []model.VectorOperator{a.next}
 	}
+	return []model.VectorOperator{a.next}
 }
 
 func (a *aggregate) Series(ctx context.Context) ([]labels.Labels, error) {
@@ -80,7 +80,7 @@ func NewKHashAggregate(
 		stepsBatch:  opts.StepsBatch,
 	}
 
-	return telemetry.NewOperator(telemetry.NewTelemetry(op, opts), op), nil
+	return telemetry.NewOperator(telemetry.NewTelemetry(op, "kaggregate", opts), op), nil
 }
 
 func (a *kAggregate) Next(ctx context.Context, buf []model.StepVector) (int, error) {
@@ -28,6 +28,17 @@ type scalarOperator struct {
 	opType     parser.ItemType
 	returnBool bool
 	stepsBatch int
+	keepNaN    bool
+	// keepMetricName keeps the metric name of the vector operand in the result.
+	keepMetricName bool
+	// warnDedup makes sure that binary operation warnings are only added once per query.
+	warnDedup warnings.Dedup
+	// bulkFloats is set when every float sample of the vector operand produces an output sample,
+	// in which case samples are appended in bulk and transformed in place.
+	bulkFloats bool
+	telemetry  telemetry.OperatorTelemetry
+	// goroutines bounds the goroutines used to read the lhs concurrently with the rhs.
+	goroutines *query.GoroutinePool
 
 	once   sync.Once
 	series []labels.Labels
@@ -43,19 +54,28 @@ func NewScalar(
 	rhsType parser.ValueType,
 	opType parser.ItemType,
 	returnBool bool,
+	keepMetricName bool,
 	opts *query.Options,
 ) (model.VectorOperator, error) {
+	if err := validateReturnBool(opType, returnBool); err != nil {
+		return nil, err
+	}
 	op := &scalarOperator{
-		lhs:        lhs,
-		rhs:        rhs,
-		lhsType:    lhsType,
-		rhsType:    rhsType,
-		opType:     opType,
-		returnBool: returnBool,
-		stepsBatch: opts.StepsBatch,
+		lhs:            lhs,
+		rhs:            rhs,
+		lhsType:        lhsType,
+		rhsType:        rhsType,
+		opType:         opType,
+		returnBool:     returnBool,
+		stepsBatch:     opts.StepsBatch,
+		keepNaN:        opts.KeepNaNComparisons,
+		keepMetricName: keepMetricName,
+		bulkFloats:     !returnBool && isArithmeticOperator(opType),
+		goroutines:     opts.Goroutines,
 	}
 
-	return telemetry.NewOperator(telemetry.NewTelemetry(op, opts), op), nil
+	op.telemetry = telemetry.NewTelemetry(op, "vectorScalarBinary", opts)
+	return telemetry.NewOperator(op.telemetry, op), nil
 }
 
 func (o *scalarOperator) Explain() (next []model.VectorOperator) {
@@ -90,14 +110,19 @@ func (o *scalarOperator) Next(ctx context.Context, buf []model.StepVector) (int,
 
 	var lhsN int
 	var lerrChan = make(chan error, 1)
-	go func() {
+	readLHS := func() {
 		var err error
 		lhsN, err = o.lhs.Next(ctx, o.lhsBuf)
 		if err != nil {
 			lerrChan <- err
 		}
 		close(lerrChan)
-	}()
+	}
+	if !o.goroutines.TryGo(readLHS) {
+		// The goroutine pool of the query is exhausted, so the operands are read one after the other.
+		readLHS()
+	}
+	o.telemetry.UpdatePeakGoroutines(o.goroutines.Peak())
 
 	rhsN, rerr := o.rhs.Next(ctx, o.rhsBuf)
 	lerr := <-lerrChan
@@ -127,11 +152,25 @@ func (o *scalarOperator) Next(ctx context.Context, buf []model.StepVector) (int,
 }
 
 func (o *scalarOperator) loadSeries(ctx context.Context) error {
-	vectorSide := o.lhs
+	vectorSide, scalarSide := o.lhs, o.rhs
 	if o.lhsType == parser.ValueTypeScalar {
-		vectorSide = o.rhs
+		vectorSide, scalarSide = o.rhs, o.lhs
 	}
+	// The scalar side can be a nested expression which needs to resolve its own series,
+	// so it is initialized concurrently with the vector side.
+	var errChan = make(chan error, 1)
+	go func() {
+		if _, err := scalarSide.Series(ctx); err != nil {
+			errChan <- err
+		}
+		close(errChan)
+	}()
+
 	vectorSeries, err := vectorSide.Series(ctx)
+	// Wait for the scalar side so that it is not initialized concurrently with Next.
+	if serr := <-errChan; err == nil {
+		err = serr
+	}
 	if err != nil {
 		return err
 	}
@@ -141,7 +180,7 @@ func (o *scalarOperator) loadSeries(ctx context.Context) error {
 	for i := range vectorSeries {
 		if !vectorSeries[i].IsEmpty() {
 			lbls := vectorSeries[i]
-			if shouldDropMetricName(o.opType, o.returnBool) {
+			if shouldDropMetricName(o.opType, o.returnBool, o.keepMetricName) {
 				lbls = extlabels.DropReserved(lbls, b)
 			}
 			series[i] = lbls
@@ -188,62 +227,103 @@ func (o *scalarOperator) execBinaryOperation(ctx context.Context, lhs, rhs model
 		scalar, other = rhs, lhs
 	}
 
+	var dropped int
+	if o.bulkFloats {
+		o.execFloatsInPlace(scalar.Samples[0], other, step)
+	} else {
+		dropped = o.execFloats(ctx, scalar.Samples[0], other, step)
+	}
+
 	var (
-		v    float64
 		h    *histogram.FloatHistogram
 		keep bool
+		warn warnings.Warnings
 		err  error
 	)
-	var warn warnings.Warnings
-	sampleHint := len(other.Samples)
-	for i, otherVal := range other.Samples {
+	histogramHint := len(other.Histograms)
+	for i, otherVal := range other.Histograms {
 		scalarVal := scalar.Samples[0]
 
 		if o.lhsType == parser.ValueTypeScalar {
-			v, _, keep, warn, err = binOp(o.opType, scalarVal, otherVal, nil, nil)
+			_, h, keep, warn, err = binOp(o.opType, scalarVal, 0., nil, otherVal)
 		} else {
-			v, _, keep, warn, err = binOp(o.opType, otherVal, scalarVal, nil, nil)
+			_, h, keep, warn, err = binOp(o.opType, 0., scalarVal, otherVal, nil)
 		}
 		if err != nil {
 			warnings.AddToContext(err, ctx)
 			continue
 		}
 		if warn != 0 {
-			emitBinaryOpWarnings(ctx, warn, o.opType)
-		}
-		// in comparison operations between scalars and vectors, the vectors are filtered, regardless if lhs or rhs
-		if keep && o.opType.IsComparisonOperator() && (o.lhsType == parser.ValueTypeVector || o.rhsType == parser.ValueTypeVector) {
-			v = otherVal
+			emitBinaryOpWarnings(ctx, o.warnDedup.Filter(warn), o.opType)
 		}
-		if o.returnBool {
-			v = 0.0
-			if keep {
-				v = 1.0
-			}
-		} else if !keep {
+		if !keep {
+			dropped++
 			continue
 		}
-		step.AppendSampleWithSizeHint(other.SampleIDs[i], v, sampleHint)
+		step.AppendHistogramWithSizeHint(other.HistogramIDs[i], h, histogramHint)
 	}
-	histogramHint := len(other.Histograms)
-	for i, otherVal := range other.Histograms {
-		scalarVal := scalar.Samples[0]
+	if dropped > 0 {
+		o.telemetry.AddDroppedSamples(dropped)
+	}
+}
+
+// execFloatsInPlace appends all float samples of the vector operand to the step at once and applies
+// the operation in place. It can only be used for operations which keep every float sample.
+func (o *scalarOperator) execFloatsInPlace(scalarVal float64, other model.StepVector, step *model.StepVector) {
+	n := len(step.Samples)
+	step.AppendSamples(other.SampleIDs, other.Samples)
+	vals := step.Samples[n:]
+	if o.lhsType == parser.ValueTypeScalar {
+		for i, otherVal := range vals {
+			vals[i], _, _, _, _ = binOp(o.opType, scalarVal, otherVal, nil, nil)
+		}
+		return
+	}
+	for i, otherVal := range vals {
+		vals[i], _, _, _, _ = binOp(o.opType, otherVal, scalarVal, nil, nil)
+	}
+}
 
+// execFloats applies the operation to each float sample of the vector operand
+// and returns the number of samples dropped by a comparison.
+func (o *scalarOperator) execFloats(ctx context.Context, scalarVal float64, other model.StepVector, step *model.StepVector) (dropped int) {
+	var (
+		v    float64
+		keep bool
+		warn warnings.Warnings
+		err  error
+	)
+	sampleHint := len(other.Samples)
+	for i, otherVal := range other.Samples {
 		if o.lhsType == parser.ValueTypeScalar {
-			_, h, keep, warn, err = binOp(o.opType, scalarVal, 0., nil, otherVal)
+			v, _, keep, warn, err = binOp(o.opType, scalarVal, otherVal, nil, nil)
 		} else {
-			_, h, keep, warn, err = binOp(o.opType, 0., scalarVal, otherVal, nil)
+			v, _, keep, warn, err = binOp(o.opType, otherVal, scalarVal, nil, nil)
+		}
+		if o.keepNaN && isNaNComparison(o.opType, scalarVal, otherVal) {
+			keep = true
 		}
 		if err != nil {
 			warnings.AddToContext(err, ctx)
 			continue
 		}
 		if warn != 0 {
-			emitBinaryOpWarnings(ctx, warn, o.opType)
+			emitBinaryOpWarnings(ctx, o.warnDedup.Filter(warn), o.opType)
 		}
-		if !keep {
+		// in comparison operations between scalars and vectors, the vectors are filtered, regardless if lhs or rhs
+		if keep && o.opType.IsComparisonOperator() && (o.lhsType == parser.ValueTypeVector || o.rhsType == parser.ValueTypeVector) {
+			v = otherVal
+		}
+		if o.returnBool {
+			v = 0.0
+			if keep {
+				v = 1.0
+			}
+		} else if !keep {
+			dropped++
 			continue
 		}
-		step.AppendHistogramWithSizeHint(other.HistogramIDs[i], h, histogramHint)
+		step.AppendSampleWithSizeHint(other.SampleIDs[i], v, sampleHint)
 	}
+	return dropped
 }
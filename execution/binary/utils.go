@@ -7,9 +7,12 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"slices"
+	"strings"
 
 	"github.com/thanos-io/promql-engine/warnings"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
@@ -24,35 +27,67 @@ const (
 	rhBinOpSide binOpSide = "right"
 )
 
+func (s binOpSide) other() binOpSide {
+	if s == lhBinOpSide {
+		return rhBinOpSide
+	}
+	return lhBinOpSide
+}
+
 type errManyToManyMatch struct {
 	matching *parser.VectorMatching
 	side     binOpSide
 
-	original, duplicate labels.Labels
+	// series are all series of the match group, there are at least two of them.
+	series []labels.Labels
 }
 
-func newManyToManyMatchError(matching *parser.VectorMatching, original, duplicate labels.Labels, side binOpSide) *errManyToManyMatch {
+func newManyToManyMatchError(matching *parser.VectorMatching, series []labels.Labels, side binOpSide) *errManyToManyMatch {
 	return &errManyToManyMatch{
-		original:  original,
-		duplicate: duplicate,
-		matching:  matching,
-		side:      side,
+		series:   series,
+		matching: matching,
+		side:     side,
 	}
 }
 
 func (e *errManyToManyMatch) Error() string {
-	group := e.original.MatchLabels(e.matching.On, e.matching.MatchingLabels...)
-	msg := "found duplicate series for the match group %s on the %s hand-side of the operation: [%s, %s]" +
+	group := e.series[0].MatchLabels(e.matching.On, e.matching.MatchingLabels...)
+	series := make([]string, 0, len(e.series))
+	for _, s := range e.series {
+		series = append(series, s.String())
+	}
+	msg := "found duplicate series for the match group %s on the %s hand-side of the operation: [%s]" +
 		";many-to-many matching not allowed: matching labels must be unique on one side"
-	return fmt.Sprintf(msg, group, e.side, e.original.String(), e.duplicate.String())
+	return fmt.Sprintf(msg, group, e.side, strings.Join(series, ", "))
+}
+
+// validateReturnBool rejects the bool modifier for operators which are not comparisons.
+// Prometheus rejects it when parsing, but plans which are not created from a parsed
+// expression can still contain it.
+func validateReturnBool(op parser.ItemType, returnBool bool) error {
+	if returnBool && !op.IsComparisonOperator() {
+		return errors.Newf("bool modifier can only be used on comparison operators, got %q", parser.ItemTypeStr[op])
+	}
+	return nil
+}
+
+func shouldDropMetricName(op parser.ItemType, returnBool, keepMetricName bool) bool {
+	if keepMetricName {
+		return false
+	}
+	if isArithmeticOperator(op) {
+		return true
+	}
+	return op.IsComparisonOperator() && returnBool
 }
 
-func shouldDropMetricName(op parser.ItemType, returnBool bool) bool {
+// isArithmeticOperator returns true for operators which produce an output sample for every pair of float samples.
+func isArithmeticOperator(op parser.ItemType) bool {
 	switch op {
 	case parser.ADD, parser.SUB, parser.MUL, parser.DIV, parser.MOD, parser.POW, parser.ATAN2:
 		return true
 	default:
-		return op.IsComparisonOperator() && returnBool
+		return false
 	}
 }
 
@@ -120,6 +155,9 @@ func binOp(op parser.ItemType, lhs, rhs float64, hlhs, hrhs *histogram.FloatHist
 					return 0, nil, false, 0, err
 				}
 				var warn warnings.Warnings
+				if schemaReduced(hlhs, hrhs) {
+					warn |= warnings.WarnHistogramSchemaReduced
+				}
 				if counterResetCollision {
 					warn |= warnings.WarnCounterResetCollision
 				}
@@ -133,6 +171,9 @@ func binOp(op parser.ItemType, lhs, rhs float64, hlhs, hrhs *histogram.FloatHist
 					return 0, nil, false, 0, err
 				}
 				var warn warnings.Warnings
+				if schemaReduced(hlhs, hrhs) {
+					warn |= warnings.WarnHistogramSchemaReduced
+				}
 				if counterResetCollision {
 					warn |= warnings.WarnCounterResetCollision
 				}
@@ -154,6 +195,73 @@ func binOp(op parser.ItemType, lhs, rhs float64, hlhs, hrhs *histogram.FloatHist
 	return 0, nil, false, 0, nil
 }
 
+// schemaReduced returns true if combining the two histograms requires downscaling one of
+// them to the lower of both exponential schemas.
+func schemaReduced(a, b *histogram.FloatHistogram) bool {
+	return !a.UsesCustomBuckets() && !b.UsesCustomBuckets() && a.Schema != b.Schema
+}
+
+// isNaNComparison returns true if op is a comparison with NaN on either side.
+func isNaNComparison(op parser.ItemType, lhs, rhs float64) bool {
+	return op.IsComparisonOperator() && (math.IsNaN(lhs) || math.IsNaN(rhs))
+}
+
+// histogramsApproxEqual is like FloatHistogram.Equals, but allows the sum and all counts
+// to differ by the given relative tolerance. The bucket layouts still have to match exactly.
+// This operation expects that both histograms are compacted.
+func histogramsApproxEqual(a, b *histogram.FloatHistogram, tolerance float64) bool {
+	if a.Schema != b.Schema || a.ZeroThreshold != b.ZeroThreshold {
+		return false
+	}
+	if a.UsesCustomBuckets() && !histogram.CustomBucketBoundsMatch(a.CustomValues, b.CustomValues) {
+		return false
+	}
+	if !slices.Equal(a.PositiveSpans, b.PositiveSpans) || !slices.Equal(a.NegativeSpans, b.NegativeSpans) {
+		return false
+	}
+	if !approxEqual(a.Count, b.Count, tolerance) || !approxEqual(a.Sum, b.Sum, tolerance) || !approxEqual(a.ZeroCount, b.ZeroCount, tolerance) {
+		return false
+	}
+	for i := range a.PositiveBuckets {
+		if !approxEqual(a.PositiveBuckets[i], b.PositiveBuckets[i], tolerance) {
+			return false
+		}
+	}
+	for i := range a.NegativeBuckets {
+		if !approxEqual(a.NegativeBuckets[i], b.NegativeBuckets[i], tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+func approxEqual(a, b, tolerance float64) bool {
+	if a == b || (math.IsNaN(a) && math.IsNaN(b)) {
+		return true
+	}
+	return math.Abs(a-b) <= tolerance*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// reduceHistogramResolution reduces the schema of h until it has at most maxBuckets buckets
+// or the minimum schema is reached. Histograms with custom buckets are left untouched.
+// Returns true if the resolution of h was reduced.
+func reduceHistogramResolution(h *histogram.FloatHistogram, maxBuckets int) bool {
+	var reduced bool
+	for exceedsBucketLimit(h, maxBuckets) {
+		h.ReduceResolution(h.Schema - 1)
+		reduced = true
+	}
+	return reduced
+}
+
+// exceedsBucketLimit returns true if the resolution of h needs to be reduced to have at most maxBuckets buckets.
+func exceedsBucketLimit(h *histogram.FloatHistogram, maxBuckets int) bool {
+	if maxBuckets <= 0 || h.UsesCustomBuckets() {
+		return false
+	}
+	return len(h.PositiveBuckets)+len(h.NegativeBuckets) > maxBuckets && h.Schema > histogram.ExponentialSchemaMin
+}
+
 // emitBinaryOpWarnings emits warnings for binary operation side effects.
 func emitBinaryOpWarnings(ctx context.Context, warn warnings.Warnings, opType parser.ItemType) {
 	if warn == 0 {
@@ -189,4 +297,7 @@ func emitBinaryOpWarnings(ctx context.Context, warn warnings.Warnings, opType pa
 	if warn&warnings.WarnIncompatibleTypesInBinOp != 0 {
 		warnings.AddToContext(annotations.IncompatibleTypesInBinOpInfo, ctx)
 	}
+	if warn&warnings.WarnHistogramSchemaReduced != 0 {
+		warnings.AddToContext(warnings.NewHistogramSchemaReducedInfo(parser.ItemTypeStr[opType]), ctx)
+	}
 }
@@ -4,10 +4,14 @@
 package binary
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"math"
 	"sync"
+	"time"
 
+	"github.com/thanos-io/promql-engine/execution/exchange"
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/execution/telemetry"
 	"github.com/thanos-io/promql-engine/extlabels"
@@ -23,7 +27,13 @@ import (
 )
 
 type joinBucket struct {
-	ats, bts     int64
+	ats, bts int64
+	// cts is the timestamp of the last step in which the bucket matched multiple low-card side series.
+	cts int64
+	// first is the high-card side sample ID with the lowest labels of the bucket in the step with timestamp fts.
+	// It is only tracked when implicit many-to-one matches keep a single match.
+	fts          int64
+	first        uint64
 	sid          uint64
 	val          float64
 	histogramVal *histogram.FloatHistogram
@@ -37,7 +47,45 @@ type vectorOperator struct {
 	opType     parser.ItemType
 	returnBool bool
 	stepsBatch int
-	sigFunc    func(labels.Labels) uint64
+	// keepMetricName keeps the metric name of the high-card side in the result.
+	keepMetricName bool
+	sigFunc        func(labels.Labels) uint64
+	// sigLabels are the labels considered by sigFunc, they are shown in the explain output for debugging.
+	sigLabels []string
+	// maxBuckets caps the bucket count of histogram results, zero means no limit.
+	maxBuckets int
+	// sortOrSeries orders the output series of "or" by label hash.
+	sortOrSeries bool
+	// histogramTolerance is the relative tolerance for histogram equality, zero means exact comparison.
+	histogramTolerance float64
+	// keepNaN keeps samples of comparisons involving NaN.
+	keepNaN bool
+	// dropNaN treats NaN samples as missing in "and" and "or" operations.
+	dropNaN bool
+	// nestedLoopJoinThreshold is the maximum number of low-card side series for which the join
+	// tables are built with a nested loop instead of hash tables.
+	nestedLoopJoinThreshold int
+	// maxOrSeries caps the combined series count of the operands of "or", zero means no limit.
+	maxOrSeries int
+	// permissiveManyToOne keeps the match with the lowest high-card side labels instead of failing implicit many-to-one matches.
+	permissiveManyToOne bool
+	// hcLabelsOrder is the position of each high-card side series when they are sorted by labels.
+	// It is only set for permissive many-to-one matching, since series IDs depend on the order of selection.
+	hcLabelsOrder []int
+	// skipManyToMany skips matching groups with multiple low-card side series instead of failing.
+	skipManyToMany bool
+	// validateSeriesIDs fails the operation when an output series is requested which is not in outputMap.
+	validateSeriesIDs bool
+	// invalidSeriesID is the first error found when validating output series IDs.
+	invalidSeriesID error
+	// goroutines bounds the goroutines used to read the lhs concurrently with the rhs.
+	goroutines *query.GoroutinePool
+
+	telemetry telemetry.OperatorTelemetry
+	// countCollisions enables tracking of signature hash collisions, which is only done when analysis is enabled.
+	countCollisions bool
+	// warnDedup makes sure that binary operation warnings are only added once per query.
+	warnDedup warnings.Dedup
 
 	once         sync.Once
 	series       []labels.Labels
@@ -47,9 +95,33 @@ type vectorOperator struct {
 
 	lcJoinBuckets []*joinBucket
 	hcJoinBuckets []*joinBucket
+	// nestedLoopJoin is set when the join tables were built with a nested loop.
+	nestedLoopJoin bool
+
+	// highCardSide is the operand which was resolved as the high-card side of the join.
+	// It is empty until the operator has been initialized.
+	highCardSide  binOpSide
+	highCardCount int
+	lowCardCount  int
 
 	lhsBuf []model.StepVector
 	rhsBuf []model.StepVector
+	// lhsCtx is used for reading the lhs so that it can be aborted when reading the rhs fails.
+	// It is derived from the context of the first call to Next and outlives that call, since
+	// operators like the concurrency operator keep using the context of their first call in
+	// background goroutines. It is cancelled once the operator returned its last batch or an error.
+	lhsCtx    context.Context
+	cancelLHS context.CancelFunc
+	// finished is set once the operator returned its last batch.
+	finished bool
+
+	// empty is set when the result of the operation has no series, which makes it possible
+	// to return empty steps without evaluating the operands.
+	empty       bool
+	mint        int64
+	maxt        int64
+	step        int64
+	currentStep int64
 }
 
 func NewVectorOperator(
@@ -58,26 +130,79 @@ func NewVectorOperator(
 	matching *parser.VectorMatching,
 	opType parser.ItemType,
 	returnBool bool,
+	keepMetricName bool,
 	opts *query.Options,
 ) (model.VectorOperator, error) {
+	// Prometheus rejects grouping modifiers for set operations when parsing.
+	// Plans which are not created from a parsed expression can still contain them.
+	if opType.IsSetOperator() {
+		if matching.Card == parser.CardOneToMany || matching.Card == parser.CardManyToOne || len(matching.Include) > 0 {
+			return nil, errors.Newf("no grouping allowed for %q operation", parser.ItemTypeStr[opType])
+		}
+		if matching.Card != parser.CardManyToMany {
+			return nil, errors.New("set operations must always be many-to-many")
+		}
+	}
+	if err := validateReturnBool(opType, returnBool); err != nil {
+		return nil, err
+	}
 	op := &vectorOperator{
-		lhs:        lhs,
-		rhs:        rhs,
-		matching:   matching,
-		opType:     opType,
-		returnBool: returnBool,
-		sigFunc:    signatureFunc(matching.On, matching.MatchingLabels...),
-		stepsBatch: opts.StepsBatch,
+		lhs:                lhs,
+		rhs:                rhs,
+		matching:           matching,
+		opType:             opType,
+		returnBool:         returnBool,
+		keepMetricName:     keepMetricName,
+		sigLabels:          signatureLabels(matching.On, matching.MatchingLabels...),
+		stepsBatch:         opts.StepsBatch,
+		maxBuckets:         opts.MaxHistogramBuckets,
+		sortOrSeries:       opts.SortOrSeries,
+		histogramTolerance: opts.HistogramEqualityTolerance,
+		keepNaN:            opts.KeepNaNComparisons,
+		dropNaN:            opts.DropNaNInSetOps,
+		countCollisions:    opts.EnableAnalysis,
+
+		nestedLoopJoinThreshold: opts.NestedLoopJoinThreshold,
+		maxOrSeries:             opts.MaxOrSeries,
+		permissiveManyToOne:     opts.PermissiveManyToOne,
+		skipManyToMany:          opts.SkipManyToManyMatches,
+		validateSeriesIDs:       opts.ValidateSeriesIDs,
+		goroutines:              opts.Goroutines,
+
+		mint:        opts.Start.UnixMilli(),
+		maxt:        opts.End.UnixMilli(),
+		step:        opts.Step.Milliseconds(),
+		currentStep: opts.Start.UnixMilli(),
 	}
 
-	return telemetry.NewOperator(telemetry.NewTelemetry(op, opts), op), nil
+	op.sigFunc = signatureFunc(matching.On, op.sigLabels)
+	if !opts.EnableSchemaReducedInfo {
+		op.warnDedup.Suppress(warnings.WarnHistogramSchemaReduced)
+	}
+
+	op.telemetry = telemetry.NewTelemetry(op, "vectorBinary", opts)
+	return telemetry.NewOperator(op.telemetry, op), nil
 }
 
 func (o *vectorOperator) String() string {
+	var s string
+	if o.matching.On {
+		s = fmt.Sprintf("[vectorBinary] %s - %v, on: %v, group: %v", parser.ItemTypeStr[o.opType], o.matching.Card.String(), o.matching.MatchingLabels, o.matching.Include)
+	} else {
+		s = fmt.Sprintf("[vectorBinary] %s - %v, ignoring: %v, group: %v", parser.ItemTypeStr[o.opType], o.matching.Card.String(), o.matching.MatchingLabels, o.matching.Include)
+	}
+	if o.highCardSide != "" {
+		s += fmt.Sprintf(", high-card: %s (%d series), low-card: %s (%d series)", o.highCardSide, o.highCardCount, o.highCardSide.other(), o.lowCardCount)
+	}
 	if o.matching.On {
-		return fmt.Sprintf("[vectorBinary] %s - %v, on: %v, group: %v", parser.ItemTypeStr[o.opType], o.matching.Card.String(), o.matching.MatchingLabels, o.matching.Include)
+		s += fmt.Sprintf(", signature: on %v", o.sigLabels)
+	} else {
+		s += fmt.Sprintf(", signature: ignoring %v", o.sigLabels)
 	}
-	return fmt.Sprintf("[vectorBinary] %s - %v, ignoring: %v, group: %v", parser.ItemTypeStr[o.opType], o.matching.Card.String(), o.matching.On, o.matching.Include)
+	if o.nestedLoopJoin {
+		s += ", join: nested-loop"
+	}
+	return s
 }
 
 func (o *vectorOperator) Explain() (next []model.VectorOperator) {
@@ -102,24 +227,56 @@ func (o *vectorOperator) Next(ctx context.Context, buf []model.StepVector) (int,
 	if err := o.initOnce(ctx); err != nil {
 		return 0, err
 	}
+	if o.empty {
+		return o.nextEmptySteps(buf), nil
+	}
+	if o.finished {
+		return 0, nil
+	}
 
-	var lhsN int
-	var lerrChan = make(chan error, 1)
-	go func() {
+	if o.lhsCtx == nil {
+		o.lhsCtx, o.cancelLHS = context.WithCancel(ctx)
+	}
+
+	var (
+		lhsN        int
+		lhsDuration time.Duration
+		lerrChan    = make(chan error, 1)
+	)
+	readLHS := func() {
+		start := time.Now()
 		var err error
-		lhsN, err = o.lhs.Next(ctx, o.lhsBuf)
+		lhsN, err = o.lhs.Next(o.lhsCtx, o.lhsBuf)
+		lhsDuration = time.Since(start)
 		if err != nil {
 			lerrChan <- err
 		}
 		close(lerrChan)
-	}()
+	}
+	concurrent := o.goroutines.TryGo(readLHS)
+	if !concurrent {
+		// The goroutine pool of the query is exhausted, so the operands are read one after the other.
+		readLHS()
+	}
+	o.telemetry.UpdatePeakGoroutines(o.goroutines.Peak())
 
+	start := time.Now()
 	rhsN, rerr := o.rhs.Next(ctx, o.rhsBuf)
+	rhsDuration := time.Since(start)
+	if rerr != nil {
+		// The lhs result is discarded, but we still wait for it since it writes into lhsBuf.
+		o.cancelLHS()
+	}
 	lerr := <-lerrChan
+	if concurrent {
+		// The faster side is idle until the slower one returns its batch.
+		o.telemetry.AddWaitTime(max(lhsDuration, rhsDuration) - min(lhsDuration, rhsDuration))
+	}
 	if rerr != nil {
 		return 0, rerr
 	}
 	if lerr != nil {
+		o.cancelLHS()
 		return 0, lerr
 	}
 
@@ -127,6 +284,9 @@ func (o *vectorOperator) Next(ctx context.Context, buf []model.StepVector) (int,
 	// we might want to drain or close the other one.
 	// We don't have a concept of closing an operator yet.
 	if lhsN == 0 || rhsN == 0 {
+		// Stop goroutines which children started with the lhs context.
+		o.cancelLHS()
+		o.finished = true
 		return 0, nil
 	}
 
@@ -134,9 +294,16 @@ func (o *vectorOperator) Next(ctx context.Context, buf []model.StepVector) (int,
 	minN := min(rhsN, lhsN)
 
 	for i := 0; i < minN && n < len(buf); i++ {
+		// Steps are matched by their position in the batch, so children must produce them in order.
+		if i > 0 && (o.lhsBuf[i].T < o.lhsBuf[i-1].T || o.rhsBuf[i].T < o.rhsBuf[i-1].T) {
+			return 0, errors.Newf("unexpected out of order steps in %q operation", parser.ItemTypeStr[o.opType])
+		}
 		if err := o.execBinaryOperation(ctx, o.lhsBuf[i], o.rhsBuf[i], &buf[n]); err != nil {
 			return 0, err
 		}
+		if o.invalidSeriesID != nil {
+			return 0, o.invalidSeriesID
+		}
 		n++
 	}
 
@@ -168,14 +335,33 @@ func (o *vectorOperator) init(ctx context.Context) error {
 	if err := <-errChan; err != nil {
 		return err
 	}
+	// The series of both operands of "or" are kept for the lifetime of the operator.
+	if o.opType == parser.LOR && o.maxOrSeries > 0 && len(highCardSide)+len(lowCardSide) > o.maxOrSeries {
+		return errors.Newf("%q operation exceeds the limit of %d series: lhs has %d series, rhs has %d series", parser.ItemTypeStr[o.opType], o.maxOrSeries, len(highCardSide), len(lowCardSide))
+	}
 	o.lhsSampleIDs = highCardSide
 	o.rhsSampleIDs = lowCardSide
 
+	o.highCardSide = lhBinOpSide
 	if o.matching.Card == parser.CardOneToMany {
 		highCardSide, lowCardSide = lowCardSide, highCardSide
+		o.highCardSide = rhBinOpSide
 	}
+	o.highCardCount = len(highCardSide)
+	o.lowCardCount = len(lowCardSide)
 
 	o.initJoinTables(highCardSide, lowCardSide)
+	// Operators which only call Next still need the output cardinality of the join in the analysis.
+	o.telemetry.SetMaxSeriesCount(len(o.series))
+
+	// The output series of "and" and "unless" are a subset of the lhs series which matched (or did not match)
+	// the rhs. Without any of them, all steps are empty regardless of the samples of the operands.
+	if (o.opType == parser.LAND || o.opType == parser.LUNLESS) && len(o.series) == 0 {
+		o.empty = true
+		exchange.Discard(o.lhs)
+		exchange.Discard(o.rhs)
+		return nil
+	}
 
 	// Pre-allocate buffers with appropriate inner slice capacities
 	// based on series counts from each side.
@@ -198,6 +384,25 @@ func (o *vectorOperator) init(ctx context.Context) error {
 	return nil
 }
 
+// nextEmptySteps fills the buffer with the next batch of steps without samples.
+func (o *vectorOperator) nextEmptySteps(buf []model.StepVector) int {
+	n := 0
+	ts := o.currentStep
+	for n < len(buf) && n < o.stepsBatch && ts <= o.maxt {
+		buf[n].Reset(ts)
+		ts += o.step
+		n++
+	}
+
+	// For instant queries, set the step to a positive value
+	// so that the operator can terminate.
+	if o.step == 0 {
+		o.step = 1
+	}
+	o.currentStep += o.step * int64(n)
+	return n
+}
+
 func (o *vectorOperator) execBinaryOperation(ctx context.Context, lhs, rhs model.StepVector, step *model.StepVector) error {
 	switch o.opType {
 	case parser.LAND:
@@ -215,7 +420,10 @@ func (o *vectorOperator) execBinaryAnd(lhs, rhs model.StepVector, step *model.St
 	ts := lhs.T
 	step.Reset(ts)
 
-	for _, sampleID := range rhs.SampleIDs {
+	for i, sampleID := range rhs.SampleIDs {
+		if o.isDroppedNaN(rhs.Samples[i]) {
+			continue
+		}
 		jp := o.lcJoinBuckets[sampleID]
 		jp.ats = ts
 	}
@@ -227,6 +435,9 @@ func (o *vectorOperator) execBinaryAnd(lhs, rhs model.StepVector, step *model.St
 
 	sampleHint := len(lhs.Samples)
 	for i, sampleID := range lhs.SampleIDs {
+		if o.isDroppedNaN(lhs.Samples[i]) {
+			continue
+		}
 		if jp := o.hcJoinBuckets[sampleID]; jp.ats == ts {
 			step.AppendSampleWithSizeHint(o.outputSeriesID(sampleID+1, 0), lhs.Samples[i], sampleHint)
 		}
@@ -247,6 +458,9 @@ func (o *vectorOperator) execBinaryOr(lhs, rhs model.StepVector, step *model.Ste
 
 	sampleHint := len(lhs.Samples) + len(rhs.Samples)
 	for i, sampleID := range lhs.SampleIDs {
+		if o.isDroppedNaN(lhs.Samples[i]) {
+			continue
+		}
 		jp := o.hcJoinBuckets[sampleID]
 		jp.ats = ts
 		step.AppendSampleWithSizeHint(o.outputSeriesID(sampleID+1, 0), lhs.Samples[i], sampleHint)
@@ -260,6 +474,9 @@ func (o *vectorOperator) execBinaryOr(lhs, rhs model.StepVector, step *model.Ste
 	}
 
 	for i, sampleID := range rhs.SampleIDs {
+		if o.isDroppedNaN(rhs.Samples[i]) {
+			continue
+		}
 		if jp := o.lcJoinBuckets[sampleID]; jp.ats != ts {
 			step.AppendSampleWithSizeHint(o.outputSeriesID(0, sampleID+1), rhs.Samples[i], sampleHint)
 		}
@@ -274,6 +491,11 @@ func (o *vectorOperator) execBinaryOr(lhs, rhs model.StepVector, step *model.Ste
 	return nil
 }
 
+// isDroppedNaN returns true if the sample is NaN and NaN samples should be treated as missing in set operations.
+func (o *vectorOperator) isDroppedNaN(v float64) bool {
+	return o.dropNaN && math.IsNaN(v)
+}
+
 func (o *vectorOperator) execBinaryUnless(lhs, rhs model.StepVector, step *model.StepVector) error {
 	ts := lhs.T
 	step.Reset(ts)
@@ -302,10 +524,24 @@ func (o *vectorOperator) execBinaryUnless(lhs, rhs model.StepVector, step *model
 	return nil
 }
 
-func (o *vectorOperator) computeBinaryPairing(hval, lval float64, hlhs, hrhs *histogram.FloatHistogram) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+func (o *vectorOperator) computeBinaryPairing(ctx context.Context, hval, lval float64, hlhs, hrhs *histogram.FloatHistogram) (float64, *histogram.FloatHistogram, bool, warnings.Warnings, error) {
+	// histogram operations copy all buckets and can be expensive, so we bail out early if the query was cancelled
+	if hlhs != nil || hrhs != nil {
+		if err := ctx.Err(); err != nil {
+			return 0, nil, false, 0, err
+		}
+	}
 	// operand is not commutative so we need to address potential swapping
 	if o.matching.Card == parser.CardOneToMany {
-		return binOp(o.opType, lval, hval, hlhs, hrhs)
+		hval, lval = lval, hval
+		hlhs, hrhs = hrhs, hlhs
+	}
+	if o.keepNaN && hlhs == nil && hrhs == nil && isNaNComparison(o.opType, hval, lval) {
+		return hval, nil, true, 0, nil
+	}
+	if o.histogramTolerance > 0 && hlhs != nil && hrhs != nil && (o.opType == parser.EQLC || o.opType == parser.NEQ) {
+		equal := histogramsApproxEqual(hlhs, hrhs, o.histogramTolerance)
+		return 0, hlhs, equal == (o.opType == parser.EQLC), 0, nil
 	}
 	return binOp(o.opType, hval, lval, hlhs, hrhs)
 }
@@ -319,6 +555,8 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 		h        *histogram.FloatHistogram
 		keep     bool
 		err      error
+		// dropped counts the samples filtered out by comparison operations.
+		dropped int
 	)
 
 	switch o.matching.Card {
@@ -338,7 +576,11 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 		jp := o.lcJoinBuckets[sampleID]
 		// Hash collisions on the low-card-side would imply a many-to-many relation.
 		if jp.ats == ts {
-			return o.newManyToManyMatchErrorOnLowCardSide(jp.sid, sampleID)
+			if o.skipManyToMany {
+				o.skipManyToManyMatch(ctx, lcs, jp, sampleID, ts)
+				continue
+			}
+			return o.newManyToManyMatchErrorOnLowCardSide(lcs, jp, sampleID)
 		}
 		jp.sid = sampleID
 		jp.val = lcs.Samples[i]
@@ -349,23 +591,39 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 		jp := o.lcJoinBuckets[histogramID]
 		// Hash collisions on the low-card-side would imply a many-to-many relation.
 		if jp.ats == ts {
-			return o.newManyToManyMatchErrorOnLowCardSide(jp.sid, histogramID)
+			if o.skipManyToMany {
+				o.skipManyToManyMatch(ctx, lcs, jp, histogramID, ts)
+				continue
+			}
+			return o.newManyToManyMatchErrorOnLowCardSide(lcs, jp, histogramID)
 		}
 		jp.sid = histogramID
 		jp.histogramVal = lcs.Histograms[i]
 		jp.ats = ts
 	}
 
-	sampleHint := len(hcs.Samples) + len(hcs.Histograms)
-	histogramHint := len(hcs.Samples) + len(hcs.Histograms)
+	// Every high-card side sample produces at most one output sample, and there can be no more
+	// output samples than output series. The step is sized for this upper bound on its first append,
+	// so it never grows afterwards, but it over-allocates when only a few series match.
+	sampleHint := min(len(hcs.Samples)+len(hcs.Histograms), len(o.series))
+	histogramHint := sampleHint
+
+	keepFirstMatch := o.permissiveManyToOne && o.matching.Card == parser.CardOneToOne
+	if keepFirstMatch {
+		o.findFirstMatches(hcs, ts)
+	}
 
 	for i, histogramID := range hcs.HistogramIDs {
 		jp := o.hcJoinBuckets[histogramID]
-		if jp.ats != ts {
+		if jp.ats != ts || jp.cts == ts {
 			continue
 		}
 		// Hash collisions on the high card side are expected except if a one-to-one
 		// matching was requested and we have an implicit many-to-one match instead.
+		if keepFirstMatch && jp.first != histogramID {
+			warnings.AddToContext(warnings.NewImplicitManyToOneInfo(parser.ItemTypeStr[o.opType]), ctx)
+			continue
+		}
 		if jp.bts == ts && o.matching.Card == parser.CardOneToOne {
 			return o.newImplicitManyToOneError()
 		}
@@ -373,16 +631,19 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 
 		var warn warnings.Warnings
 		if jp.histogramVal != nil {
-			_, h, keep, warn, err = o.computeBinaryPairing(0, 0, hcs.Histograms[i], jp.histogramVal)
+			_, h, keep, warn, err = o.computeBinaryPairing(ctx, 0, 0, hcs.Histograms[i], jp.histogramVal)
 		} else {
-			_, h, keep, warn, err = o.computeBinaryPairing(0, jp.val, hcs.Histograms[i], nil)
+			_, h, keep, warn, err = o.computeBinaryPairing(ctx, 0, jp.val, hcs.Histograms[i], nil)
 		}
 		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
 			warnings.AddToContext(err, ctx)
 			continue
 		}
 		if warn != 0 {
-			emitBinaryOpWarnings(ctx, warn, o.opType)
+			emitBinaryOpWarnings(ctx, o.warnDedup.Filter(warn), o.opType)
 			// For incompatible types, skip entirely - don't produce any output
 			if warn&warnings.WarnIncompatibleTypesInBinOp != 0 {
 				continue
@@ -398,21 +659,27 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 				step.AppendSampleWithSizeHint(o.outputSeriesID(histogramID+1, jp.sid+1), 0.0, sampleHint)
 			}
 		case !keep:
+			dropped++
 			continue
 		}
 
 		if h != nil {
+			h = o.limitBuckets(ctx, h, hcs.Histograms[i], jp.histogramVal)
 			step.AppendHistogramWithSizeHint(o.outputSeriesID(histogramID+1, jp.sid+1), h, histogramHint)
 		}
 	}
 
 	for i, sampleID := range hcs.SampleIDs {
 		jp := o.hcJoinBuckets[sampleID]
-		if jp.ats != ts {
+		if jp.ats != ts || jp.cts == ts {
 			continue
 		}
 		// Hash collisions on the high card side are expected except if a one-to-one
 		// matching was requested and we have an implicit many-to-one match instead.
+		if keepFirstMatch && jp.first != sampleID {
+			warnings.AddToContext(warnings.NewImplicitManyToOneInfo(parser.ItemTypeStr[o.opType]), ctx)
+			continue
+		}
 		if jp.bts == ts && o.matching.Card == parser.CardOneToOne {
 			return o.newImplicitManyToOneError()
 		}
@@ -421,29 +688,34 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 		var warn warnings.Warnings
 
 		if jp.histogramVal != nil {
-			_, h, keep, warn, err = o.computeBinaryPairing(hcs.Samples[i], 0, nil, jp.histogramVal)
+			_, h, keep, warn, err = o.computeBinaryPairing(ctx, hcs.Samples[i], 0, nil, jp.histogramVal)
 			if err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return ctxErr
+				}
 				warnings.AddToContext(err, ctx)
 				continue
 			}
 			if warn != 0 {
-				emitBinaryOpWarnings(ctx, warn, o.opType)
+				emitBinaryOpWarnings(ctx, o.warnDedup.Filter(warn), o.opType)
 				if warn&warnings.WarnIncompatibleTypesInBinOp != 0 {
 					continue
 				}
 			}
 			if !keep {
+				dropped++
 				continue
 			}
+			h = o.limitBuckets(ctx, h, jp.histogramVal)
 			step.AppendHistogramWithSizeHint(o.outputSeriesID(sampleID+1, jp.sid+1), h, histogramHint)
 		} else {
-			val, _, keep, warn, err = o.computeBinaryPairing(hcs.Samples[i], jp.val, nil, nil)
+			val, _, keep, warn, err = o.computeBinaryPairing(ctx, hcs.Samples[i], jp.val, nil, nil)
 			if err != nil {
 				warnings.AddToContext(err, ctx)
 				continue
 			}
 			if warn != 0 {
-				emitBinaryOpWarnings(ctx, warn, o.opType)
+				emitBinaryOpWarnings(ctx, o.warnDedup.Filter(warn), o.opType)
 			}
 			if o.returnBool {
 				val = 0
@@ -451,69 +723,165 @@ func (o *vectorOperator) execBinaryArithmetic(ctx context.Context, lhs, rhs mode
 					val = 1
 				}
 			} else if !keep {
+				dropped++
 				continue
 			}
 			step.AppendSampleWithSizeHint(o.outputSeriesID(sampleID+1, jp.sid+1), val, sampleHint)
 		}
 	}
+	if dropped > 0 {
+		o.telemetry.AddDroppedSamples(dropped)
+	}
 	return nil
 }
 
-func (o *vectorOperator) newManyToManyMatchErrorOnLowCardSide(originalSampleId, duplicateSampleId uint64) error {
+// limitBuckets returns h with its resolution reduced to at most maxBuckets buckets. Comparisons return
+// one of their operands, which can be shared with other steps or operators, so h is copied before it
+// is reduced when it is one of the given operands.
+func (o *vectorOperator) limitBuckets(ctx context.Context, h *histogram.FloatHistogram, operands ...*histogram.FloatHistogram) *histogram.FloatHistogram {
+	if !exceedsBucketLimit(h, o.maxBuckets) {
+		return h
+	}
+	if slices.Contains(operands, h) {
+		h = h.Copy()
+	}
+	if reduceHistogramResolution(h, o.maxBuckets) {
+		warnings.AddToContext(warnings.NewHistogramResolutionReducedInfo(parser.ItemTypeStr[o.opType], o.maxBuckets), ctx)
+	}
+	return h
+}
+
+// newManyToManyMatchErrorOnLowCardSide returns an error which contains all low-card side series of the step
+// which share the join bucket jp. The duplicate and the series recorded in jp come first, followed by the
+// other series of the bucket in the order in which their samples appear in the step. All float and
+// histogram samples of the step are scanned for them, since they can come before or after the duplicate.
+func (o *vectorOperator) newManyToManyMatchErrorOnLowCardSide(lcs model.StepVector, jp *joinBucket, duplicateSampleId uint64) error {
 	side := rhBinOpSide
-	labels := o.rhsSampleIDs
+	sideSeries := o.rhsSampleIDs
 
 	if o.matching.Card == parser.CardOneToMany {
 		side = lhBinOpSide
-		labels = o.lhsSampleIDs
+		sideSeries = o.lhsSampleIDs
+	}
+	series := []labels.Labels{sideSeries[duplicateSampleId], sideSeries[jp.sid]}
+	for _, ids := range [][]uint64{lcs.SampleIDs, lcs.HistogramIDs} {
+		for _, id := range ids {
+			if id != duplicateSampleId && id != jp.sid && o.lcJoinBuckets[id] == jp {
+				series = append(series, sideSeries[id])
+			}
+		}
+	}
+	return newManyToManyMatchError(o.matching, series, side)
+}
+
+// skipManyToManyMatch marks the join bucket as skipped for the step and reports the
+// many-to-many match once per step with an annotation.
+func (o *vectorOperator) skipManyToManyMatch(ctx context.Context, lcs model.StepVector, jp *joinBucket, duplicateSampleId uint64, ts int64) {
+	if jp.cts == ts {
+		return
+	}
+	jp.cts = ts
+	err := o.newManyToManyMatchErrorOnLowCardSide(lcs, jp, duplicateSampleId)
+	warnings.AddToContext(warnings.NewManyToManyMatchSkippedWarning(parser.ItemTypeStr[o.opType], err), ctx)
+}
+
+// findFirstMatches records the high-card side sample with the lowest labels of each join bucket in the step,
+// so that implicit many-to-one matches keep the same match regardless of the order of samples and series.
+func (o *vectorOperator) findFirstMatches(hcs model.StepVector, ts int64) {
+	for _, ids := range [][]uint64{hcs.SampleIDs, hcs.HistogramIDs} {
+		for _, id := range ids {
+			jp := o.hcJoinBuckets[id]
+			if jp.ats != ts {
+				continue
+			}
+			if jp.fts != ts || o.hcLabelsOrder[id] < o.hcLabelsOrder[jp.first] {
+				jp.fts = ts
+				jp.first = id
+			}
+		}
+	}
+}
+
+// labelsOrder returns the position of each series when they are sorted by labels.
+func labelsOrder(series []labels.Labels) []int {
+	ids := make([]int, len(series))
+	for i := range ids {
+		ids[i] = i
+	}
+	slices.SortFunc(ids, func(a, b int) int {
+		return labels.Compare(series[a], series[b])
+	})
+
+	order := make([]int, len(series))
+	for pos, id := range ids {
+		order[id] = pos
 	}
-	return newManyToManyMatchError(o.matching, labels[duplicateSampleId], labels[originalSampleId], side)
+	return order
 }
 
 func (o *vectorOperator) newImplicitManyToOneError() error {
 	return errors.New("multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)")
 }
 
+// outputSeriesID returns the output series for a pair of high-card and low-card sample IDs,
+// which are offset by one so that zero means the side is not part of the output.
 func (o *vectorOperator) outputSeriesID(hc, lc uint64) uint64 {
-	return o.outputMap[cantorPairing(hc, lc)]
+	id, ok := o.outputMap[cantorPairing(hc, lc)]
+	if !ok && o.validateSeriesIDs && o.invalidSeriesID == nil {
+		o.invalidSeriesID = errors.Newf("internal error: %q operation produced unregistered output series for high-card sample ID %d and low-card sample ID %d", parser.ItemTypeStr[o.opType], int64(hc)-1, int64(lc)-1)
+	}
+	return id
 }
 
 func (o *vectorOperator) initJoinTables(highCardSide, lowCardSide []labels.Labels) {
 	var (
-		joinBucketsByHash     = make(map[uint64]*joinBucket)
-		lcJoinBuckets         = make([]*joinBucket, len(lowCardSide))
-		hcJoinBuckets         = make([]*joinBucket, len(highCardSide))
-		lcHashToSeriesIDs     = make(map[uint64][]uint64, len(lowCardSide))
-		hcHashToSeriesIDs     = make(map[uint64][]uint64, len(highCardSide))
-		lcSampleIdToSignature = make(map[int]uint64, len(lowCardSide))
-		hcSampleIdToSignature = make(map[int]uint64, len(highCardSide))
+		lcSignatures = make([]uint64, len(lowCardSide))
+		hcSignatures = make([]uint64, len(highCardSide))
 
 		outputMap = make(map[uint64]uint64, len(highCardSide))
 	)
 
-	// initialize join bucket mappings
+	if o.permissiveManyToOne && o.matching.Card == parser.CardOneToOne {
+		o.hcLabelsOrder = labelsOrder(highCardSide)
+	}
+
+	collisions := newCollisionCounter(o.countCollisions, o.matching)
 	for i := range lowCardSide {
-		sig := o.sigFunc(lowCardSide[i])
-		lcSampleIdToSignature[i] = sig
-		lcHashToSeriesIDs[sig] = append(lcHashToSeriesIDs[sig], uint64(i))
-		if jb, ok := joinBucketsByHash[sig]; ok {
-			lcJoinBuckets[i] = jb
-		} else {
-			jb := joinBucket{ats: -1, bts: -1}
-			joinBucketsByHash[sig] = &jb
-			lcJoinBuckets[i] = &jb
-		}
+		lcSignatures[i] = o.sigFunc(lowCardSide[i])
+		collisions.observe(lcSignatures[i], lowCardSide[i])
 	}
 	for i := range highCardSide {
-		sig := o.sigFunc(highCardSide[i])
-		hcSampleIdToSignature[i] = sig
-		hcHashToSeriesIDs[sig] = append(hcHashToSeriesIDs[sig], uint64(i))
-		if jb, ok := joinBucketsByHash[sig]; ok {
-			hcJoinBuckets[i] = jb
-		} else {
-			jb := joinBucket{ats: -1, bts: -1}
-			joinBucketsByHash[sig] = &jb
-			hcJoinBuckets[i] = &jb
+		hcSignatures[i] = o.sigFunc(highCardSide[i])
+		collisions.observe(hcSignatures[i], highCardSide[i])
+	}
+
+	// initialize join bucket mappings
+	var (
+		matchingSeries func(sig uint64) []uint64
+		numJoinBuckets int
+	)
+	if o.nestedLoopJoinThreshold > 0 && len(lowCardSide) <= o.nestedLoopJoinThreshold {
+		o.nestedLoopJoin = true
+		o.lcJoinBuckets, o.hcJoinBuckets = nestedLoopJoinBuckets(lcSignatures, hcSignatures)
+		// Unmatched high-card side series do not share buckets here, so the number of buckets is
+		// counted separately to report the same count as hash joins. This is only done for analysis.
+		if o.countCollisions {
+			numJoinBuckets = countDistinctSignatures(lcSignatures, hcSignatures)
+		}
+		matchingSeries = func(sig uint64) []uint64 {
+			var ids []uint64
+			for i, lcSig := range lcSignatures {
+				if lcSig == sig {
+					ids = append(ids, uint64(i))
+				}
+			}
+			return ids
+		}
+	} else {
+		var lcHashToSeriesIDs map[uint64][]uint64
+		o.lcJoinBuckets, o.hcJoinBuckets, lcHashToSeriesIDs, numJoinBuckets = hashJoinBuckets(lcSignatures, hcSignatures)
+		matchingSeries = func(sig uint64) []uint64 {
+			return lcHashToSeriesIDs[sig]
 		}
 	}
 
@@ -524,19 +892,27 @@ func (o *vectorOperator) initJoinTables(highCardSide, lowCardSide []labels.Label
 		// "and" can only have matches if lhs and rhs have collision, so we only need to populate
 		// the output map for lhs series that have corresponding hash collision
 		for i := range highCardSide {
-			sig := hcSampleIdToSignature[i]
-			if lcs := lcHashToSeriesIDs[sig]; len(lcs) == 0 {
+			if lcs := matchingSeries(hcSignatures[i]); len(lcs) == 0 {
 				continue
 			}
 			outputMap[cantorPairing(uint64(i+1), 0)] = uint64(h.append(highCardSide[i]))
 		}
 	case parser.LOR:
+		// Identical label sets on both sides are deduplicated by the join helper, so both entries of
+		// such a series point to the same output series. The rhs sample is only used in steps without
+		// a lhs sample since both share a join bucket.
 		for i := range highCardSide {
 			outputMap[cantorPairing(uint64(i+1), 0)] = uint64(h.append(highCardSide[i]))
 		}
 		for i := range lowCardSide {
 			outputMap[cantorPairing(0, uint64(i+1))] = uint64(h.append(lowCardSide[i]))
 		}
+		if o.sortOrSeries {
+			remap := h.sortByHash()
+			for k, v := range outputMap {
+				outputMap[k] = remap[v]
+			}
+		}
 	case parser.LUNLESS:
 		for i := range highCardSide {
 			outputMap[cantorPairing(uint64(i+1), 0)] = uint64(h.append(highCardSide[i]))
@@ -544,21 +920,125 @@ func (o *vectorOperator) initJoinTables(highCardSide, lowCardSide []labels.Label
 	default:
 		b := labels.NewBuilder(labels.EmptyLabels())
 		for i := range highCardSide {
-			sig := hcSampleIdToSignature[i]
-			lcs, ok := lcHashToSeriesIDs[sig]
-			if !ok {
-				continue
-			}
-			for _, lc := range lcs {
+			for _, lc := range matchingSeries(hcSignatures[i]) {
 				n := h.append(o.resultMetric(b, highCardSide[i], lowCardSide[lc]))
 				outputMap[cantorPairing(uint64(i+1), uint64(lc+1))] = uint64(n)
 			}
 		}
 	}
+	o.telemetry.AddHashCollisions(collisions.count)
+	o.telemetry.SetJoinBucketCount(numJoinBuckets)
 	o.series = h.ls
 	o.outputMap = outputMap
-	o.lcJoinBuckets = lcJoinBuckets
-	o.hcJoinBuckets = hcJoinBuckets
+}
+
+// hashJoinBuckets assigns series with the same signature to the same join bucket using hash tables.
+// It also returns the IDs of the low-card side series for each signature and the number of distinct buckets.
+func hashJoinBuckets(lcSignatures, hcSignatures []uint64) ([]*joinBucket, []*joinBucket, map[uint64][]uint64, int) {
+	var (
+		joinBucketsByHash = make(map[uint64]*joinBucket)
+		lcJoinBuckets     = make([]*joinBucket, len(lcSignatures))
+		hcJoinBuckets     = make([]*joinBucket, len(hcSignatures))
+		lcHashToSeriesIDs = make(map[uint64][]uint64, len(lcSignatures))
+	)
+	for i, sig := range lcSignatures {
+		lcHashToSeriesIDs[sig] = append(lcHashToSeriesIDs[sig], uint64(i))
+		if jb, ok := joinBucketsByHash[sig]; ok {
+			lcJoinBuckets[i] = jb
+		} else {
+			jb := joinBucket{ats: -1, bts: -1, cts: -1, fts: -1}
+			joinBucketsByHash[sig] = &jb
+			lcJoinBuckets[i] = &jb
+		}
+	}
+	for i, sig := range hcSignatures {
+		if jb, ok := joinBucketsByHash[sig]; ok {
+			hcJoinBuckets[i] = jb
+		} else {
+			jb := joinBucket{ats: -1, bts: -1, cts: -1, fts: -1}
+			joinBucketsByHash[sig] = &jb
+			hcJoinBuckets[i] = &jb
+		}
+	}
+	return lcJoinBuckets, hcJoinBuckets, lcHashToSeriesIDs, len(joinBucketsByHash)
+}
+
+// nestedLoopJoinBuckets assigns series with the same signature to the same join bucket by comparing
+// the signatures of both sides pairwise. This is quadratic in the number of low-card side series,
+// but does not allocate any hash tables which makes it cheaper when the low-card side is small.
+// High-card side series without a match never share a bucket with the low-card side, so they
+// do not need to share a bucket with each other either.
+func nestedLoopJoinBuckets(lcSignatures, hcSignatures []uint64) ([]*joinBucket, []*joinBucket) {
+	lcJoinBuckets := make([]*joinBucket, len(lcSignatures))
+	for i, sig := range lcSignatures {
+		for j := range i {
+			if lcSignatures[j] == sig {
+				lcJoinBuckets[i] = lcJoinBuckets[j]
+				break
+			}
+		}
+		if lcJoinBuckets[i] == nil {
+			lcJoinBuckets[i] = &joinBucket{ats: -1, bts: -1, cts: -1, fts: -1}
+		}
+	}
+	hcJoinBuckets := make([]*joinBucket, len(hcSignatures))
+	for i, sig := range hcSignatures {
+		for j, lcSig := range lcSignatures {
+			if lcSig == sig {
+				hcJoinBuckets[i] = lcJoinBuckets[j]
+				break
+			}
+		}
+		if hcJoinBuckets[i] == nil {
+			hcJoinBuckets[i] = &joinBucket{ats: -1, bts: -1, cts: -1, fts: -1}
+		}
+	}
+	return lcJoinBuckets, hcJoinBuckets
+}
+
+// countDistinctSignatures returns the number of distinct signatures across both sides,
+// which is the number of buckets a hash join creates for them.
+func countDistinctSignatures(lcSignatures, hcSignatures []uint64) int {
+	seen := make(map[uint64]struct{}, len(lcSignatures))
+	for _, sig := range lcSignatures {
+		seen[sig] = struct{}{}
+	}
+	for _, sig := range hcSignatures {
+		seen[sig] = struct{}{}
+	}
+	return len(seen)
+}
+
+// collisionCounter counts distinct matching label sets which share a signature hash with another one.
+type collisionCounter struct {
+	enabled  bool
+	matching *parser.VectorMatching
+	seen     map[uint64][]labels.Labels
+	count    int
+}
+
+func newCollisionCounter(enabled bool, matching *parser.VectorMatching) *collisionCounter {
+	c := &collisionCounter{enabled: enabled, matching: matching}
+	if enabled {
+		c.seen = make(map[uint64][]labels.Labels)
+	}
+	return c
+}
+
+func (c *collisionCounter) observe(sig uint64, lbls labels.Labels) {
+	if !c.enabled {
+		return
+	}
+	matched := lbls.MatchLabels(c.matching.On, c.matching.MatchingLabels...)
+	for _, other := range c.seen[sig] {
+		if labels.Equal(other, matched) {
+			return
+		}
+	}
+	c.seen[sig] = append(c.seen[sig], matched)
+	if len(c.seen[sig]) > 1 {
+		c.count++
+	}
 }
 
 type joinHelper struct {
@@ -583,10 +1063,36 @@ func (h *joinHelper) append(ls labels.Labels) int {
 	return h.n - 1
 }
 
+// sortByHash orders the series by their label hash and returns a mapping from old to new series IDs.
+// Series with colliding hashes are ordered by their labels.
+func (h *joinHelper) sortByHash() []uint64 {
+	hashes := make([]uint64, len(h.ls))
+	order := make([]int, len(h.ls))
+	for i := range h.ls {
+		hashes[i] = h.ls[i].Hash()
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		if c := cmp.Compare(hashes[a], hashes[b]); c != 0 {
+			return c
+		}
+		return labels.Compare(h.ls[a], h.ls[b])
+	})
+
+	remap := make([]uint64, len(h.ls))
+	sorted := make([]labels.Labels, len(h.ls))
+	for newID, oldID := range order {
+		remap[oldID] = uint64(newID)
+		sorted[newID] = h.ls[oldID]
+	}
+	h.ls = sorted
+	return remap
+}
+
 func (o *vectorOperator) resultMetric(b *labels.Builder, highCard, lowCard labels.Labels) labels.Labels {
 	b.Reset(highCard)
 
-	if shouldDropMetricName(o.opType, o.returnBool) {
+	if shouldDropMetricName(o.opType, o.returnBool, o.keepMetricName) {
 		b.Del(labels.MetricName)
 		b.Del(extlabels.MetricType)
 		b.Del(extlabels.MetricUnit)
@@ -606,7 +1112,7 @@ func (o *vectorOperator) resultMetric(b *labels.Builder, highCard, lowCard label
 			b.Del(ln)
 		}
 	}
-	if o.returnBool {
+	if o.returnBool && !o.keepMetricName {
 		b.Del(labels.MetricName)
 		b.Del(extlabels.MetricType)
 		b.Del(extlabels.MetricUnit)
@@ -614,16 +1120,25 @@ func (o *vectorOperator) resultMetric(b *labels.Builder, highCard, lowCard label
 	return b.Labels()
 }
 
-func signatureFunc(on bool, names ...string) func(labels.Labels) uint64 {
+// signatureLabels returns the sorted labels which are included in (for on) or excluded from (for ignoring)
+// the join signature. The metric name is always excluded when matching with ignoring.
+func signatureLabels(on bool, names ...string) []string {
+	if on {
+		names = slices.Clone(names)
+	} else {
+		names = append([]string{labels.MetricName}, names...)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func signatureFunc(on bool, names []string) func(labels.Labels) uint64 {
 	b := make([]byte, 256)
 	if on {
-		slices.Sort(names)
 		return func(lset labels.Labels) uint64 {
 			return xxhash.Sum64(lset.BytesWithLabels(b, names...))
 		}
 	}
-	names = append([]string{labels.MetricName}, names...)
-	slices.Sort(names)
 	return func(lset labels.Labels) uint64 {
 		return xxhash.Sum64(lset.BytesWithoutLabels(b, names...))
 	}
@@ -0,0 +1,138 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package binary
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// seriesOperator returns the given series without any samples.
+// It keeps the context of the last call to Next in ctx.
+type seriesOperator struct {
+	series []labels.Labels
+	ctx    context.Context
+}
+
+func (o *seriesOperator) Next(ctx context.Context, _ []model.StepVector) (int, error) {
+	o.ctx = ctx
+	return 0, nil
+}
+
+func (o *seriesOperator) Series(context.Context) ([]labels.Labels, error) { return o.series, nil }
+
+func (o *seriesOperator) Explain() []model.VectorOperator { return nil }
+
+func (o *seriesOperator) String() string { return "[series]" }
+
+func TestCollisionCounter(t *testing.T) {
+	t.Parallel()
+
+	matching := &parser.VectorMatching{On: true, MatchingLabels: []string{"pod"}}
+	for _, tc := range []struct {
+		name     string
+		enabled  bool
+		sigs     []uint64
+		series   []labels.Labels
+		expected int
+	}{
+		{
+			name:     "distinct signatures",
+			enabled:  true,
+			sigs:     []uint64{1, 2},
+			series:   []labels.Labels{labels.FromStrings("pod", "a"), labels.FromStrings("pod", "b")},
+			expected: 0,
+		},
+		{
+			name:    "same matching labels",
+			enabled: true,
+			sigs:    []uint64{1, 1},
+			series: []labels.Labels{
+				labels.FromStrings(labels.MetricName, "foo", "pod", "a"),
+				labels.FromStrings(labels.MetricName, "bar", "pod", "a"),
+			},
+			expected: 0,
+		},
+		{
+			name:    "different matching labels",
+			enabled: true,
+			sigs:    []uint64{1, 1, 1, 1},
+			series: []labels.Labels{
+				labels.FromStrings("pod", "a"),
+				labels.FromStrings("pod", "b"),
+				labels.FromStrings("pod", "c"),
+				labels.FromStrings("container", "x", "pod", "c"),
+			},
+			expected: 2,
+		},
+		{
+			name:     "disabled",
+			sigs:     []uint64{1, 1},
+			series:   []labels.Labels{labels.FromStrings("pod", "a"), labels.FromStrings("pod", "b")},
+			expected: 0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCollisionCounter(tc.enabled, matching)
+			for i, sig := range tc.sigs {
+				c.observe(sig, tc.series[i])
+			}
+			testutil.Equals(t, tc.expected, c.count)
+		})
+	}
+}
+
+func TestVectorOperatorReportsHashCollisions(t *testing.T) {
+	t.Parallel()
+
+	lhs := &seriesOperator{series: []labels.Labels{
+		labels.FromStrings(labels.MetricName, "foo", "pod", "a"),
+		labels.FromStrings(labels.MetricName, "foo", "pod", "b"),
+	}}
+	rhs := &seriesOperator{series: []labels.Labels{
+		labels.FromStrings(labels.MetricName, "bar", "pod", "a"),
+	}}
+	matching := &parser.VectorMatching{Card: parser.CardOneToOne, On: true, MatchingLabels: []string{"pod"}}
+	op, err := NewVectorOperator(lhs, rhs, matching, parser.MUL, false, false, &query.Options{EnableAnalysis: true, StepsBatch: 10})
+	testutil.Ok(t, err)
+
+	// Hashes of distinct label sets practically never collide, so all series are given the same signature.
+	op.(*telemetry.Operator).Unwrap().(*vectorOperator).sigFunc = func(labels.Labels) uint64 { return 0 }
+
+	_, err = op.Series(context.Background())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, op.(telemetry.ObservableVectorOperator).HashCollisions())
+}
+
+func TestVectorOperatorCancelsLHSContextWhenFinished(t *testing.T) {
+	t.Parallel()
+
+	lhs := &seriesOperator{series: []labels.Labels{labels.FromStrings(labels.MetricName, "foo", "pod", "a")}}
+	rhs := &seriesOperator{series: []labels.Labels{labels.FromStrings(labels.MetricName, "bar", "pod", "a")}}
+	matching := &parser.VectorMatching{Card: parser.CardOneToOne, On: true, MatchingLabels: []string{"pod"}}
+	op, err := NewVectorOperator(lhs, rhs, matching, parser.MUL, false, false, &query.Options{StepsBatch: 10})
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	buf := make([]model.StepVector, 10)
+	n, err := op.Next(ctx, buf)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, n)
+	testutil.Equals(t, context.Canceled, lhs.ctx.Err())
+
+	// The operands are not read again once the operator is finished.
+	lhs.ctx = nil
+	n, err = op.Next(ctx, buf)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, n)
+	testutil.Assert(t, lhs.ctx == nil, "expected the lhs not to be read again")
+}
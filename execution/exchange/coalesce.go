@@ -63,7 +63,7 @@ func NewCoalesce(opts *query.Options, batchSize int64, operators ...model.Vector
 		batchSize:     batchSize,
 	}
 
-	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, "coalesce", opts), oper)
 }
 
 func (c *coalesce) Explain() (next []model.VectorOperator) {
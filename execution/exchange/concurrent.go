@@ -46,7 +46,7 @@ func NewConcurrent(next model.VectorOperator, bufferSize int, opts *query.Option
 		returnChan: make(chan []model.StepVector, bufferSize+2),
 	}
 
-	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, "concurrent", opts), oper)
 }
 
 func (c *concurrencyOperator) Explain() (next []model.VectorOperator) {
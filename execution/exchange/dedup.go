@@ -44,7 +44,7 @@ func NewDedupOperator(next model.VectorOperator, opts *query.Options) model.Vect
 	oper := &dedupOperator{
 		next: next,
 	}
-	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, "dedup", opts), oper)
 }
 
 func (d *dedupOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
@@ -5,6 +5,7 @@ package exchange
 
 import (
 	"context"
+	"math"
 	"sync"
 
 	"github.com/thanos-io/promql-engine/execution/model"
@@ -22,14 +23,17 @@ type duplicateLabelCheckOperator struct {
 	next model.VectorOperator
 
 	p []pair
-	c []uint64
+	// c counts the samples of each series at timestamp ts. Only the counters of the
+	// current timestamp are kept, since samples of one timestamp can span multiple batches.
+	c  []uint64
+	ts int64
 }
 
 func NewDuplicateLabelCheck(next model.VectorOperator, opts *query.Options) model.VectorOperator {
 	oper := &duplicateLabelCheckOperator{
 		next: next,
 	}
-	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, "duplicateLabelCheck", opts), oper)
 }
 
 func (d *duplicateLabelCheckOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
@@ -51,24 +55,22 @@ func (d *duplicateLabelCheckOperator) Next(ctx context.Context, buf []model.Step
 		return 0, nil
 	}
 
-	// TODO: currently there is a bug, we need to reset 'd.c's state
-	// if the current timestamp changes. With configured BatchSize we
-	// dont see all samples for a timestamp in the same batch, but this
-	// logic relies on that.
 	if len(d.p) > 0 {
-		for i := range d.p {
-			d.c[d.p[i].a] = 0
-			d.c[d.p[i].b] = 0
-		}
 		for i := range n {
 			sv := &buf[i]
+			if sv.T > d.ts {
+				d.reset(sv.T)
+			}
 			for _, sid := range sv.SampleIDs {
-				d.c[sid] |= 2 << i
+				d.c[sid]++
 			}
-		}
-		for i := range d.p {
-			if d.c[d.p[i].a]&d.c[d.p[i].b] > 0 {
-				return 0, extlabels.ErrDuplicateLabelSet
+			for _, sid := range sv.HistogramIDs {
+				d.c[sid]++
+			}
+			for j := range d.p {
+				if d.c[d.p[j].a] > 0 && d.c[d.p[j].b] > 0 {
+					return 0, extlabels.ErrDuplicateLabelSet
+				}
 			}
 		}
 	}
@@ -76,6 +78,16 @@ func (d *duplicateLabelCheckOperator) Next(ctx context.Context, buf []model.Step
 	return n, nil
 }
 
+// reset clears the counters of the previous timestamp when a new timestamp is observed.
+// Only series which are part of a pair can collide, so only their counters need to be cleared.
+func (d *duplicateLabelCheckOperator) reset(ts int64) {
+	for i := range d.p {
+		d.c[d.p[i].a] = 0
+		d.c[d.p[i].b] = 0
+	}
+	d.ts = ts
+}
+
 func (d *duplicateLabelCheckOperator) Series(ctx context.Context) ([]labels.Labels, error) {
 	if err := d.init(ctx); err != nil {
 		return nil, err
@@ -116,6 +128,7 @@ func (d *duplicateLabelCheckOperator) init(ctx context.Context) error {
 		}
 		d.p = p
 		d.c = c
+		d.ts = math.MinInt64
 	})
 	return err
 }
@@ -0,0 +1,252 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// fanOutBatch is a batch of step vectors read from the shared operator
+// which has not yet been read by all consumers.
+type fanOutBatch struct {
+	vectors []model.StepVector
+	n       int
+	pending int
+}
+
+// FanOut shares the output of a single operator between multiple consumers.
+// Batches are pulled from the shared operator by whichever consumer needs them first
+// and are buffered until every consumer has read them. Consumers get their own copy
+// of each batch, except for the last consumer which takes over the buffered vectors.
+// Buffers are only reused for new batches once all consumers have read them.
+// Consumers which are not going to be read anymore need to be discarded with Discard,
+// otherwise batches are buffered for them until the end of the query.
+type FanOut struct {
+	next model.VectorOperator
+	opts *query.Options
+
+	seriesOnce sync.Once
+	series     []labels.Labels
+	seriesErr  error
+
+	// pullMu serializes reading from the shared operator. It is acquired before mu,
+	// so that consumers can read buffered batches while another consumer pulls a new one.
+	pullMu sync.Mutex
+
+	mu        sync.Mutex
+	consumers int
+	// offset is the position of the first buffered batch in the output of next.
+	offset  int
+	batches []*fanOutBatch
+	free    [][]model.StepVector
+	done    bool
+	err     error
+}
+
+func NewFanOut(next model.VectorOperator, opts *query.Options) *FanOut {
+	return &FanOut{next: next, opts: opts}
+}
+
+// NewConsumer registers a new consumer of the shared operator.
+// All consumers need to be registered before the first batch is read.
+func (f *FanOut) NewConsumer() model.VectorOperator {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.consumers++
+	oper := &fanOutConsumer{fanOut: f}
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, "fanout", f.opts), oper)
+}
+
+// Discard releases the batches buffered for the fan-out consumers in the tree of the given operator.
+// It needs to be called for operands which are not going to be read anymore. Shared operators
+// below the consumers are still read by their other consumers, so they are not descended into.
+func Discard(op model.VectorOperator) {
+	if w, ok := op.(*telemetry.Operator); ok {
+		op = w.Unwrap()
+	}
+	if c, ok := op.(*fanOutConsumer); ok {
+		c.discard()
+		return
+	}
+	for _, child := range op.Explain() {
+		Discard(child)
+	}
+}
+
+func (f *FanOut) seriesForConsumer(ctx context.Context) ([]labels.Labels, error) {
+	f.seriesOnce.Do(func() {
+		f.series, f.seriesErr = f.next.Series(ctx)
+	})
+	if f.seriesErr != nil {
+		return nil, f.seriesErr
+	}
+	// Consumers can modify the returned slice, so each of them gets its own.
+	return slices.Clone(f.series), nil
+}
+
+func (f *FanOut) nextForConsumer(ctx context.Context, pos int, buf []model.StepVector) (int, error) {
+	for {
+		if n, ok, err := f.read(pos, buf); ok {
+			return n, err
+		}
+		f.pull(ctx, pos)
+	}
+}
+
+// read copies the batch at the given position into buf. It returns false
+// if the batch still needs to be pulled from the shared operator.
+func (f *FanOut) read(pos int, buf []model.StepVector) (int, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if pos-f.offset >= len(f.batches) {
+		if f.err != nil {
+			return 0, true, f.err
+		}
+		return 0, f.done, nil
+	}
+
+	batch := f.batches[pos-f.offset]
+	batch.pending--
+
+	n := min(batch.n, len(buf))
+	if batch.pending > 0 {
+		for i := range n {
+			copyVector(&buf[i], batch.vectors[i])
+		}
+		return n, true, nil
+	}
+
+	// This is the last consumer to read the batch, so it can take over the vectors.
+	for i := range n {
+		buf[i], batch.vectors[i] = batch.vectors[i], buf[i]
+	}
+	f.releaseReadBatches()
+	return n, true, nil
+}
+
+// pull reads the next batch from the shared operator, unless another consumer
+// already did so while this one was waiting for pullMu.
+func (f *FanOut) pull(ctx context.Context, pos int) {
+	f.pullMu.Lock()
+	defer f.pullMu.Unlock()
+
+	f.mu.Lock()
+	if pos-f.offset < len(f.batches) || f.done || f.err != nil {
+		f.mu.Unlock()
+		return
+	}
+	var vectors []model.StepVector
+	if len(f.free) > 0 {
+		vectors = f.free[len(f.free)-1]
+		f.free = f.free[:len(f.free)-1]
+	} else {
+		vectors = make([]model.StepVector, f.opts.StepsBatch)
+	}
+	f.mu.Unlock()
+
+	n, err := f.next.Next(ctx, vectors)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		f.err = err
+		return
+	}
+	if n == 0 {
+		f.done = true
+		f.free = append(f.free, vectors)
+		return
+	}
+	f.batches = append(f.batches, &fanOutBatch{vectors: vectors, n: n, pending: f.consumers})
+}
+
+// discard unregisters a consumer which has read the batches before the given position.
+func (f *FanOut) discard(pos int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.consumers--
+	for i := max(pos-f.offset, 0); i < len(f.batches); i++ {
+		f.batches[i].pending--
+	}
+	f.releaseReadBatches()
+}
+
+// releaseReadBatches makes the buffers of batches which were read by all consumers available for new batches.
+// Consumers read batches in order, so these are always the first buffered batches.
+func (f *FanOut) releaseReadBatches() {
+	for len(f.batches) > 0 && f.batches[0].pending == 0 {
+		f.free = append(f.free, f.batches[0].vectors)
+		f.batches[0] = nil
+		f.batches = f.batches[1:]
+		f.offset++
+	}
+}
+
+func copyVector(dst *model.StepVector, src model.StepVector) {
+	dst.Reset(src.T)
+	dst.AppendSamples(src.SampleIDs, src.Samples)
+	for i, h := range src.Histograms {
+		dst.AppendHistogram(src.HistogramIDs[i], h.Copy())
+	}
+}
+
+// fanOutConsumer is a model.VectorOperator reading the output of a FanOut.
+type fanOutConsumer struct {
+	fanOut    *FanOut
+	pos       int
+	discarded bool
+}
+
+func (c *fanOutConsumer) Explain() (next []model.VectorOperator) {
+	return []model.VectorOperator{c.fanOut.next}
+}
+
+func (c *fanOutConsumer) String() string {
+	c.fanOut.mu.Lock()
+	defer c.fanOut.mu.Unlock()
+	return fmt.Sprintf("[fanout(consumers=%d)]", c.fanOut.consumers)
+}
+
+func (c *fanOutConsumer) Series(ctx context.Context) ([]labels.Labels, error) {
+	return c.fanOut.seriesForConsumer(ctx)
+}
+
+func (c *fanOutConsumer) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	if c.discarded {
+		return 0, nil
+	}
+
+	n, err := c.fanOut.nextForConsumer(ctx, c.pos, buf)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	c.pos++
+	return n, nil
+}
+
+func (c *fanOutConsumer) discard() {
+	if c.discarded {
+		return
+	}
+	c.discarded = true
+	c.fanOut.discard(c.pos)
+}
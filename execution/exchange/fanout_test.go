@@ -0,0 +1,117 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package exchange
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// stepsOperator returns one sample with the value of the timestamp for each of its steps.
+// Once the first steps were returned, Next waits for blocked to be closed if it is set.
+type stepsOperator struct {
+	steps   int
+	current int
+
+	first   int
+	blocked chan struct{}
+}
+
+func (o *stepsOperator) Next(_ context.Context, buf []model.StepVector) (int, error) {
+	if o.blocked != nil && o.current >= o.first {
+		<-o.blocked
+	}
+	n := 0
+	for ; n < len(buf) && o.current < o.steps; n++ {
+		buf[n].Reset(int64(o.current))
+		buf[n].AppendSample(0, float64(o.current))
+		o.current++
+	}
+	return n, nil
+}
+
+func (o *stepsOperator) Series(context.Context) ([]labels.Labels, error) {
+	return []labels.Labels{labels.FromStrings("foo", "bar")}, nil
+}
+
+func (o *stepsOperator) Explain() []model.VectorOperator { return nil }
+
+func (o *stepsOperator) String() string { return "[steps]" }
+
+func readSteps(t *testing.T, op model.VectorOperator, batches int) []float64 {
+	t.Helper()
+
+	var values []float64
+	buf := make([]model.StepVector, 2)
+	for range batches {
+		n, err := op.Next(context.Background(), buf)
+		testutil.Ok(t, err)
+		for _, v := range buf[:n] {
+			values = append(values, v.Samples...)
+		}
+	}
+	return values
+}
+
+func TestFanOutConsumersReadAllBatches(t *testing.T) {
+	t.Parallel()
+
+	f := NewFanOut(&stepsOperator{steps: 5}, &query.Options{StepsBatch: 2})
+	a, b := f.NewConsumer(), f.NewConsumer()
+
+	testutil.Equals(t, []float64{0, 1, 2, 3}, readSteps(t, a, 2))
+	testutil.Equals(t, 2, len(f.batches))
+
+	testutil.Equals(t, []float64{0, 1, 2, 3, 4}, readSteps(t, b, 4))
+	testutil.Equals(t, []float64{4}, readSteps(t, a, 2))
+	testutil.Equals(t, 0, len(f.batches))
+}
+
+func TestFanOutDiscardReleasesBatches(t *testing.T) {
+	t.Parallel()
+
+	f := NewFanOut(&stepsOperator{steps: 10}, &query.Options{StepsBatch: 2})
+	a, b := f.NewConsumer(), f.NewConsumer()
+
+	testutil.Equals(t, []float64{0, 1}, readSteps(t, b, 1))
+	testutil.Equals(t, []float64{0, 1, 2, 3}, readSteps(t, a, 2))
+	testutil.Equals(t, 1, len(f.batches))
+
+	Discard(b)
+	testutil.Equals(t, 0, len(f.batches))
+
+	testutil.Equals(t, []float64{4, 5, 6, 7, 8, 9}, readSteps(t, a, 4))
+	testutil.Equals(t, 0, len(f.batches))
+	testutil.Equals(t, 0, len(readSteps(t, b, 1)))
+}
+
+func TestFanOutReadsBufferedBatchesWhilePulling(t *testing.T) {
+	t.Parallel()
+
+	blocked := make(chan struct{})
+	f := NewFanOut(&stepsOperator{steps: 4, first: 2, blocked: blocked}, &query.Options{StepsBatch: 2})
+	a, b := f.NewConsumer(), f.NewConsumer()
+
+	testutil.Equals(t, []float64{0, 1}, readSteps(t, a, 1))
+
+	pulled := make(chan error)
+	buf := make([]model.StepVector, 2)
+	go func() {
+		_, err := a.Next(context.Background(), buf)
+		pulled <- err
+	}()
+
+	// The buffered batch can be read while the other consumer waits for the shared operator.
+	testutil.Equals(t, []float64{0, 1}, readSteps(t, b, 1))
+	close(blocked)
+	testutil.Ok(t, <-pulled)
+	testutil.Equals(t, []float64{2}, buf[0].Samples)
+	testutil.Equals(t, []float64{2, 3}, readSteps(t, b, 1))
+}
@@ -29,8 +29,10 @@ import (
 	"github.com/thanos-io/promql-engine/execution/noop"
 	"github.com/thanos-io/promql-engine/execution/parse"
 	"github.com/thanos-io/promql-engine/execution/remote"
+	"github.com/thanos-io/promql-engine/execution/round"
 	"github.com/thanos-io/promql-engine/execution/scan"
 	"github.com/thanos-io/promql-engine/execution/step_invariant"
+	"github.com/thanos-io/promql-engine/execution/tap"
 	"github.com/thanos-io/promql-engine/execution/unary"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
@@ -50,10 +52,42 @@ func New(ctx context.Context, expr logicalplan.Node, storage storage.Scanners, o
 		End:   opts.End.UnixMilli(),
 		Step:  opts.Step.Milliseconds(),
 	}
-	return newOperator(ctx, expr, storage, opts, hints)
+	if opts.EnableSharedSubexpressions {
+		ctx = withSubexpressions(ctx, expr)
+	}
+	op, err := newOperator(ctx, expr, storage, opts, hints)
+	if err != nil || opts.RoundSignificantDigits <= 0 {
+		return op, err
+	}
+	return round.NewOperator(op, opts.RoundSignificantDigits, opts), nil
 }
 
 func newOperator(ctx context.Context, expr logicalplan.Node, storage storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
+	subexprs, key := sharedSubexpression(ctx, expr, opts, hints)
+	if subexprs != nil {
+		if fanOut, ok := subexprs.fanOuts[key]; ok {
+			return fanOut.NewConsumer(), nil
+		}
+	}
+
+	op, err := newNodeOperator(ctx, expr, storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Recorder != nil {
+		if s := expr.String(); opts.Recorder.ShouldRecord(s) {
+			op = tap.NewOperator(op, s, opts.Recorder, opts)
+		}
+	}
+	if subexprs == nil {
+		return op, nil
+	}
+	fanOut := exchange.NewFanOut(op, opts)
+	subexprs.fanOuts[key] = fanOut
+	return fanOut.NewConsumer(), nil
+}
+
+func newNodeOperator(ctx context.Context, expr logicalplan.Node, storage storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
 	switch e := expr.(type) {
 	case *logicalplan.NumberLiteral:
 		return scan.NewNumberLiteralSelector(opts, e.Val), nil
@@ -94,6 +128,9 @@ func newVectorSelector(ctx context.Context, e *logicalplan.VectorSelector, scann
 }
 
 func newCall(ctx context.Context, e *logicalplan.FunctionCall, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
+	if e.Func.Experimental && !opts.EnableExperimentalFunctions {
+		return nil, errors.Newf("%s() is experimental and must be enabled with EnableExperimentalFunctions", e.Func.Name)
+	}
 	hints.Func = e.Func.Name
 	hints.Grouping = nil
 	hints.By = false
@@ -101,6 +138,11 @@ func newCall(ctx context.Context, e *logicalplan.FunctionCall, scanners storage.
 	if e.Func.Name == "absent_over_time" {
 		return newAbsentOverTimeOperator(ctx, e, scanners, opts, hints)
 	}
+	if opts.AbsentLabelsLookback > 0 {
+		if vs, ok := logicalplan.AbsentLookbackSelector(e); ok {
+			return newAbsentWithLookbackOperator(ctx, e, vs, scanners, opts, hints)
+		}
+	}
 	if e.Func.Name == "timestamp" {
 		switch arg := e.Args[0].(type) {
 		case *logicalplan.VectorSelector:
@@ -174,6 +216,20 @@ func newAbsentOverTimeOperator(ctx context.Context, call *logicalplan.FunctionCa
 	}
 }
 
+// newAbsentWithLookbackOperator creates an absent operator whose argument also selects series from
+// the configured lookback window before the query start. Samples are still only produced for
+// the query range, but the selected series are used to enrich the labels of the absent series.
+func newAbsentWithLookbackOperator(ctx context.Context, call *logicalplan.FunctionCall, vs *logicalplan.VectorSelector, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
+	start, end := getTimeRangesForVectorSelector(vs, opts, 0)
+	hints.Start = start - opts.AbsentLabelsLookback.Milliseconds()
+	hints.End = end
+	next, err := scanners.NewVectorSelector(ctx, opts, hints, *vs)
+	if err != nil {
+		return nil, err
+	}
+	return function.NewFunctionOperator(call, []model.VectorOperator{next}, opts.StepsBatch, opts)
+}
+
 func newRangeVectorFunction(ctx context.Context, e *logicalplan.FunctionCall, t *logicalplan.MatrixSelector, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
 	// TODO(saswatamcode): Range vector result might need new operator
 	// before it can be non-nested. https://github.com/thanos-io/promql-engine/issues/39
@@ -260,6 +316,9 @@ func newInstantVectorFunction(ctx context.Context, e *logicalplan.FunctionCall,
 }
 
 func newAggregateExpression(ctx context.Context, e *logicalplan.Aggregation, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
+	if e.Op.IsExperimentalAggregator() && !opts.EnableExperimentalFunctions {
+		return nil, errors.Newf("%s() is experimental and must be enabled with EnableExperimentalFunctions", e.Op)
+	}
 	hints.Func = e.Op.String()
 	hints.Grouping = e.Grouping
 	hints.By = !e.Without
@@ -310,7 +369,7 @@ func newVectorBinaryOperator(ctx context.Context, e *logicalplan.Binary, storage
 	if err != nil {
 		return nil, err
 	}
-	return binary.NewVectorOperator(leftOperator, rightOperator, e.VectorMatching, e.Op, e.ReturnBool, opts)
+	return binary.NewVectorOperator(leftOperator, rightOperator, e.VectorMatching, e.Op, e.ReturnBool, e.KeepMetricName, opts)
 }
 
 func newScalarBinaryOperator(ctx context.Context, e *logicalplan.Binary, storage storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
@@ -323,7 +382,7 @@ func newScalarBinaryOperator(ctx context.Context, e *logicalplan.Binary, storage
 		return nil, err
 	}
 
-	return binary.NewScalar(lhs, rhs, e.LHS.ReturnType(), e.RHS.ReturnType(), e.Op, e.ReturnBool, opts)
+	return binary.NewScalar(lhs, rhs, e.LHS.ReturnType(), e.RHS.ReturnType(), e.Op, e.ReturnBool, e.KeepMetricName, opts)
 }
 
 func newUnaryExpression(ctx context.Context, e *logicalplan.Unary, scanners storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
@@ -348,7 +407,8 @@ func newStepInvariantExpression(ctx context.Context, e *logicalplan.StepInvarian
 	case *logicalplan.NumberLiteral:
 		return scan.NewNumberLiteralSelector(opts, t.Val), nil
 	}
-	next, err := newOperator(ctx, e.Expr, scanners, opts.WithEndTime(opts.Start), hints)
+	// The wrapped expression has the same string representation, so it is only recorded once by the caller.
+	next, err := newNodeOperator(ctx, e.Expr, scanners, opts.WithEndTime(opts.Start), hints)
 	if err != nil {
 		return nil, err
 	}
@@ -394,7 +454,8 @@ func newRemoteExecution(ctx context.Context, e logicalplan.RemoteExecution, opts
 }
 
 func newDuplicateLabelCheck(ctx context.Context, e *logicalplan.CheckDuplicateLabels, storage storage.Scanners, opts *query.Options, hints promstorage.SelectHints) (model.VectorOperator, error) {
-	op, err := newOperator(ctx, e.Expr, storage, opts, hints)
+	// The wrapped expression has the same string representation, so it is only recorded once by the caller.
+	op, err := newNodeOperator(ctx, e.Expr, storage, opts, hints)
 	if err != nil {
 		return nil, err
 	}
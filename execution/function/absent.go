@@ -20,6 +20,11 @@ type absentOperator struct {
 	funcExpr *logicalplan.FunctionCall
 	series   []labels.Labels
 	next     model.VectorOperator
+
+	// enrichLabels adds labels which are shared by all series selected by next
+	// to the synthesized series. It is only set when next selects series from
+	// the lookback window, see logicalplan.AbsentLookbackSelector.
+	enrichLabels bool
 }
 
 func newAbsentOperator(
@@ -27,11 +32,13 @@ func newAbsentOperator(
 	next model.VectorOperator,
 	opts *query.Options,
 ) model.VectorOperator {
+	_, lookback := logicalplan.AbsentLookbackSelector(funcExpr)
 	oper := &absentOperator{
-		funcExpr: funcExpr,
-		next:     next,
+		funcExpr:     funcExpr,
+		next:         next,
+		enrichLabels: lookback && opts.AbsentLabelsLookback > 0,
 	}
-	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, "absent", opts), oper)
 }
 
 func (o *absentOperator) String() string {
@@ -42,12 +49,15 @@ func (o *absentOperator) Explain() (next []model.VectorOperator) {
 	return []model.VectorOperator{o.next}
 }
 
-func (o *absentOperator) Series(_ context.Context) ([]labels.Labels, error) {
-	o.loadSeries()
+func (o *absentOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	if err := o.loadSeries(ctx); err != nil {
+		return nil, err
+	}
 	return o.series, nil
 }
 
-func (o *absentOperator) loadSeries() {
+func (o *absentOperator) loadSeries(ctx context.Context) error {
+	var err error
 	// we need to put the filtered labels back for absent to compute its series properly
 	o.once.Do(func() {
 		// https://github.com/prometheus/prometheus/blob/df1b4da348a7c2f8c0b294ffa1f05db5f6641278/promql/functions.go#L1857
@@ -76,8 +86,36 @@ func (o *absentOperator) loadSeries() {
 				b.Del(l.Name)
 			}
 		}
+		if o.enrichLabels {
+			var observed []labels.Labels
+			observed, err = o.next.Series(ctx)
+			if err != nil {
+				return
+			}
+			setCommonLabels(b, observed, has)
+		}
 		o.series = []labels.Labels{b.Labels()}
 	})
+	return err
+}
+
+// setCommonLabels sets labels which have the same value in all series, except for
+// the metric name and labels in skip.
+func setCommonLabels(b *labels.Builder, series []labels.Labels, skip map[string]bool) {
+	if len(series) == 0 {
+		return
+	}
+	series[0].Range(func(l labels.Label) {
+		if l.Name == labels.MetricName || skip[l.Name] {
+			return
+		}
+		for _, s := range series[1:] {
+			if s.Get(l.Name) != l.Value {
+				return
+			}
+		}
+		b.Set(l.Name, l.Value)
+	})
 }
 
 func (o *absentOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
@@ -87,7 +125,9 @@ func (o *absentOperator) Next(ctx context.Context, buf []model.StepVector) (int,
 	default:
 	}
 
-	o.loadSeries()
+	if err := o.loadSeries(ctx); err != nil {
+		return 0, err
+	}
 
 	n, err := o.next.Next(ctx, buf)
 	if err != nil {
@@ -123,9 +123,12 @@ var instantVectorFuncs = map[string]functionCall{
 		return math.Min(max, v), true
 	},
 	"histogram_sum": func(f float64, h *histogram.FloatHistogram, vargs ...float64) (float64, bool) {
-		if h == nil {
+		if h == nil || len(vargs) > 1 {
 			return 0., false
 		}
+		if len(vargs) > 0 {
+			return h.Sum * vargs[0], true
+		}
 		return h.Sum, true
 	},
 	"histogram_count": func(f float64, h *histogram.FloatHistogram, vargs ...float64) (float64, bool) {
@@ -178,6 +181,48 @@ var instantVectorFuncs = map[string]functionCall{
 	}),
 }
 
+// histogramStatFuncs are histogram functions which need to iterate over all buckets.
+// Their results are memoized per series by the function operator.
+var histogramStatFuncs = map[string]func(*histogram.FloatHistogram) float64{
+	"histogram_stddev": histogramStdDev,
+	"histogram_stdvar": histogramStdVar,
+}
+
+// trigonometricFuncs only operate on floats. Histograms passed to them are dropped
+// and reported with an annotation.
+var trigonometricFuncs = map[string]struct{}{
+	"sin":   {},
+	"cos":   {},
+	"tan":   {},
+	"asin":  {},
+	"acos":  {},
+	"atan":  {},
+	"sinh":  {},
+	"cosh":  {},
+	"tanh":  {},
+	"asinh": {},
+	"acosh": {},
+	"atanh": {},
+	"rad":   {},
+	"deg":   {},
+}
+
+// nanSumFuncs derive their result from the sum of a histogram, so a NaN sum makes the result NaN.
+// Such histograms are reported with an annotation to help finding the series they come from.
+var nanSumFuncs = map[string]struct{}{
+	"histogram_avg":    {},
+	"histogram_stddev": {},
+	"histogram_stdvar": {},
+}
+
+// clampFuncs are not defined for histograms. Histograms passed to them are dropped
+// and reported with an annotation, clamping histogram_count or histogram_sum works instead.
+var clampFuncs = map[string]struct{}{
+	"clamp":     {},
+	"clamp_min": {},
+	"clamp_max": {},
+}
+
 type noArgFunctionCall func(t int64) float64
 
 var noArgFuncs = map[string]noArgFunctionCall{
@@ -43,6 +43,8 @@ type histogramOperator struct {
 	scalar1Op  model.VectorOperator
 	scalar2Op  model.VectorOperator
 
+	delayedNameRemoval bool
+
 	// scalarPoints is a reusable buffer for points from the first argument of histogram_quantile.
 	scalar1Points []float64
 	scalar2Points []float64
@@ -54,6 +56,9 @@ type histogramOperator struct {
 
 	// needed to compile warnings on mixed histograms
 	inputSeriesNames []string
+	// outputSeriesNames are the metric names of the first input series mapped to each output series.
+	// They are only kept when delayed name removal is enabled.
+	outputSeriesNames []string
 
 	// seriesBuckets are the buckets for each individual conventional histogram series.
 	seriesBuckets []promql.Buckets
@@ -76,6 +81,8 @@ func newHistogramOperator(
 		funcName:   call.Func.Name,
 		funcArgs:   call.Args,
 		stepsBatch: stepsBatch,
+
+		delayedNameRemoval: opts.EnableDelayedNameRemoval,
 	}
 
 	switch o.funcName {
@@ -92,7 +99,7 @@ func newHistogramOperator(
 	default:
 		panic("unsupported function passed")
 	}
-	return telemetry.NewOperator(telemetry.NewTelemetry(o, opts), o)
+	return telemetry.NewOperator(telemetry.NewTelemetry(o, o.funcName, opts), o)
 }
 
 func (o *histogramOperator) String() string {
@@ -256,6 +263,7 @@ func (o *histogramOperator) processInputSeries(ctx context.Context, vectors []mo
 				case "histogram_fraction":
 					v, annos = promql.HistogramFraction(o.scalar1Points[stepIndex], o.scalar2Points[stepIndex], vector.Histograms[i], o.inputSeriesNames[seriesID], posrange.PositionRange{})
 					buf[n].AppendSample(uint64(outputSeriesID), v)
+					o.warnInvertedBounds(ctx, stepIndex)
 				}
 				warnings.MergeToContext(annos, ctx)
 			} else {
@@ -283,13 +291,20 @@ func (o *histogramOperator) processInputSeries(ctx context.Context, vectors []mo
 				}
 				v, forcedMonotonicity, _ := promql.BucketQuantile(o.scalar1Points[stepIndex], stepBuckets)
 				buf[n].AppendSample(uint64(i), v)
+				// Only classic histograms can be non-monotonic, native histograms are handled above.
+				// Like Prometheus, the metric name is only added when delayed name removal is enabled.
 				if forcedMonotonicity {
-					warnings.AddToContext(annotations.NewHistogramQuantileForcedMonotonicityInfo(o.inputSeriesNames[i], posrange.PositionRange{}), ctx)
+					var metricName string
+					if o.outputSeriesNames != nil {
+						metricName = o.outputSeriesNames[i]
+					}
+					warnings.AddToContext(annotations.NewHistogramQuantileForcedMonotonicityInfo(metricName, posrange.PositionRange{}), ctx)
 				}
 			case "histogram_fraction":
 				// BucketFraction handles single bucket and other edge cases properly.
 				v := promql.BucketFraction(o.scalar1Points[stepIndex], o.scalar2Points[stepIndex], stepBuckets)
 				buf[n].AppendSample(uint64(i), v)
+				o.warnInvertedBounds(ctx, stepIndex)
 			}
 		}
 		n++
@@ -298,6 +313,17 @@ func (o *histogramOperator) processInputSeries(ctx context.Context, vectors []mo
 	return n, nil
 }
 
+// warnInvertedBounds adds an annotation if the bounds of histogram_fraction are inverted in the given step.
+// It is only called for steps with histograms, since there is no fraction to compute otherwise.
+func (o *histogramOperator) warnInvertedBounds(ctx context.Context, stepIndex int) {
+	if stepIndex >= len(o.scalar2Points) {
+		return
+	}
+	if lower, upper := o.scalar1Points[stepIndex], o.scalar2Points[stepIndex]; lower > upper {
+		warnings.AddToContext(warnings.NewHistogramFractionInvertedBoundsInfo(lower, upper), ctx)
+	}
+}
+
 func (o *histogramOperator) loadSeries(ctx context.Context) error {
 
 	o.vectorBuf = make([]model.StepVector, o.stepsBatch)
@@ -319,6 +345,9 @@ func (o *histogramOperator) loadSeries(ctx context.Context) error {
 
 	o.series = make([]labels.Labels, 0)
 	o.inputSeriesNames = make([]string, len(series))
+	if o.delayedNameRemoval {
+		o.outputSeriesNames = make([]string, 0)
+	}
 	o.outputIndex = make([]*histogramSeries, len(series))
 	b := labels.ScratchBuilder{}
 	for i, s := range series {
@@ -344,6 +373,9 @@ func (o *histogramOperator) loadSeries(ctx context.Context) error {
 		seriesID, ok := seriesHashes[seriesHash]
 		if !ok {
 			o.series = append(o.series, lbls)
+			if o.outputSeriesNames != nil {
+				o.outputSeriesNames = append(o.outputSeriesNames, s.Get(labels.MetricName))
+			}
 			seriesID = len(o.series) - 1
 			seriesHashes[seriesHash] = seriesID
 		}
@@ -15,8 +15,10 @@ import (
 	"github.com/thanos-io/promql-engine/extlabels"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/warnings"
 
 	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 )
@@ -75,7 +77,7 @@ func newNoArgsFunctionOperator(funcExpr *logicalplan.FunctionCall, stepsBatch in
 		op.sampleIDs = []uint64{0}
 	}
 
-	return telemetry.NewOperator(telemetry.NewTelemetry(op, opts), op), nil
+	return telemetry.NewOperator(telemetry.NewTelemetry(op, "function", opts), op), nil
 }
 
 // functionOperator returns []model.StepVector after processing input with desired function.
@@ -91,6 +93,15 @@ type functionOperator struct {
 	call         functionCall
 	scalarPoints [][]float64
 	scalarBuf    []model.StepVector
+
+	// histogramStats memoizes functions which need a full pass over all histogram buckets.
+	histogramStats *histogramStatCache
+	// warnOnHistograms emits an annotation for every histogram dropped by the function.
+	warnOnHistograms bool
+	// warnOnNaNSum emits an annotation for every histogram with a NaN sum.
+	warnOnNaNSum bool
+	// metricNames are the metric names of the input series, only set when warnOnNaNSum is.
+	metricNames []string
 }
 
 func newInstantVectorFunctionOperator(funcExpr *logicalplan.FunctionCall, nextOps []model.VectorOperator, stepsBatch int, opts *query.Options) (model.VectorOperator, error) {
@@ -111,6 +122,13 @@ func newInstantVectorFunctionOperator(funcExpr *logicalplan.FunctionCall, nextOp
 		stepsBatch:   stepsBatch,
 		scalarPoints: scalarPoints,
 	}
+	if stat, ok := histogramStatFuncs[funcExpr.Func.Name]; ok {
+		f.histogramStats = newHistogramStatCache(stat)
+	}
+	_, trigonometric := trigonometricFuncs[funcExpr.Func.Name]
+	_, clamp := clampFuncs[funcExpr.Func.Name]
+	f.warnOnHistograms = trigonometric || clamp
+	_, f.warnOnNaNSum = nanSumFuncs[funcExpr.Func.Name]
 
 	for i := range funcExpr.Args {
 		if funcExpr.Args[i].ReturnType() == parser.ValueTypeVector {
@@ -122,7 +140,7 @@ func newInstantVectorFunctionOperator(funcExpr *logicalplan.FunctionCall, nextOp
 	// Check selector type.
 	switch funcExpr.Args[f.vectorIndex].ReturnType() {
 	case parser.ValueTypeVector, parser.ValueTypeScalar:
-		return telemetry.NewOperator(telemetry.NewTelemetry(f, opts), f), nil
+		return telemetry.NewOperator(telemetry.NewTelemetry(f, "function", opts), f), nil
 	default:
 		return nil, errors.Wrapf(parse.ErrNotImplemented, "got %s:", funcExpr.String())
 	}
@@ -187,28 +205,42 @@ func (o *functionOperator) Next(ctx context.Context, buf []model.StepVector) (in
 
 	for batchIndex := range n {
 		vector := &buf[batchIndex]
-		i := 0
-		for i < len(vector.Samples) {
+		// This operator modifies samples directly in the input vector to avoid allocations.
+		// Invalid output samples are dropped by compacting the valid ones to the front of the vector.
+		j := 0
+		for i := range vector.Samples {
 			if v, ok := o.call(vector.Samples[i], nil, o.scalarPoints[batchIndex]...); ok {
-				vector.Samples[i] = v
-				i++
-			} else {
-				// This operator modifies samples directly in the input vector to avoid allocations.
-				// In case of an invalid output sample, we need to do an in-place removal of the input sample.
-				vector.RemoveSample(i)
+				vector.SampleIDs[j] = vector.SampleIDs[i]
+				vector.Samples[j] = v
+				j++
 			}
 		}
+		vector.SampleIDs = vector.SampleIDs[:j]
+		vector.Samples = vector.Samples[:j]
 
-		i = 0
+		i := 0
 		for i < len(vector.Histograms) {
-			v, ok := o.call(0., vector.Histograms[i], o.scalarPoints[batchIndex]...)
+			sampleID := vector.HistogramIDs[i]
+			var (
+				v  float64
+				ok bool
+			)
+			if o.warnOnNaNSum && math.IsNaN(vector.Histograms[i].Sum) {
+				warnings.AddToContext(warnings.NewHistogramNaNSumInfo(o.funcExpr.Func.Name, o.metricNames[sampleID]), ctx)
+			}
+			if o.histogramStats != nil {
+				v, ok = o.histogramStats.get(sampleID, vector.Histograms[i]), true
+			} else {
+				v, ok = o.call(0., vector.Histograms[i], o.scalarPoints[batchIndex]...)
+			}
 			// This operator modifies samples directly in the input vector to avoid allocations.
 			// All current functions for histograms produce a float64 sample. It's therefore safe to
 			// always remove the input histogram so that it does not propagate to the output.
-			sampleID := vector.HistogramIDs[i]
 			vector.RemoveHistogram(i)
 			if ok {
 				vector.AppendSample(sampleID, v)
+			} else if o.warnOnHistograms {
+				warnings.AddToContext(warnings.NewHistogramIgnoredInFunctionInfo(o.funcExpr.Func.Name), ctx)
 			}
 		}
 	}
@@ -233,9 +265,19 @@ func (o *functionOperator) loadSeries(ctx context.Context) error {
 			return
 		}
 		o.series = make([]labels.Labels, len(series))
+		if o.histogramStats != nil {
+			o.histogramStats.entries = make([]histogramStatEntry, len(series))
+		}
+
+		if o.warnOnNaNSum {
+			o.metricNames = make([]string, len(series))
+		}
 
 		var b labels.ScratchBuilder
 		for i, s := range series {
+			if o.warnOnNaNSum {
+				o.metricNames[i] = s.Get(labels.MetricName)
+			}
 			lbls := extlabels.DropReserved(s, b)
 			o.series[i] = lbls
 		}
@@ -243,3 +285,35 @@ func (o *functionOperator) loadSeries(ctx context.Context) error {
 
 	return err
 }
+
+// histogramStatCache remembers the last computed statistic for each series.
+// Step-invariant inputs hand out the same histogram for every step, so the result
+// can be reused as long as the histogram has not changed since it was last seen.
+type histogramStatCache struct {
+	stat    func(*histogram.FloatHistogram) float64
+	entries []histogramStatEntry
+}
+
+// histogramStatEntry identifies a histogram by its pointer. Count and Sum are
+// compared as well to detect histograms which were modified in place.
+type histogramStatEntry struct {
+	h          *histogram.FloatHistogram
+	count, sum float64
+	val        float64
+}
+
+func newHistogramStatCache(stat func(*histogram.FloatHistogram) float64) *histogramStatCache {
+	return &histogramStatCache{stat: stat}
+}
+
+func (c *histogramStatCache) get(seriesID uint64, h *histogram.FloatHistogram) float64 {
+	if seriesID >= uint64(len(c.entries)) {
+		return c.stat(h)
+	}
+	e := &c.entries[seriesID]
+	if e.h == h && e.count == h.Count && e.sum == h.Sum {
+		return e.val
+	}
+	*e = histogramStatEntry{h: h, count: h.Count, sum: h.Sum, val: c.stat(h)}
+	return e.val
+}
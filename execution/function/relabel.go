@@ -6,6 +6,7 @@ package function
 import (
 	"context"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
 
@@ -24,6 +25,9 @@ type relabelOperator struct {
 	funcExpr *logicalplan.FunctionCall
 	once     sync.Once
 	series   []labels.Labels
+	// outputIDs maps input series IDs to the IDs of the sorted output series.
+	// It is nil when relabeling did not change the order of the series.
+	outputIDs []uint64
 }
 
 func newRelabelOperator(
@@ -35,7 +39,7 @@ func newRelabelOperator(
 		next:     next,
 		funcExpr: funcExpr,
 	}
-	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, "relabel", opts), oper)
 }
 
 func (o *relabelOperator) String() string {
@@ -53,7 +57,19 @@ func (o *relabelOperator) Series(ctx context.Context) ([]labels.Labels, error) {
 }
 
 func (o *relabelOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
-	return o.next.Next(ctx, buf)
+	n, err := o.next.Next(ctx, buf)
+	if err != nil || o.outputIDs == nil {
+		return n, err
+	}
+	for i := range n {
+		for j, id := range buf[i].SampleIDs {
+			buf[i].SampleIDs[j] = o.outputIDs[id]
+		}
+		for j, id := range buf[i].HistogramIDs {
+			buf[i].HistogramIDs[j] = o.outputIDs[id]
+		}
+	}
+	return n, nil
 }
 
 func (o *relabelOperator) loadSeries(ctx context.Context) (err error) {
@@ -71,7 +87,40 @@ func (o *relabelOperator) loadSeries(ctx context.Context) (err error) {
 	default:
 		err = errors.Newf("invalid function name for relabel operator: %s", o.funcExpr.Func.Name)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	o.sortSeries()
+	return nil
+}
+
+// sortSeries sorts the relabeled series, like Prometheus does, since relabeling
+// can change the position of a series in the sort order.
+func (o *relabelOperator) sortSeries() {
+	order := make([]int, len(o.series))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return labels.Compare(o.series[a], o.series[b]) })
+
+	var reordered bool
+	for i, id := range order {
+		if i != id {
+			reordered = true
+			break
+		}
+	}
+	if !reordered {
+		return
+	}
+
+	sorted := make([]labels.Labels, len(o.series))
+	o.outputIDs = make([]uint64, len(o.series))
+	for i, id := range order {
+		sorted[i] = o.series[id]
+		o.outputIDs[id] = uint64(i)
+	}
+	o.series = sorted
 }
 
 func (o *relabelOperator) loadSeriesForLabelJoin(series []labels.Labels) error {
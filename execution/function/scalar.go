@@ -10,6 +10,7 @@ import (
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/execution/telemetry"
 	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/warnings"
 
 	"github.com/prometheus/prometheus/model/labels"
 )
@@ -23,7 +24,7 @@ func newScalarOperator(next model.VectorOperator, opts *query.Options) model.Vec
 		next: next,
 	}
 
-	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, "scalar", opts), oper)
 }
 
 func (o *scalarOperator) String() string {
@@ -57,6 +58,10 @@ func (o *scalarOperator) Next(ctx context.Context, buf []model.StepVector) (int,
 			val = vector.Samples[0]
 		} else {
 			val = math.NaN()
+			// Histograms cannot be converted to a scalar, let users know why they got NaN.
+			if len(vector.Samples) == 0 && len(vector.Histograms) > 0 {
+				warnings.AddToContext(warnings.NewHistogramIgnoredInFunctionInfo("scalar"), ctx)
+			}
 		}
 		vector.Reset(vector.T)
 		vector.AppendSample(0, val)
@@ -26,7 +26,7 @@ func newTimestampOperator(next model.VectorOperator, opts *query.Options) model.
 	oper := &timestampOperator{
 		next: next,
 	}
-	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, "timestamp", opts), oper)
 }
 
 func (o *timestampOperator) Explain() (next []model.VectorOperator) {
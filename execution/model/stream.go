@@ -0,0 +1,76 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model
+
+import (
+	"context"
+	"sync"
+)
+
+// streamBuffers is the number of buffers used by StreamOperator. It allows the operator
+// to produce the next batch while the consumer processes the current one.
+const streamBuffers = 2
+
+// StepVectorBatchOrError is a batch of step vectors produced by an operator, or the error
+// which stopped it.
+type StepVectorBatchOrError struct {
+	Vectors []StepVector
+	Err     error
+
+	release func()
+}
+
+// Release hands the buffer of the batch back to the stream so that it can be reused for the
+// next batch. The vectors must not be used afterwards. Calling Release more than once has no effect.
+func (b StepVectorBatchOrError) Release() {
+	if b.release != nil {
+		b.release()
+	}
+}
+
+// StreamOperator drives the operator to completion and sends its batches on the returned channel.
+// The channel is closed after the last batch, after an error or when the context is cancelled.
+// The operator is blocked until the consumer releases a batch when all buffers are in use.
+func StreamOperator(ctx context.Context, op VectorOperator, stepsBatch int) <-chan StepVectorBatchOrError {
+	out := make(chan StepVectorBatchOrError)
+	free := make(chan []StepVector, streamBuffers)
+	for range streamBuffers {
+		free <- make([]StepVector, stepsBatch)
+	}
+
+	go func() {
+		defer close(out)
+		for {
+			var buf []StepVector
+			select {
+			case <-ctx.Done():
+				return
+			case buf = <-free:
+			}
+
+			n, err := op.Next(ctx, buf)
+			if err != nil {
+				select {
+				case <-ctx.Done():
+				case out <- StepVectorBatchOrError{Err: err}:
+				}
+				return
+			}
+			if n == 0 {
+				return
+			}
+
+			batch := StepVectorBatchOrError{
+				Vectors: buf[:n],
+				release: sync.OnceFunc(func() { free <- buf }),
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case out <- batch:
+			}
+		}
+	}()
+	return out
+}
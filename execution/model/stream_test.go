@@ -0,0 +1,89 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model
+
+import (
+	"context"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// stepsOperator returns two samples with the value 7 for each step until maxt.
+type stepsOperator struct {
+	maxt        int64
+	step        int64
+	currentStep int64
+}
+
+func (o *stepsOperator) Next(_ context.Context, buf []StepVector) (int, error) {
+	n := 0
+	for ; n < len(buf) && o.currentStep <= o.maxt; n++ {
+		buf[n].Reset(o.currentStep)
+		buf[n].AppendSample(0, 7)
+		buf[n].AppendSample(1, 7)
+		o.currentStep += o.step
+	}
+	return n, nil
+}
+
+func (o *stepsOperator) Series(context.Context) ([]labels.Labels, error) {
+	return []labels.Labels{labels.FromStrings("container", "a"), labels.FromStrings("container", "b")}, nil
+}
+
+func (o *stepsOperator) Explain() []VectorOperator { return nil }
+
+func (o *stepsOperator) String() string { return "[steps]" }
+
+func TestStreamOperator(t *testing.T) {
+	t.Parallel()
+
+	newOperator := func() *stepsOperator {
+		return &stepsOperator{maxt: 270_000, step: 30_000}
+	}
+
+	t.Run("consumes all batches", func(t *testing.T) {
+		var (
+			timestamps []int64
+			buffers    = make(map[*StepVector]struct{})
+		)
+		for batch := range StreamOperator(context.Background(), newOperator(), 2) {
+			testutil.Ok(t, batch.Err)
+			buffers[&batch.Vectors[0]] = struct{}{}
+			for _, v := range batch.Vectors {
+				timestamps = append(timestamps, v.T)
+				testutil.Equals(t, []float64{7, 7}, v.Samples)
+			}
+			batch.Release()
+		}
+		testutil.Equals(t, []int64{0, 30_000, 60_000, 90_000, 120_000, 150_000, 180_000, 210_000, 240_000, 270_000}, timestamps)
+		testutil.Assert(t, len(buffers) <= 2, "expected released buffers to be reused, got %d buffers", len(buffers))
+	})
+
+	t.Run("stops on cancellation", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream := StreamOperator(ctx, newOperator(), 2)
+
+		batch := <-stream
+		testutil.Ok(t, batch.Err)
+		batch.Release()
+		cancel()
+		for batch := range stream {
+			batch.Release()
+		}
+	})
+
+	t.Run("releases batches once", func(t *testing.T) {
+		var batches int
+		for batch := range StreamOperator(context.Background(), newOperator(), 2) {
+			testutil.Ok(t, batch.Err)
+			batches++
+			// Without releasing idempotently, the second call blocks once all buffers were released.
+			batch.Release()
+			batch.Release()
+		}
+		testutil.Equals(t, 5, batches)
+	})
+}
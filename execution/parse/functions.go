@@ -28,6 +28,17 @@ var XFunctions = map[string]*parser.Function{
 	},
 }
 
+// ExtendedFunctions overrides the definitions of upstream functions which accept
+// additional arguments in this engine.
+var ExtendedFunctions = map[string]*parser.Function{
+	"histogram_sum": {
+		Name:       "histogram_sum",
+		ArgTypes:   []parser.ValueType{parser.ValueTypeVector, parser.ValueTypeScalar},
+		Variadic:   1,
+		ReturnType: parser.ValueTypeVector,
+	},
+}
+
 // IsExtFunction is a convenience function to determine whether extended range calculations are required.
 func IsExtFunction(functionName string) bool {
 	_, ok := XFunctions[functionName]
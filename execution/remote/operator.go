@@ -43,7 +43,7 @@ func NewExecution(query promql.Query, queryRangeStart, queryRangeEnd time.Time,
 		vectorSelector:  promstorage.NewVectorSelector(storage, opts, 0, 0, false, 0, 1),
 	}
 
-	return telemetry.NewOperator(telemetry.NewTelemetry(oper, opts), oper)
+	return telemetry.NewOperator(telemetry.NewTelemetry(oper, "remoteExec", opts), oper)
 }
 
 func (e *Execution) Series(ctx context.Context) ([]labels.Labels, error) {
@@ -0,0 +1,72 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package round
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// roundOperator rounds the float samples of its child to a fixed number of significant digits.
+// This masks floating point differences when comparing results of different engines.
+// Histograms are passed through unchanged.
+type roundOperator struct {
+	next   model.VectorOperator
+	digits int
+}
+
+func NewOperator(next model.VectorOperator, digits int, opts *query.Options) model.VectorOperator {
+	op := &roundOperator{
+		next:   next,
+		digits: digits,
+	}
+	return telemetry.NewOperator(telemetry.NewTelemetry(op, "round", opts), op)
+}
+
+func (o *roundOperator) String() string {
+	return fmt.Sprintf("[round] %d significant digits", o.digits)
+}
+
+func (o *roundOperator) Explain() (next []model.VectorOperator) {
+	return []model.VectorOperator{o.next}
+}
+
+func (o *roundOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	return o.next.Series(ctx)
+}
+
+func (o *roundOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	n, err := o.next.Next(ctx, buf)
+	if err != nil {
+		return 0, err
+	}
+	for i := range n {
+		for j, v := range buf[i].Samples {
+			buf[i].Samples[j] = roundSignificant(v, o.digits)
+		}
+	}
+	return n, nil
+}
+
+// roundSignificant rounds v to the given number of significant digits. The value is rounded through
+// its decimal representation so that the result does not depend on the precision of intermediate
+// floating point operations.
+func roundSignificant(v float64, digits int) float64 {
+	if v == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	r, err := strconv.ParseFloat(strconv.FormatFloat(v, 'g', digits, 64), 64)
+	if err != nil {
+		return v
+	}
+	return r
+}
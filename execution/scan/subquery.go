@@ -36,8 +36,9 @@ type subqueryOperator struct {
 	step        int64
 	stepsBatch  int
 
-	onceSeries sync.Once
-	series     []labels.Labels
+	onceSeries  sync.Once
+	series      []labels.Labels
+	metricNames []string
 
 	lastVectors   []model.StepVector
 	lastCollected int
@@ -81,7 +82,7 @@ func NewSubqueryOperator(next, paramOp, paramOp2 model.VectorOperator, opts *que
 		params:        make([]float64, opts.StepsBatch),
 		params2:       make([]float64, opts.StepsBatch),
 	}
-	o.telemetry = telemetry.NewSubqueryTelemetry(o, opts)
+	o.telemetry = telemetry.NewSubqueryTelemetry(o, "subquery", opts)
 	return telemetry.NewOperator(o.telemetry, o), nil
 }
 
@@ -90,14 +91,14 @@ func (o *subqueryOperator) String() string {
 }
 
 func (o *subqueryOperator) Explain() (next []model.VectorOperator) {
-	switch o.funcExpr.Func.Name {
-	case "quantile_over_time", "predict_linear":
-		return []model.VectorOperator{o.paramOp, o.next}
-	case "double_exponential_smoothing":
-		return []model.VectorOperator{o.paramOp, o.paramOp2, o.next}
-	default:
-		return []model.VectorOperator{o.next}
+	// Scalar parameters are pulled alongside the subquery, so they are part of the tree.
+	if o.paramOp != nil {
+		next = append(next, o.paramOp)
 	}
+	if o.paramOp2 != nil {
+		next = append(next, o.paramOp2)
+	}
+	return append(next, o.next)
 }
 
 func (o *subqueryOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
@@ -189,11 +190,13 @@ func (o *subqueryOperator) Next(ctx context.Context, buf []model.StepVector) (in
 		buf[n].Reset(o.currentStep)
 		hint := len(o.buffers)
 		for sampleId, rangeSamples := range o.buffers {
-			f, h, ok, _, err := rangeSamples.Eval(ctx, o.params[i], o.params2[i], math.MinInt64)
+			f, h, ok, warn, err := rangeSamples.Eval(ctx, o.params[i], o.params2[i], math.MinInt64)
 			if err != nil {
 				return 0, err
 			}
-			// Note: warnings from subqueries are currently ignored since we don't have metric names here
+			if warn != 0 {
+				ringbuffer.EmitWarnings(ctx, warn, o.metricNames[sampleId])
+			}
 			if ok {
 				if h != nil {
 					buf[n].AppendHistogramWithSizeHint(uint64(sampleId), h, hint)
@@ -275,12 +278,14 @@ func (o *subqueryOperator) initSeries(ctx context.Context) error {
 		}
 
 		o.series = make([]labels.Labels, len(series))
+		o.metricNames = make([]string, len(series))
 		o.buffers = make([]*ringbuffer.GenericRingBuffer, len(series))
 		for i := range o.buffers {
 			o.buffers[i] = ringbuffer.New(ctx, 8, o.subQuery.Range.Milliseconds(), o.subQuery.Offset.Milliseconds(), o.call)
 		}
 		var b labels.ScratchBuilder
 		for i, s := range series {
+			o.metricNames[i] = s.Get(labels.MetricName)
 			lbls := s
 			if o.funcExpr.Func.Name != "last_over_time" {
 				lbls = extlabels.DropReserved(s, b)
@@ -0,0 +1,114 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package execution
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/thanos-io/promql-engine/execution/exchange"
+	"github.com/thanos-io/promql-engine/logicalplan"
+	"github.com/thanos-io/promql-engine/query"
+
+	promstorage "github.com/prometheus/prometheus/storage"
+)
+
+type subexpressionsKey struct{}
+
+// subexpressions keeps track of subtrees which occur more than once in a plan, like rate(x[5m])
+// in rate(x[5m]) / sum(rate(x[5m])). The operator for such a subtree is only created once
+// and its output is shared between all occurrences through a fan-out.
+type subexpressions struct {
+	counts  map[string]int
+	fanOuts map[string]*exchange.FanOut
+}
+
+func withSubexpressions(ctx context.Context, root logicalplan.Node) context.Context {
+	counts := make(map[string]int)
+	countSubexpressions(root, counts)
+	return context.WithValue(ctx, subexpressionsKey{}, &subexpressions{
+		counts:  counts,
+		fanOuts: make(map[string]*exchange.FanOut),
+	})
+}
+
+// countSubexpressions counts the occurrences of each subtree in the plan.
+// Repeated subtrees are not descended into since their operators are only created once.
+func countSubexpressions(node logicalplan.Node, counts map[string]int) {
+	if key, ok := planKey(node); ok {
+		counts[key]++
+		if counts[key] > 1 {
+			return
+		}
+	}
+	for _, c := range node.Children() {
+		countSubexpressions(*c, counts)
+	}
+}
+
+// sharedSubexpression returns the tracked subexpressions and the key under which the operator
+// for the given node is shared. The returned subexpressions are nil if the node is not shared.
+func sharedSubexpression(ctx context.Context, node logicalplan.Node, opts *query.Options, hints promstorage.SelectHints) (*subexpressions, string) {
+	subexprs, ok := ctx.Value(subexpressionsKey{}).(*subexpressions)
+	if !ok {
+		return nil, ""
+	}
+	key, ok := planKey(node)
+	if !ok || subexprs.counts[key] < 2 {
+		return nil, ""
+	}
+
+	// The same subtree can be evaluated over different ranges, for example inside of a subquery.
+	key = fmt.Sprintf("%s|%d|%d|%d|%d", key, opts.Start.UnixMilli(), opts.End.UnixMilli(), opts.Step, opts.LookbackDelta)
+	if usesHints(node) {
+		key = fmt.Sprintf("%s|%+v", key, hints)
+	}
+	return subexprs, key
+}
+
+// usesHints returns whether the hints passed to the operator of the given node reach a selector.
+// Functions and aggregations set their own hints for the selectors below them.
+func usesHints(node logicalplan.Node) bool {
+	switch node.(type) {
+	case *logicalplan.FunctionCall, *logicalplan.Aggregation:
+		return false
+	case *logicalplan.VectorSelector:
+		return true
+	}
+	for _, c := range node.Children() {
+		if usesHints(*c) {
+			return true
+		}
+	}
+	return false
+}
+
+// planKey returns a key identifying the subtree of the given node,
+// or false if the operator for the subtree cannot be shared.
+func planKey(node logicalplan.Node) (string, bool) {
+	switch node.(type) {
+	case *logicalplan.NumberLiteral, *logicalplan.StringLiteral, *logicalplan.MatrixSelector:
+		return "", false
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s:%s", node.Type(), node)
+	shareable := true
+	logicalplan.Traverse(&node, func(n *logicalplan.Node) {
+		switch t := (*n).(type) {
+		case *logicalplan.VectorSelector:
+			// Fields set by optimizers are not part of the string representation of selectors.
+			fmt.Fprintf(&b, "|%v %v %d %t %t", t.Filters, t.Projection, t.BatchSize, t.SelectTimestamp, t.DecodeNativeHistogramStats)
+		case *logicalplan.Binary:
+			// Keeping the metric name is not part of the string representation of binary operations either.
+			fmt.Fprintf(&b, "|%t", t.KeepMetricName)
+		case logicalplan.RemoteExecution, logicalplan.Deduplicate, logicalplan.UserDefinedExpr:
+			// Remote executions of the same query can be sent to different engines,
+			// and user defined expressions are not necessarily identified by their string representation.
+			shareable = false
+		}
+	})
+	return b.String(), shareable
+}
@@ -0,0 +1,64 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package tap
+
+import (
+	"sync"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Recording holds the series and step vectors captured for a single expression.
+type Recording struct {
+	Series  []labels.Labels
+	Vectors []model.StepVector
+}
+
+// Buffer is a query.Recorder which keeps recordings of the given expressions in memory.
+type Buffer struct {
+	mu         sync.Mutex
+	recordings map[string]*Recording
+}
+
+// NewBuffer creates a Buffer recording the output of the given expressions.
+// Expressions need to match the string representation of the logical plan node, for example "rate(foo[5m])".
+func NewBuffer(exprs ...string) *Buffer {
+	b := &Buffer{recordings: make(map[string]*Recording, len(exprs))}
+	for _, expr := range exprs {
+		b.recordings[expr] = &Recording{}
+	}
+	return b
+}
+
+func (b *Buffer) ShouldRecord(expr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.recordings[expr]
+	return ok
+}
+
+func (b *Buffer) RecordSeries(expr string, series []labels.Labels) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recordings[expr].Series = series
+}
+
+func (b *Buffer) RecordVectors(expr string, vectors []model.StepVector) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := b.recordings[expr]
+	r.Vectors = append(r.Vectors, vectors...)
+}
+
+// Recording returns what was recorded for the given expression.
+func (b *Buffer) Recording(expr string) Recording {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r, ok := b.recordings[expr]; ok {
+		return *r
+	}
+	return Recording{}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package tap
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/telemetry"
+	"github.com/thanos-io/promql-engine/query"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// tapOperator passes through the output of its child and records a copy of it
+// in a query.Recorder without altering the data.
+type tapOperator struct {
+	next     model.VectorOperator
+	expr     string
+	recorder query.Recorder
+
+	once   sync.Once
+	series []labels.Labels
+}
+
+func NewOperator(next model.VectorOperator, expr string, recorder query.Recorder, opts *query.Options) model.VectorOperator {
+	op := &tapOperator{
+		next:     next,
+		expr:     expr,
+		recorder: recorder,
+	}
+	return telemetry.NewOperator(telemetry.NewTelemetry(op, "tap", opts), op)
+}
+
+func (o *tapOperator) String() string {
+	return fmt.Sprintf("[tap] %s", o.expr)
+}
+
+func (o *tapOperator) Explain() (next []model.VectorOperator) {
+	return []model.VectorOperator{o.next}
+}
+
+func (o *tapOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() {
+		o.series, err = o.next.Series(ctx)
+		if err == nil {
+			o.recorder.RecordSeries(o.expr, o.series)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o.series, nil
+}
+
+func (o *tapOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	n, err := o.next.Next(ctx, buf)
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	// The buffer is owned by the caller and will be reused, so we record a deep copy.
+	recorded := make([]model.StepVector, n)
+	for i := range n {
+		recorded[i] = copyVector(buf[i])
+	}
+	o.recorder.RecordVectors(o.expr, recorded)
+	return n, nil
+}
+
+func copyVector(v model.StepVector) model.StepVector {
+	out := model.StepVector{T: v.T}
+	out.AppendSamples(v.SampleIDs, v.Samples)
+	if len(v.Histograms) > 0 {
+		hs := make([]*histogram.FloatHistogram, len(v.Histograms))
+		for i, h := range v.Histograms {
+			hs[i] = h.Copy()
+		}
+		out.AppendHistograms(v.HistogramIDs, hs)
+	}
+	return out
+}
@@ -6,11 +6,16 @@ package telemetry
 import (
 	"context"
 	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/warnings"
 
 	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
@@ -20,6 +25,9 @@ import (
 type OperatorTelemetry interface {
 	fmt.Stringer
 
+	// Name returns the kind of the operator, e.g. "vectorBinary" or "absent". Unlike String,
+	// it does not contain operator specific details and can be used to group operators.
+	Name() string
 	MaxSeriesCount() int
 	SetMaxSeriesCount(count int)
 	ExecutionTimeTaken() time.Duration
@@ -27,41 +35,106 @@ type OperatorTelemetry interface {
 	SeriesExecutionTime() time.Duration
 	AddNextExecutionTime(time.Duration)
 	NextExecutionTime() time.Duration
+	AddWaitTime(time.Duration)
+	WaitTime() time.Duration
 	IncrementSamplesAtTimestamp(samples int, t int64)
 	Samples() *stats.QuerySamples
+	TotalSamples() int64
 	LogicalNode() logicalplan.Node
 	UpdatePeak(count int)
+	AddHashCollisions(count int)
+	HashCollisions() int
+	SetJoinBucketCount(count int)
+	// JoinBucketCount returns the number of distinct matching groups of a binary operation.
+	JoinBucketCount() int
+	AddDroppedSamples(count int)
+	// DroppedSamples returns the number of samples which were filtered out by a comparison operation.
+	DroppedSamples() int64
+	// ObserveHistograms records that the operator returned histogram samples.
+	ObserveHistograms()
+	// EstimatedMemory returns an estimate of the bytes needed to hold one batch of steps returned by the operator.
+	// It is based on the number of output series, and accounts for histograms once the operator returned them.
+	EstimatedMemory() int64
+	UpdatePeakGoroutines(count int)
+	// PeakGoroutines returns the highest number of goroutines observed by the operator which
+	// were reading operands of the query concurrently.
+	PeakGoroutines() int
+	// TimeBudget returns the soft limit on the time the operator can spend in Next. Zero means no limit.
+	TimeBudget() time.Duration
+	// Snapshot returns a consistent copy of the current counters. It can be called
+	// while the operator is still being executed.
+	Snapshot() TelemetrySnapshot
 }
 
-func NewTelemetry(operator fmt.Stringer, opts *query.Options) OperatorTelemetry {
+// TelemetrySnapshot is a point in time copy of the counters of an operator.
+type TelemetrySnapshot struct {
+	Series         int
+	ExecutionTime  time.Duration
+	SeriesTime     time.Duration
+	NextTime       time.Duration
+	WaitTime       time.Duration
+	TotalSamples   int64
+	PeakSamples    int
+	HashCollisions int
+	JoinBuckets    int
+	DroppedSamples int64
+	// EstimatedMemory is the estimated size of the output of the operator in bytes.
+	EstimatedMemory int64
+	PeakGoroutines  int
+}
+
+const (
+	// bytesPerSample is the size of a float sample in a step vector, which consists of its series ID and value.
+	bytesPerSample = 16
+	// bytesPerHistogram is the size of a histogram sample in a step vector, which consists of its series ID,
+	// a pointer to the histogram and the histogram itself. Buckets are not included since their number is unknown.
+	bytesPerHistogram = 16 + int64(unsafe.Sizeof(histogram.FloatHistogram{}))
+)
+
+// EstimateMemory returns the estimated size in bytes of the output of an operator with the given
+// number of series for the given number of steps. Operators only hold one batch of steps at a time,
+// so steps is usually the number of steps per batch rather than the total number of steps of a query.
+func EstimateMemory(series, steps int, histograms bool) int64 {
+	if histograms {
+		return int64(series) * int64(steps) * bytesPerHistogram
+	}
+	return int64(series) * int64(steps) * bytesPerSample
+}
+
+// NewTelemetry creates the telemetry of an operator. The name is the kind of the operator, see OperatorTelemetry.Name.
+func NewTelemetry(operator fmt.Stringer, name string, opts *query.Options) OperatorTelemetry {
 	if opts.EnableAnalysis {
-		return NewTrackedTelemetry(operator, opts, nil)
+		return NewTrackedTelemetry(operator, name, opts, nil)
 	}
-	return NewNoopTelemetry(operator)
+	return &NoopTelemetry{Stringer: operator, name: name, timeBudget: opts.OperatorTimeBudget}
 }
 
-func NewSubqueryTelemetry(operator fmt.Stringer, opts *query.Options) OperatorTelemetry {
+func NewSubqueryTelemetry(operator fmt.Stringer, name string, opts *query.Options) OperatorTelemetry {
 	if opts.EnableAnalysis {
-		return NewTrackedTelemetry(operator, opts, &logicalplan.Subquery{})
+		return NewTrackedTelemetry(operator, name, opts, &logicalplan.Subquery{})
 	}
-	return NewNoopTelemetry(operator)
+	return &NoopTelemetry{Stringer: operator, name: name, timeBudget: opts.OperatorTimeBudget}
 }
 
-func NewStepInvariantTelemetry(operator fmt.Stringer, opts *query.Options) OperatorTelemetry {
+func NewStepInvariantTelemetry(operator fmt.Stringer, name string, opts *query.Options) OperatorTelemetry {
 	if opts.EnableAnalysis {
-		return NewTrackedTelemetry(operator, opts, &logicalplan.StepInvariantExpr{})
+		return NewTrackedTelemetry(operator, name, opts, &logicalplan.StepInvariantExpr{})
 	}
-	return NewNoopTelemetry(operator)
+	return &NoopTelemetry{Stringer: operator, name: name, timeBudget: opts.OperatorTimeBudget}
 }
 
 type NoopTelemetry struct {
 	fmt.Stringer
+	name       string
+	timeBudget time.Duration
 }
 
-func NewNoopTelemetry(operator fmt.Stringer) *NoopTelemetry {
-	return &NoopTelemetry{Stringer: operator}
+func NewNoopTelemetry(operator fmt.Stringer, name string) *NoopTelemetry {
+	return &NoopTelemetry{Stringer: operator, name: name}
 }
 
+func (tm *NoopTelemetry) Name() string { return tm.name }
+
 func (tm *NoopTelemetry) AddExecutionTimeTaken(t time.Duration) {}
 
 func (tm *NoopTelemetry) ExecutionTimeTaken() time.Duration {
@@ -80,10 +153,18 @@ func (tm *NoopTelemetry) NextExecutionTime() time.Duration {
 	return time.Duration(0)
 }
 
+func (tm *NoopTelemetry) AddWaitTime(t time.Duration) {}
+
+func (tm *NoopTelemetry) WaitTime() time.Duration {
+	return time.Duration(0)
+}
+
 func (tm *NoopTelemetry) IncrementSamplesAtTimestamp(_ int, _ int64) {}
 
 func (tm *NoopTelemetry) Samples() *stats.QuerySamples { return nil }
 
+func (tm *NoopTelemetry) TotalSamples() int64 { return 0 }
+
 func (tm *NoopTelemetry) MaxSeriesCount() int { return 0 }
 
 func (tm *NoopTelemetry) SetMaxSeriesCount(_ int) {}
@@ -94,27 +175,75 @@ func (tm *NoopTelemetry) LogicalNode() logicalplan.Node {
 
 func (tm *NoopTelemetry) UpdatePeak(_ int) {}
 
+func (tm *NoopTelemetry) AddHashCollisions(_ int) {}
+
+func (tm *NoopTelemetry) HashCollisions() int { return 0 }
+
+func (tm *NoopTelemetry) SetJoinBucketCount(_ int) {}
+
+func (tm *NoopTelemetry) JoinBucketCount() int { return 0 }
+
+func (tm *NoopTelemetry) AddDroppedSamples(_ int) {}
+
+func (tm *NoopTelemetry) DroppedSamples() int64 { return 0 }
+
+func (tm *NoopTelemetry) ObserveHistograms() {}
+
+func (tm *NoopTelemetry) EstimatedMemory() int64 { return 0 }
+
+func (tm *NoopTelemetry) UpdatePeakGoroutines(_ int) {}
+
+func (tm *NoopTelemetry) PeakGoroutines() int { return 0 }
+
+func (tm *NoopTelemetry) TimeBudget() time.Duration { return tm.timeBudget }
+
+func (tm *NoopTelemetry) Snapshot() TelemetrySnapshot { return TelemetrySnapshot{} }
+
+// TrackedTelemetry records the statistics of an operator. It is safe for concurrent use
+// so that operators can update it from parallel execution paths.
 type TrackedTelemetry struct {
 	fmt.Stringer
+	name string
 
+	mu            sync.Mutex
 	Series        int
 	ExecutionTime time.Duration
 	SeriesTime    time.Duration
 	NextTime      time.Duration
+	// Wait is the time the operator spent waiting for its slowest child.
+	Wait          time.Duration
 	LoadedSamples *stats.QuerySamples
-	logicalNode   logicalplan.Node
+	// Collisions is the number of distinct label sets which shared a hash with another label set.
+	Collisions int
+	// JoinBuckets is the number of distinct matching groups allocated by a binary operation.
+	JoinBuckets int
+	// Dropped is the number of samples filtered out by a comparison operation.
+	Dropped int64
+	// Goroutines is the peak number of goroutines reading operands of the query concurrently.
+	Goroutines int
+	// steps is the number of steps in a batch, which is used to estimate the memory of the operator.
+	steps int
+	// histograms is set once the operator returned histogram samples.
+	histograms  bool
+	logicalNode logicalplan.Node
+	timeBudget  time.Duration
 }
 
-func NewTrackedTelemetry(operator fmt.Stringer, opts *query.Options, logicalPlanNode logicalplan.Node) *TrackedTelemetry {
+func NewTrackedTelemetry(operator fmt.Stringer, name string, opts *query.Options, logicalPlanNode logicalplan.Node) *TrackedTelemetry {
 	ss := stats.NewQuerySamples(opts.EnablePerStepStats)
 	ss.InitStepTracking(opts.Start.UnixMilli(), opts.End.UnixMilli(), StepTrackingInterval(opts.Step))
 	return &TrackedTelemetry{
 		Stringer:      operator,
+		name:          name,
 		LoadedSamples: ss,
+		steps:         opts.NumStepsPerBatch(),
 		logicalNode:   logicalPlanNode,
+		timeBudget:    opts.OperatorTimeBudget,
 	}
 }
 
+func (ti *TrackedTelemetry) Name() string { return ti.name }
+
 func StepTrackingInterval(step time.Duration) int64 {
 	if step == 0 {
 		return 1
@@ -122,31 +251,59 @@ func StepTrackingInterval(step time.Duration) int64 {
 	return int64(step / (time.Millisecond / time.Nanosecond))
 }
 
-func (ti *TrackedTelemetry) AddExecutionTimeTaken(t time.Duration) { ti.ExecutionTime += t }
+func (ti *TrackedTelemetry) AddExecutionTimeTaken(t time.Duration) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.ExecutionTime += t
+}
 
 func (ti *TrackedTelemetry) ExecutionTimeTaken() time.Duration {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
 	return ti.ExecutionTime
 }
 
 func (ti *TrackedTelemetry) AddSeriesExecutionTime(t time.Duration) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
 	ti.SeriesTime += t
 	ti.ExecutionTime += t
 }
 
 func (ti *TrackedTelemetry) SeriesExecutionTime() time.Duration {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
 	return ti.SeriesTime
 }
 
 func (ti *TrackedTelemetry) AddNextExecutionTime(t time.Duration) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
 	ti.NextTime += t
 	ti.ExecutionTime += t
 }
 
 func (ti *TrackedTelemetry) NextExecutionTime() time.Duration {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
 	return ti.NextTime
 }
 
+func (ti *TrackedTelemetry) AddWaitTime(t time.Duration) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.Wait += t
+}
+
+func (ti *TrackedTelemetry) WaitTime() time.Duration {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.Wait
+}
+
 func (ti *TrackedTelemetry) IncrementSamplesAtTimestamp(samples int, t int64) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
 	ti.LoadedSamples.IncrementSamplesAtTimestamp(t, int64(samples))
 }
 
@@ -154,14 +311,119 @@ func (ti *TrackedTelemetry) LogicalNode() logicalplan.Node {
 	return ti.logicalNode
 }
 
-func (ti *TrackedTelemetry) Samples() *stats.QuerySamples { return ti.LoadedSamples }
+// Samples returns a copy of the samples loaded by the operator, which is not modified
+// when the operator loads more samples.
+func (ti *TrackedTelemetry) Samples() *stats.QuerySamples {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	samples := *ti.LoadedSamples
+	samples.TotalSamplesPerStep = slices.Clone(ti.LoadedSamples.TotalSamplesPerStep)
+	return &samples
+}
 
-func (ti *TrackedTelemetry) MaxSeriesCount() int { return ti.Series }
+func (ti *TrackedTelemetry) TotalSamples() int64 {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.LoadedSamples.TotalSamples
+}
 
-func (ti *TrackedTelemetry) SetMaxSeriesCount(count int) { ti.Series = count }
+func (ti *TrackedTelemetry) MaxSeriesCount() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.Series
+}
+
+func (ti *TrackedTelemetry) SetMaxSeriesCount(count int) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.Series = count
+}
 
 func (ti *TrackedTelemetry) UpdatePeak(count int) {
-	ti.Samples().UpdatePeak(count)
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.LoadedSamples.UpdatePeak(count)
+}
+
+func (ti *TrackedTelemetry) AddHashCollisions(count int) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.Collisions += count
+}
+
+func (ti *TrackedTelemetry) HashCollisions() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.Collisions
+}
+
+func (ti *TrackedTelemetry) SetJoinBucketCount(count int) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.JoinBuckets = count
+}
+
+func (ti *TrackedTelemetry) JoinBucketCount() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.JoinBuckets
+}
+
+func (ti *TrackedTelemetry) AddDroppedSamples(count int) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.Dropped += int64(count)
+}
+
+func (ti *TrackedTelemetry) DroppedSamples() int64 {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.Dropped
+}
+
+func (ti *TrackedTelemetry) ObserveHistograms() {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.histograms = true
+}
+
+func (ti *TrackedTelemetry) EstimatedMemory() int64 {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return EstimateMemory(ti.Series, ti.steps, ti.histograms)
+}
+
+func (ti *TrackedTelemetry) UpdatePeakGoroutines(count int) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.Goroutines = max(ti.Goroutines, count)
+}
+
+func (ti *TrackedTelemetry) PeakGoroutines() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.Goroutines
+}
+
+func (ti *TrackedTelemetry) TimeBudget() time.Duration { return ti.timeBudget }
+
+func (ti *TrackedTelemetry) Snapshot() TelemetrySnapshot {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return TelemetrySnapshot{
+		Series:          ti.Series,
+		ExecutionTime:   ti.ExecutionTime,
+		SeriesTime:      ti.SeriesTime,
+		NextTime:        ti.NextTime,
+		WaitTime:        ti.Wait,
+		TotalSamples:    ti.LoadedSamples.TotalSamples,
+		PeakSamples:     ti.LoadedSamples.PeakSamples,
+		HashCollisions:  ti.Collisions,
+		JoinBuckets:     ti.JoinBuckets,
+		DroppedSamples:  ti.Dropped,
+		EstimatedMemory: EstimateMemory(ti.Series, ti.steps, ti.histograms),
+		PeakGoroutines:  ti.Goroutines,
+	}
 }
 
 type ObservableVectorOperator interface {
@@ -190,6 +452,15 @@ func NewOperator(telemetry OperatorTelemetry, inner model.VectorOperator) model.
 type Operator struct {
 	OperatorTelemetry
 	inner model.VectorOperator
+
+	// nextTime and selfTime are tracked separately from the telemetry so that the time budget
+	// is also enforced when analysis is disabled. nextTime includes the time spent in children
+	// and is read by the parent operator, which can run in a different goroutine.
+	nextTime       atomic.Int64
+	selfTime       time.Duration
+	budgetExceeded bool
+	// children are the closest operators below this one which track their time in Next.
+	children []*Operator
 }
 
 func (t *Operator) Series(ctx context.Context) ([]labels.Labels, error) {
@@ -205,37 +476,86 @@ func (t *Operator) Series(ctx context.Context) ([]labels.Labels, error) {
 
 func (t *Operator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
 	start := time.Now()
-	var totalSamplesBeforeCount int64
-	totalSamplesBefore := t.OperatorTelemetry.Samples()
-	if totalSamplesBefore != nil {
-		totalSamplesBeforeCount = totalSamplesBefore.TotalSamples
-	} else {
-		totalSamplesBeforeCount = 0
-	}
+	totalSamplesBefore := t.OperatorTelemetry.TotalSamples()
+	childrenTimeBefore := t.childrenNextTime()
 
 	defer func() { t.OperatorTelemetry.AddNextExecutionTime(time.Since(start)) }()
 	n, err := t.inner.Next(ctx, buf)
+	t.checkTimeBudget(ctx, time.Since(start), t.childrenNextTime()-childrenTimeBefore)
 	if err != nil {
 		return 0, err
 	}
 
-	var totalSamplesAfter int64
-	totalSamplesAfterSamples := t.OperatorTelemetry.Samples()
-	if totalSamplesAfterSamples != nil {
-		totalSamplesAfter = totalSamplesAfterSamples.TotalSamples
-	} else {
-		totalSamplesAfter = 0
+	totalSamplesAfter := t.OperatorTelemetry.TotalSamples()
+	t.OperatorTelemetry.UpdatePeak(int(totalSamplesAfter) - int(totalSamplesBefore))
+	for i := range n {
+		if len(buf[i].Histograms) > 0 {
+			t.OperatorTelemetry.ObserveHistograms()
+			break
+		}
 	}
 
-	t.OperatorTelemetry.UpdatePeak(int(totalSamplesAfter) - int(totalSamplesBeforeCount))
-
 	return n, err
 }
 
+// checkTimeBudget adds an annotation the first time the operator exceeds its time budget.
+// Only the time spent in the operator itself counts against the budget, so that a slow
+// operator does not make all of its ancestors exceed their budget as well.
+func (t *Operator) checkTimeBudget(ctx context.Context, elapsed, childrenElapsed time.Duration) {
+	budget := t.OperatorTelemetry.TimeBudget()
+	if budget <= 0 {
+		return
+	}
+	t.nextTime.Add(int64(elapsed))
+	if t.budgetExceeded {
+		return
+	}
+	// Children can run concurrently, in which case their time can exceed the elapsed time.
+	t.selfTime += max(elapsed-childrenElapsed, 0)
+	if t.selfTime > budget {
+		t.budgetExceeded = true
+		warnings.AddToContext(warnings.NewOperatorTimeBudgetExceededInfo(t.OperatorTelemetry.Name(), budget), ctx)
+	}
+}
+
+// childrenNextTime returns the total time the children of the operator spent in Next.
+// It is only tracked when the operator has a time budget.
+func (t *Operator) childrenNextTime() time.Duration {
+	if t.OperatorTelemetry.TimeBudget() <= 0 {
+		return 0
+	}
+	if t.children == nil {
+		t.children = make([]*Operator, 0)
+		t.collectChildren(t.inner.Explain())
+	}
+	var total time.Duration
+	for _, c := range t.children {
+		total += time.Duration(c.nextTime.Load())
+	}
+	return total
+}
+
+func (t *Operator) collectChildren(ops []model.VectorOperator) {
+	for _, op := range ops {
+		if c, ok := op.(*Operator); ok {
+			t.children = append(t.children, c)
+			continue
+		}
+		if op != nil {
+			t.collectChildren(op.Explain())
+		}
+	}
+}
+
 func (t *Operator) Explain() []model.VectorOperator {
 	return t.inner.Explain()
 }
 
+// Unwrap returns the operator whose telemetry is recorded.
+func (t *Operator) Unwrap() model.VectorOperator {
+	return t.inner
+}
+
 func (t *Operator) String() string {
 	return t.inner.String()
 }
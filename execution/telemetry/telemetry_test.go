@@ -0,0 +1,169 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/logicalplan"
+	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/warnings"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// sleepOperator sleeps for the given duration in each call to Next before reading from next.
+// Without next, it returns a single step, or err if it is set.
+type sleepOperator struct {
+	name  string
+	sleep time.Duration
+	next  model.VectorOperator
+	err   error
+	done  bool
+}
+
+func (o *sleepOperator) Next(ctx context.Context, buf []model.StepVector) (int, error) {
+	time.Sleep(o.sleep)
+	if o.next != nil {
+		return o.next.Next(ctx, buf)
+	}
+	if o.err != nil {
+		return 0, o.err
+	}
+	if o.done {
+		return 0, nil
+	}
+	o.done = true
+	buf[0].Reset(0)
+	return 1, nil
+}
+
+func (o *sleepOperator) Series(context.Context) ([]labels.Labels, error) { return nil, nil }
+
+func (o *sleepOperator) Explain() []model.VectorOperator {
+	if o.next == nil {
+		return nil
+	}
+	return []model.VectorOperator{o.next}
+}
+
+func (o *sleepOperator) String() string { return "[" + o.name + "]" }
+
+func newSleepOperator(name string, sleep time.Duration, next model.VectorOperator, err error, opts *query.Options) model.VectorOperator {
+	op := &sleepOperator{name: name, sleep: sleep, next: next, err: err}
+	return NewOperator(NewTelemetry(op, name, opts), op)
+}
+
+func TestOperatorTimeBudgetExcludesChildren(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{name: "success"},
+		{name: "error", err: errors.New("leaf failed")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			opts := &query.Options{OperatorTimeBudget: 50 * time.Millisecond}
+			leaf := newSleepOperator("leaf", 100*time.Millisecond, nil, tc.err, opts)
+			root := newSleepOperator("root", 0, newSleepOperator("middle", 0, leaf, nil, opts), nil, opts)
+
+			ctx := warnings.NewContext(context.Background())
+			_, err := root.Next(ctx, make([]model.StepVector, 1))
+			testutil.Equals(t, tc.err, err)
+
+			_, infos := warnings.FromContext(ctx).AsStrings("", 0, 0)
+			testutil.Equals(t, 1, len(infos))
+			testutil.Assert(t, strings.HasSuffix(infos[0], "in leaf operator"), "unexpected info %q", infos[0])
+		})
+	}
+}
+
+func TestTrackedTelemetryConcurrentUpdates(t *testing.T) {
+	t.Parallel()
+
+	opts := &query.Options{Start: time.Unix(0, 0), End: time.Unix(100, 0), Step: 10 * time.Second, EnablePerStepStats: true}
+	tm := NewTrackedTelemetry(&logicalplan.NumberLiteral{Val: 1}, "numberLiteral", opts, nil)
+
+	const workers, updates = 8, 1000
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range updates {
+				tm.IncrementSamplesAtTimestamp(1, 10_000)
+				tm.AddNextExecutionTime(time.Nanosecond)
+				tm.AddHashCollisions(1)
+				tm.UpdatePeak(1)
+				_ = tm.Samples().TotalSamples
+			}
+		}()
+	}
+	wg.Wait()
+
+	testutil.Equals(t, int64(workers*updates), tm.TotalSamples())
+	testutil.Equals(t, workers*updates*time.Nanosecond, tm.NextExecutionTime())
+	testutil.Equals(t, workers*updates*time.Nanosecond, tm.ExecutionTimeTaken())
+	testutil.Equals(t, workers*updates, tm.HashCollisions())
+
+	// Samples returns a copy which is not modified by later updates.
+	samples := tm.Samples()
+	tm.IncrementSamplesAtTimestamp(1, 10_000)
+	testutil.Equals(t, int64(workers*updates), samples.TotalSamples)
+	testutil.Equals(t, int64(workers*updates), samples.TotalSamplesPerStep[1])
+	testutil.Equals(t, int64(workers*updates+1), tm.Samples().TotalSamples)
+}
+
+func TestTrackedTelemetrySnapshot(t *testing.T) {
+	t.Parallel()
+
+	opts := &query.Options{Start: time.Unix(0, 0), End: time.Unix(100, 0), Step: 10 * time.Second, StepsBatch: 10}
+	tm := NewTrackedTelemetry(&logicalplan.NumberLiteral{Val: 1}, "numberLiteral", opts, nil)
+	tm.SetMaxSeriesCount(3)
+
+	const updates = 1000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range updates {
+			tm.IncrementSamplesAtTimestamp(2, 10_000)
+			tm.AddNextExecutionTime(time.Nanosecond)
+		}
+	}()
+
+	// Snapshots taken while the counters are updated must be consistent with each other.
+	var prev TelemetrySnapshot
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		snapshot := tm.Snapshot()
+		testutil.Assert(t, snapshot.TotalSamples >= prev.TotalSamples, "samples decreased from %d to %d", prev.TotalSamples, snapshot.TotalSamples)
+		testutil.Assert(t, snapshot.NextTime >= prev.NextTime, "next time decreased from %v to %v", prev.NextTime, snapshot.NextTime)
+		testutil.Equals(t, snapshot.NextTime, snapshot.ExecutionTime)
+		prev = snapshot
+	}
+
+	testutil.Equals(t, TelemetrySnapshot{
+		Series:          3,
+		ExecutionTime:   updates * time.Nanosecond,
+		NextTime:        updates * time.Nanosecond,
+		TotalSamples:    2 * updates,
+		EstimatedMemory: EstimateMemory(3, 10, false),
+	}, tm.Snapshot())
+	testutil.Equals(t, TelemetrySnapshot{}, NewNoopTelemetry(&logicalplan.NumberLiteral{Val: 1}, "numberLiteral").Snapshot())
+}
@@ -642,6 +642,9 @@ func isDistributive(expr *Node, skipBinaryPushdown bool, engineLabels map[string
 	case Deduplicate, RemoteExecution:
 		return false
 	case *Binary:
+		if e.KeepMetricName {
+			return false
+		}
 		if isBinaryExpressionWithOneScalarSide(e) {
 			return true
 		}
@@ -673,6 +676,18 @@ func isDistributive(expr *Node, skipBinaryPushdown bool, engineLabels map[string
 	return true
 }
 
+// keepsMetricName returns whether the plan has binary operations which keep the metric name.
+// Remote engines only receive the string representation of a plan, which cannot express it.
+func keepsMetricName(plan Node) bool {
+	var keep bool
+	Traverse(&plan, func(n *Node) {
+		if b, ok := (*n).(*Binary); ok && b.KeepMetricName {
+			keep = true
+		}
+	})
+	return keep
+}
+
 func isBinaryExpressionWithOneScalarSide(expr *Binary) bool {
 	lhsConstant := IsConstantScalarExpr(expr.LHS)
 	rhsConstant := IsConstantScalarExpr(expr.RHS)
@@ -1052,6 +1052,25 @@ sum(dedup(
 	testutil.Assert(t, len(vs1.LabelMatchers) == len(vs0.LabelMatchers)-1, "expected %d label matchers, got %d", len(vs0.LabelMatchers)-1, len(vs1.LabelMatchers))
 }
 
+func TestDistributedExecutionKeepsMetricNameLocally(t *testing.T) {
+	expr, err := parser.ParseExpr(`sum(metric * 2)`)
+	testutil.Ok(t, err)
+
+	engines := []api.RemoteEngine{
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")}),
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "west")}),
+	}
+
+	lplan, _ := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}, PlanOptions{})
+	lplan.Root().(*Aggregation).Expr.(*Binary).KeepMetricName = true
+
+	optimizedPlan, _ := lplan.Optimize([]Optimizer{
+		DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)},
+	})
+	expected := `sum(dedup(remote(metric), remote(metric)) * 2)`
+	testutil.Equals(t, cleanUp(replacements, expected), optimizedPlan.Root().String())
+}
+
 type engineMock struct {
 	api.RemoteEngine
 	minT               int64
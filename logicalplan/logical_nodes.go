@@ -375,6 +375,11 @@ type Binary struct {
 	// If a comparison operator, return 0/1 rather than filtering.
 	ReturnBool bool
 
+	// If set, the metric name of the operands is kept in the result instead of being dropped.
+	// There is no PromQL syntax for it yet, so it can only be set on the logical plan. It is not part
+	// of the string representation either, so operations which set it are not sent to remote engines.
+	KeepMetricName bool
+
 	ValueType parser.ValueType
 }
 
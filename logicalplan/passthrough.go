@@ -44,6 +44,9 @@ func matchingEngineTime(e api.RemoteEngine, opts *query.Options) bool {
 
 func (m PassthroughOptimizer) Optimize(plan Node, opts *query.Options) (Node, annotations.Annotations) {
 	engines := m.Endpoints.Engines()
+	if keepsMetricName(plan) {
+		return plan, nil
+	}
 	if len(engines) == 1 {
 		if !matchingEngineTime(engines[0], opts) {
 			return plan, nil
@@ -32,6 +32,21 @@ func TestPassthrough(t *testing.T) {
 		testutil.Equals(t, "remote(time())", renderExprTree(optimizedPlan.Root()))
 	})
 
+	t.Run("not optimized when keeping the metric name", func(t *testing.T) {
+		engines := []api.RemoteEngine{
+			newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east"), labels.FromStrings("region", "south")}),
+		}
+		optimizers := []Optimizer{PassthroughOptimizer{Endpoints: api.NewStaticEndpoints(engines)}}
+
+		expr, err := parser.ParseExpr(`metric * 2`)
+		testutil.Ok(t, err)
+		plan, _ := NewFromAST(expr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}, PlanOptions{})
+		plan.Root().(*Binary).KeepMetricName = true
+		optimizedPlan, _ := plan.Optimize(optimizers)
+
+		testutil.Equals(t, "metric * 2", renderExprTree(optimizedPlan.Root()))
+	})
+
 	t.Run("not optimized with two engines", func(t *testing.T) {
 		engines := []api.RemoteEngine{
 			newEngineMock(math.MinInt64, math.MinInt64, []labels.Labels{labels.FromStrings("region", "east"), labels.FromStrings("region", "south")}),
@@ -131,10 +131,37 @@ func getTimeRangesForSelector(qOpts *query.Options, n *parser.VectorSelector, pa
 		// inject a zero if there is only one point.
 		start -= int64(qOpts.ExtLookbackDelta.Milliseconds())
 	}
+	if isAbsentLookbackSelector(n, parents) {
+		// Select series from further back so that absent can use their labels.
+		start -= qOpts.AbsentLabelsLookback.Milliseconds()
+	}
 
 	return start, end
 }
 
+// AbsentLookbackSelector returns the selector whose series are used to enrich the labels of the series
+// synthesized by the given absent call when AbsentLabelsLookback is set. Only selectors which are the
+// direct argument of absent are selected from further back.
+func AbsentLookbackSelector(call *FunctionCall) (*VectorSelector, bool) {
+	if call.Func.Name != "absent" || len(call.Args) != 1 {
+		return nil, false
+	}
+	vs, ok := call.Args[0].(*VectorSelector)
+	return vs, ok
+}
+
+func isAbsentLookbackSelector(n *parser.VectorSelector, parents []*Node) bool {
+	if len(parents) == 0 {
+		return false
+	}
+	call, ok := (*parents[len(parents)-1]).(*FunctionCall)
+	if !ok {
+		return false
+	}
+	vs, ok := AbsentLookbackSelector(call)
+	return ok && vs.VectorSelector == n
+}
+
 func extractFuncFromPath(p []*Node) string {
 	if len(p) == 0 {
 		return ""
@@ -415,6 +442,14 @@ func reduceConstantExpressions(expr Node) Node {
 				*parent = &NumberLiteral{Val: math.Pow(lnum, rnum)}
 			case parser.MOD:
 				*parent = &NumberLiteral{Val: math.Mod(lnum, rnum)}
+			case parser.ATAN2:
+				*parent = &NumberLiteral{Val: math.Atan2(lnum, rnum)}
+			case parser.EQLC, parser.NEQ, parser.GTR, parser.LSS, parser.GTE, parser.LTE:
+				// Comparisons between scalars are only valid with the bool modifier.
+				if !tparent.ReturnBool {
+					return false
+				}
+				*parent = &NumberLiteral{Val: compareConstants(tparent.Op, lnum, rnum)}
 			default:
 				return false
 			}
@@ -424,6 +459,28 @@ func reduceConstantExpressions(expr Node) Node {
 	return expr
 }
 
+func compareConstants(op parser.ItemType, lhs, rhs float64) float64 {
+	var ok bool
+	switch op {
+	case parser.EQLC:
+		ok = lhs == rhs
+	case parser.NEQ:
+		ok = lhs != rhs
+	case parser.GTR:
+		ok = lhs > rhs
+	case parser.LSS:
+		ok = lhs < rhs
+	case parser.GTE:
+		ok = lhs >= rhs
+	case parser.LTE:
+		ok = lhs <= rhs
+	}
+	if ok {
+		return 1
+	}
+	return 0
+}
+
 func trimParens(expr Node) Node {
 	TraverseBottomUp(nil, &expr, func(parent, current *Node) bool {
 		if current == nil || parent == nil {
@@ -443,7 +500,14 @@ func insertDuplicateLabelChecks(expr Node) Node {
 		switch t := (*node).(type) {
 		case *CheckDuplicateLabels:
 			return
-		case *Aggregation, *Unary, *Binary, *FunctionCall:
+		case *FunctionCall:
+			// vector() always returns a single series, so it cannot produce duplicates.
+			// Its argument can still contain vectors with duplicates, e.g. in scalar(-x).
+			if t.Func.Name == "vector" {
+				return
+			}
+			*node = &CheckDuplicateLabels{Expr: t}
+		case *Aggregation, *Unary, *Binary:
 			*node = &CheckDuplicateLabels{Expr: t}
 		case *VectorSelector:
 			if t.SelectTimestamp {
@@ -395,6 +395,26 @@ func TestReduceConstantExpressions(t *testing.T) {
 			expr:     "12%5",
 			expected: "2",
 		},
+		{
+			name:     "binary atan2",
+			expr:     "0 atan2 1",
+			expected: "0",
+		},
+		{
+			name:     "bool comparison",
+			expr:     "2 > bool 3",
+			expected: "0",
+		},
+		{
+			name:     "nested bool comparison",
+			expr:     "(1 + 1) == bool 2",
+			expected: "1",
+		},
+		{
+			name:     "bool comparison with NaN",
+			expr:     "NaN != bool NaN",
+			expected: "1",
+		},
 		{
 			name:     "unary negation",
 			expr:     "2+(-5)",
@@ -433,3 +453,33 @@ func cleanUp(replacements map[string]*regexp.Regexp, expr string) string {
 	}
 	return strings.Trim(expr, " ")
 }
+
+func TestMinMaxTimeAbsentLabelsLookback(t *testing.T) {
+	opts := &query.Options{
+		Start:                time.Unix(3600, 0),
+		End:                  time.Unix(3600, 0),
+		LookbackDelta:        5 * time.Minute,
+		AbsentLabelsLookback: time.Hour,
+	}
+	cases := []struct {
+		expr     string
+		expected int64
+	}{
+		{expr: `absent(foo)`, expected: -300},
+		{expr: `absent(-foo)`, expected: 3300},
+		{expr: `absent(sum(foo))`, expected: 3300},
+		{expr: `absent_over_time(foo[5m])`, expected: 3300},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.expr, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			plan, err := NewFromAST(expr, opts, PlanOptions{})
+			testutil.Ok(t, err)
+			optimizedPlan, _ := plan.Optimize(DefaultOptimizers)
+			mint, _ := optimizedPlan.MinMaxTime(opts)
+			testutil.Equals(t, tcase.expected*1000, mint)
+		})
+	}
+}
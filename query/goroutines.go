@@ -0,0 +1,67 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import "sync/atomic"
+
+// GoroutinePool bounds the number of goroutines which operators of a query start to read
+// their operands concurrently. It is shared by all operators of a query, including the
+// operators of subqueries. A nil pool does not bound the number of goroutines.
+type GoroutinePool struct {
+	// slots is nil when the number of goroutines is not bounded.
+	slots  chan struct{}
+	active atomic.Int64
+	peak   atomic.Int64
+}
+
+// NewGoroutinePool creates a pool which runs at most size goroutines at the same time.
+// A size of zero means no limit, but the number of goroutines is still tracked.
+func NewGoroutinePool(size int) *GoroutinePool {
+	p := &GoroutinePool{}
+	if size > 0 {
+		p.slots = make(chan struct{}, size)
+	}
+	return p
+}
+
+// TryGo runs f in a new goroutine if the pool has capacity and reports whether it did.
+// It never blocks, since operators waiting for a slot could be waiting for their own children.
+// Callers need to run f themselves when no goroutine was started.
+func (p *GoroutinePool) TryGo(f func()) bool {
+	if p == nil {
+		go f()
+		return true
+	}
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+
+	active := p.active.Add(1)
+	for peak := p.peak.Load(); active > peak && !p.peak.CompareAndSwap(peak, active); peak = p.peak.Load() {
+	}
+	go func() {
+		defer p.release()
+		f()
+	}()
+	return true
+}
+
+func (p *GoroutinePool) release() {
+	p.active.Add(-1)
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// Peak returns the highest number of goroutines which were running at the same time.
+func (p *GoroutinePool) Peak() int {
+	if p == nil {
+		return 0
+	}
+	return int(p.peak.Load())
+}
@@ -8,16 +8,38 @@ import (
 )
 
 type Options struct {
-	Start                    time.Time
-	End                      time.Time
-	Step                     time.Duration
-	StepsBatch               int
-	LookbackDelta            time.Duration
-	EnablePerStepStats       bool
-	ExtLookbackDelta         time.Duration
-	NoStepSubqueryIntervalFn func(time.Duration) time.Duration
-	EnableAnalysis           bool
-	DecodingConcurrency      int
+	Start                       time.Time
+	End                         time.Time
+	Step                        time.Duration
+	StepsBatch                  int
+	LookbackDelta               time.Duration
+	EnablePerStepStats          bool
+	ExtLookbackDelta            time.Duration
+	NoStepSubqueryIntervalFn    func(time.Duration) time.Duration
+	EnableAnalysis              bool
+	DecodingConcurrency         int
+	AbsentLabelsLookback        time.Duration
+	MaxHistogramBuckets         int
+	EnableExperimentalFunctions bool
+	Recorder                    Recorder
+	SortOrSeries                bool
+	EnableSchemaReducedInfo     bool
+	HistogramEqualityTolerance  float64
+	KeepNaNComparisons          bool
+	NestedLoopJoinThreshold     int
+	OperatorTimeBudget          time.Duration
+	DropNaNInSetOps             bool
+	RoundSignificantDigits      int
+	MaxOrSeries                 int
+	PermissiveManyToOne         bool
+	SkipManyToManyMatches       bool
+	ValidateSeriesIDs           bool
+	EnableSharedSubexpressions  bool
+	// EnableDelayedNameRemoval only changes the annotations which Prometheus names differently
+	// when delayed name removal is enabled. Metric names are still dropped right away.
+	EnableDelayedNameRemoval bool
+	// Goroutines is shared by all operators of a query, including the operators of subqueries.
+	Goroutines *GoroutinePool
 }
 
 // TotalSteps returns the total number of steps in the query, regardless of batching.
@@ -50,13 +72,32 @@ func (o *Options) WithEndTime(end time.Time) *Options {
 
 func NestedOptionsForSubquery(opts *Options, step, queryRange, offset time.Duration) *Options {
 	nOpts := &Options{
-		End:                      opts.End.Add(-offset),
-		LookbackDelta:            opts.LookbackDelta,
-		StepsBatch:               opts.StepsBatch,
-		ExtLookbackDelta:         opts.ExtLookbackDelta,
-		NoStepSubqueryIntervalFn: opts.NoStepSubqueryIntervalFn,
-		EnableAnalysis:           opts.EnableAnalysis,
-		DecodingConcurrency:      opts.DecodingConcurrency,
+		End:                         opts.End.Add(-offset),
+		LookbackDelta:               opts.LookbackDelta,
+		StepsBatch:                  opts.StepsBatch,
+		ExtLookbackDelta:            opts.ExtLookbackDelta,
+		NoStepSubqueryIntervalFn:    opts.NoStepSubqueryIntervalFn,
+		EnableAnalysis:              opts.EnableAnalysis,
+		DecodingConcurrency:         opts.DecodingConcurrency,
+		AbsentLabelsLookback:        opts.AbsentLabelsLookback,
+		MaxHistogramBuckets:         opts.MaxHistogramBuckets,
+		EnableExperimentalFunctions: opts.EnableExperimentalFunctions,
+		Recorder:                    opts.Recorder,
+		SortOrSeries:                opts.SortOrSeries,
+		EnableSchemaReducedInfo:     opts.EnableSchemaReducedInfo,
+		EnableDelayedNameRemoval:    opts.EnableDelayedNameRemoval,
+		HistogramEqualityTolerance:  opts.HistogramEqualityTolerance,
+		KeepNaNComparisons:          opts.KeepNaNComparisons,
+		NestedLoopJoinThreshold:     opts.NestedLoopJoinThreshold,
+		OperatorTimeBudget:          opts.OperatorTimeBudget,
+		DropNaNInSetOps:             opts.DropNaNInSetOps,
+		RoundSignificantDigits:      opts.RoundSignificantDigits,
+		MaxOrSeries:                 opts.MaxOrSeries,
+		PermissiveManyToOne:         opts.PermissiveManyToOne,
+		SkipManyToManyMatches:       opts.SkipManyToManyMatches,
+		ValidateSeriesIDs:           opts.ValidateSeriesIDs,
+		Goroutines:                  opts.Goroutines,
+		EnableSharedSubexpressions:  opts.EnableSharedSubexpressions,
 	}
 	if step != 0 {
 		nOpts.Step = step
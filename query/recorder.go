@@ -0,0 +1,21 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"github.com/thanos-io/promql-engine/execution/model"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// Recorder captures intermediate results of a query for debugging purposes.
+// Implementations must be safe for concurrent use since operators can be executed concurrently.
+type Recorder interface {
+	// ShouldRecord returns true if the output of the given expression should be recorded.
+	ShouldRecord(expr string) bool
+	// RecordSeries is called with the output series of a recorded expression.
+	RecordSeries(expr string, series []labels.Labels)
+	// RecordVectors is called with a copy of every batch of step vectors produced by a recorded expression.
+	RecordVectors(expr string, vectors []model.StepVector)
+}
@@ -306,19 +306,22 @@ var rangeVectorFuncs = map[string]FunctionCall{
 		}
 		floats := make([]float64, 0, len(f.Samples))
 
-		var warn warnings.Warnings
+		var hasHistograms bool
 		for _, sample := range f.Samples {
 			if sample.V.H != nil {
-				if len(floats) > 0 {
-					warn |= warnings.WarnHistogramIgnoredInMixedRange
-				}
+				hasHistograms = true
 				continue
 			}
 			floats = append(floats, sample.V.F)
 		}
 
+		// Series with only histograms in the window are skipped without an annotation.
 		if len(floats) == 0 {
-			return 0, nil, false, warn, nil
+			return 0, nil, false, 0, nil
+		}
+		var warn warnings.Warnings
+		if hasHistograms {
+			warn = warnings.WarnHistogramIgnoredInMixedRange
 		}
 		return compute.Quantile(f.ScalarPoint, floats), nil, true, warn, nil
 	},
@@ -769,20 +772,22 @@ func madOverTime(points []Sample) (float64, bool, warnings.Warnings) {
 }
 
 func maxOverTime(points []Sample) (float64, int64, bool, warnings.Warnings) {
-	resv := points[0].V.F
-	rest := points[0].T
+	var (
+		resv float64
+		rest int64
+	)
 
 	var foundFloat, foundHist bool
 	for _, v := range points {
 		if v.V.H != nil {
 			foundHist = true
-		} else {
-			foundFloat = true
+			continue
 		}
-		if v.V.F >= resv || math.IsNaN(resv) {
+		if !foundFloat || v.V.F >= resv || math.IsNaN(resv) {
 			resv = v.V.F
 			rest = v.T
 		}
+		foundFloat = true
 	}
 
 	if !foundFloat {
@@ -796,20 +801,22 @@ func maxOverTime(points []Sample) (float64, int64, bool, warnings.Warnings) {
 }
 
 func minOverTime(points []Sample) (float64, int64, bool, warnings.Warnings) {
-	resv := points[0].V.F
-	rest := points[0].T
+	var (
+		resv float64
+		rest int64
+	)
 
 	var foundFloat, foundHist bool
 	for _, v := range points {
 		if v.V.H != nil {
 			foundHist = true
-		} else {
-			foundFloat = true
+			continue
 		}
-		if v.V.F <= resv || math.IsNaN(resv) {
+		if !foundFloat || v.V.F <= resv || math.IsNaN(resv) {
 			resv = v.V.F
 			rest = v.T
 		}
+		foundFloat = true
 	}
 
 	if !foundFloat {
@@ -988,17 +995,18 @@ func changes(points []Sample) float64 {
 }
 
 func deriv(points []Sample) (float64, bool, warnings.Warnings) {
-	var floats int
+	var floats, histograms int
 	var warn warnings.Warnings
 
 	for _, p := range points {
 		if p.V.H == nil {
 			floats++
+		} else {
+			histograms++
 		}
-
-		if floats > 0 && p.V.H != nil {
-			warn |= warnings.WarnHistogramIgnoredInMixedRange
-		}
+	}
+	if floats > 0 && histograms > 0 {
+		warn |= warnings.WarnHistogramIgnoredInMixedRange
 	}
 
 	if floats < 2 {
@@ -1020,17 +1028,18 @@ func deriv(points []Sample) (float64, bool, warnings.Warnings) {
 }
 
 func predictLinear(points []Sample, duration float64, stepTime int64) (float64, bool, warnings.Warnings) {
-	var floats int
+	var floats, histograms int
 	var warn warnings.Warnings
 
 	for _, p := range points {
 		if p.V.H == nil {
 			floats++
+		} else {
+			histograms++
 		}
-
-		if floats > 0 && p.V.H != nil {
-			warn |= warnings.WarnHistogramIgnoredInMixedRange
-		}
+	}
+	if floats > 0 && histograms > 0 {
+		warn |= warnings.WarnHistogramIgnoredInMixedRange
 	}
 
 	if floats < 2 {
@@ -61,6 +61,9 @@ type matrixSelector struct {
 	selectRange   int64
 	offset        int64
 	isExtFunction bool
+	// atModifier is set when the selector uses the @ modifier. Like in Prometheus,
+	// its range is then selected relative to the start of the query for all steps.
+	atModifier bool
 
 	currentStep     int64
 	currentSeries   int64
@@ -86,6 +89,7 @@ func NewMatrixSelector(
 	arg2 float64,
 	opts *query.Options,
 	selectRange, offset time.Duration,
+	atModifier bool,
 	batchSize int64,
 	shard, numShard int,
 ) (model.VectorOperator, error) {
@@ -110,6 +114,7 @@ func NewMatrixSelector(
 
 		selectRange:     selectRange.Milliseconds(),
 		offset:          offset.Milliseconds(),
+		atModifier:      atModifier,
 		currentStep:     opts.Start.UnixMilli(),
 		seriesBatchSize: batchSize,
 
@@ -125,7 +130,7 @@ func NewMatrixSelector(
 		m.step = 1
 	}
 
-	m.telemetry = telemetry.NewTelemetry(m, opts)
+	m.telemetry = telemetry.NewTelemetry(m, "matrixSelector", opts)
 	return telemetry.NewOperator(m.telemetry, m), nil
 }
 
@@ -187,6 +192,9 @@ func (o *matrixSelector) Next(ctx context.Context, buf []model.StepVector) (int,
 
 		for currStep := 0; currStep < n && seriesTs <= o.maxt; currStep++ {
 			maxt := seriesTs - o.offset
+			if o.atModifier {
+				maxt = o.mint - o.offset
+			}
 			mint := maxt - o.selectRange
 
 			if err := scanner.selectPoints(mint, maxt, seriesTs, o.fhReader, o.isExtFunction); err != nil {
@@ -201,7 +209,7 @@ func (o *matrixSelector) Next(ctx context.Context, buf []model.StepVector) (int,
 				return 0, err
 			}
 			if warn != 0 {
-				emitRingbufferWarnings(ctx, warn, scanner.metricName)
+				ringbuffer.EmitWarnings(ctx, warn, scanner.metricName)
 			}
 			if ok {
 				buf[currStep].T = seriesTs
@@ -404,31 +412,3 @@ func (m *matrixScanner) selectPoints(
 	}
 	return m.iterator.Err()
 }
-
-// emitRingbufferWarnings converts warnings.Warnings flags to proper annotations with metric names.
-func emitRingbufferWarnings(ctx context.Context, warn warnings.Warnings, metricName string) {
-	if warn&warnings.WarnNotCounter != 0 {
-		warnings.AddToContext(annotations.NewNativeHistogramNotCounterWarning(metricName, posrange.PositionRange{}), ctx)
-	}
-	if warn&warnings.WarnNotGauge != 0 {
-		warnings.AddToContext(annotations.NewNativeHistogramNotGaugeWarning(metricName, posrange.PositionRange{}), ctx)
-	}
-	if warn&warnings.WarnMixedFloatsHistograms != 0 {
-		warnings.AddToContext(annotations.NewMixedFloatsHistogramsWarning(metricName, posrange.PositionRange{}), ctx)
-	}
-	if warn&warnings.WarnMixedExponentialCustomBuckets != 0 {
-		warnings.AddToContext(annotations.NewMixedExponentialCustomHistogramsWarning(metricName, posrange.PositionRange{}), ctx)
-	}
-	if warn&warnings.WarnHistogramIgnoredInMixedRange != 0 {
-		warnings.AddToContext(annotations.NewHistogramIgnoredInMixedRangeInfo(metricName, posrange.PositionRange{}), ctx)
-	}
-	if warn&warnings.WarnCounterResetCollision != 0 {
-		warnings.AddToContext(annotations.NewHistogramCounterResetCollisionWarning(posrange.PositionRange{}, annotations.HistogramAgg), ctx)
-	}
-	if warn&warnings.WarnNHCBBoundsReconciled != 0 {
-		warnings.AddToContext(annotations.NewMismatchedCustomBucketsHistogramsInfo(posrange.PositionRange{}, annotations.HistogramSub), ctx)
-	}
-	if warn&warnings.WarnNHCBBoundsReconciledAgg != 0 {
-		warnings.AddToContext(annotations.NewMismatchedCustomBucketsHistogramsInfo(posrange.PositionRange{}, annotations.HistogramAgg), ctx)
-	}
-}
@@ -146,6 +146,7 @@ func (p Scanners) NewMatrixSelector(
 			opts,
 			logicalNode.Range,
 			vs.Offset,
+			vs.Timestamp != nil,
 			vs.BatchSize,
 			i,
 			opts.DecodingConcurrency,
@@ -87,7 +87,7 @@ func NewVectorSelector(
 		o.step = 1
 	}
 
-	o.telemetry = telemetry.NewTelemetry(o, queryOpts)
+	o.telemetry = telemetry.NewTelemetry(o, "vectorSelector", queryOpts)
 	return telemetry.NewOperator(o.telemetry, o)
 }
 
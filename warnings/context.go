@@ -8,19 +8,109 @@ import (
 	"fmt"
 	"maps"
 	"sync"
+	"time"
 
 	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/util/annotations"
 )
 
+//lint:file-ignore faillint Annotations wrap the errors of Prometheus with fmt.Errorf, since errors.Wrapf would move the "PromQL info:" and "PromQL warning:" prefixes to the end of their messages.
+
 // MixedFloatsHistogramsAggWarning is used when an aggregation encounters both floats and histograms.
 // We define this here because Prometheus's NewMixedFloatsHistogramsAggWarning requires a posrange
 // which we don't have at the accumulator level.
-//
-//lint:ignore faillint We need fmt.Errorf to match Prometheus error format exactly.
 var MixedFloatsHistogramsAggWarning = fmt.Errorf("%w aggregation", annotations.MixedFloatsHistogramsWarning)
 
+// HistogramIgnoredInFunctionInfo is used when a function which only operates on floats receives a histogram.
+// Prometheus drops such histograms silently, so there is no upstream annotation for this case.
+var HistogramIgnoredInFunctionInfo = fmt.Errorf("%w: ignored histogram in", annotations.PromQLInfo)
+
+// NewHistogramIgnoredInFunctionInfo is used when a histogram is ignored by a function.
+func NewHistogramIgnoredInFunctionInfo(funcName string) error {
+	return fmt.Errorf("%w %s function", HistogramIgnoredInFunctionInfo, funcName)
+}
+
+// HistogramResolutionReducedInfo is used when the resolution of a histogram produced by a binary
+// operation was reduced to respect the configured bucket limit.
+var HistogramResolutionReducedInfo = fmt.Errorf("%w: reduced resolution of histogram", annotations.PromQLInfo)
+
+// NewHistogramResolutionReducedInfo is used when a histogram result exceeded the bucket limit.
+func NewHistogramResolutionReducedInfo(opName string, maxBuckets int) error {
+	return fmt.Errorf("%w produced by %s operation to at most %d buckets", HistogramResolutionReducedInfo, opName, maxBuckets)
+}
+
+// AnnotationsTruncatedWarning is used when a query produced more annotations than it is allowed to retain.
+var AnnotationsTruncatedWarning = fmt.Errorf("%w: annotations truncated", annotations.PromQLWarning)
+
+// NewAnnotationsTruncatedWarning is used when annotations were dropped after reaching the limit.
+func NewAnnotationsTruncatedWarning(limit int) error {
+	return fmt.Errorf("%w, only the first %d annotations were retained", AnnotationsTruncatedWarning, limit)
+}
+
+// HistogramFractionInvertedBoundsInfo is used when histogram_fraction is called with a lower bound
+// that is greater than its upper bound. Prometheus returns 0 rather than NaN in this case, for native
+// and classic histograms alike, and does not add an annotation.
+var HistogramFractionInvertedBoundsInfo = fmt.Errorf("%w: lower bound of histogram_fraction is greater than its upper bound", annotations.PromQLInfo)
+
+// NewHistogramFractionInvertedBoundsInfo is used when the bounds of histogram_fraction are inverted.
+func NewHistogramFractionInvertedBoundsInfo(lower, upper float64) error {
+	return fmt.Errorf("%w, got lower bound %g and upper bound %g", HistogramFractionInvertedBoundsInfo, lower, upper)
+}
+
+// HistogramSchemaReducedInfo is used when histograms with different exponential schemas were
+// combined and the higher resolution histogram had to be downscaled to the common schema.
+var HistogramSchemaReducedInfo = fmt.Errorf("%w: reduced schema of histograms with different resolutions", annotations.PromQLInfo)
+
+// NewHistogramSchemaReducedInfo is used when an operation downscaled a histogram to a common schema.
+func NewHistogramSchemaReducedInfo(opName string) error {
+	return fmt.Errorf("%w in %s operation", HistogramSchemaReducedInfo, opName)
+}
+
+// HistogramNaNSumInfo is used when a function derives its result from the sum of a histogram whose sum is NaN.
+// Prometheus returns NaN in this case without an annotation.
+var HistogramNaNSumInfo = fmt.Errorf("%w: histogram with NaN sum in", annotations.PromQLInfo)
+
+// NewHistogramNaNSumInfo is used when a function encountered a histogram with a NaN sum.
+func NewHistogramNaNSumInfo(funcName, metricName string) error {
+	return fmt.Errorf("%w %s function for metric name %q", HistogramNaNSumInfo, funcName, metricName)
+}
+
+// OperatorTimeBudgetExceededInfo is used when an operator spent more time in Next than the configured budget.
+var OperatorTimeBudgetExceededInfo = fmt.Errorf("%w: operator exceeded its time budget", annotations.PromQLInfo)
+
+// NewOperatorTimeBudgetExceededInfo is used when an operator exceeded its time budget.
+func NewOperatorTimeBudgetExceededInfo(opName string, budget time.Duration) error {
+	return fmt.Errorf("%w of %s in %s operator", OperatorTimeBudgetExceededInfo, budget, opName)
+}
+
+// CountValuesHistogramInfo is used when count_values counts native histograms. Prometheus uses the
+// string representation of histograms as label values in this case without an annotation.
+var CountValuesHistogramInfo = fmt.Errorf("%w: count_values used the string representation of native histograms as label values", annotations.PromQLInfo)
+
+// NewCountValuesHistogramInfo is used when count_values encountered a native histogram.
+func NewCountValuesHistogramInfo(metricName string) error {
+	return fmt.Errorf("%w for metric name %q", CountValuesHistogramInfo, metricName)
+}
+
+// ImplicitManyToOneInfo is used when a one-to-one binary operation matched multiple series on the
+// high-card side and only the first match was kept. Prometheus fails the query in this case.
+var ImplicitManyToOneInfo = fmt.Errorf("%w: multiple matches for labels, many-to-one matching must be explicit (group_left/group_right)", annotations.PromQLInfo)
+
+// NewImplicitManyToOneInfo is used when a binary operation kept the first of multiple matches.
+func NewImplicitManyToOneInfo(opName string) error {
+	return fmt.Errorf("%w, keeping the first match in %s operation", ImplicitManyToOneInfo, opName)
+}
+
+// ManyToManyMatchSkippedWarning is used when a matching group of a binary operation matched multiple series
+// on the side which needs to be unique and was left out of the result. Prometheus fails the query in this case.
+var ManyToManyMatchSkippedWarning = fmt.Errorf("%w: skipped matching group with multiple matches", annotations.PromQLWarning)
+
+// NewManyToManyMatchSkippedWarning is used when a binary operation skipped a matching group instead of failing.
+func NewManyToManyMatchSkippedWarning(opName string, err error) error {
+	return fmt.Errorf("%w in %s operation: %s", ManyToManyMatchSkippedWarning, opName, err.Error())
+}
+
 // Warnings is a bitset of warning flags that can be returned by functions
 // to indicate warning conditions. The actual warning messages with metric
 // names are emitted by operators that have access to series labels.
@@ -37,8 +127,28 @@ const (
 	WarnNHCBBoundsReconciled    // for subtraction operations (rate, irate, delta)
 	WarnNHCBBoundsReconciledAgg // for aggregation operations (sum, avg, sum_over_time, avg_over_time)
 	WarnIncompatibleTypesInBinOp
+	WarnHistogramSchemaReduced // for binary operations between histograms with different exponential schemas
 )
 
+// Dedup tracks warning flags which were already reported. Operators evaluating many steps can use it
+// to add each annotation to the context only once instead of formatting it again for every sample.
+// It is not safe for concurrent use.
+type Dedup struct {
+	seen Warnings
+}
+
+// Suppress marks warns as seen, so that Filter never returns them.
+func (d *Dedup) Suppress(warns Warnings) {
+	d.seen |= warns
+}
+
+// Filter returns the flags of warns which were not passed to Filter before and marks them as seen.
+func (d *Dedup) Filter(warns Warnings) Warnings {
+	unseen := warns &^ d.seen
+	d.seen |= warns
+	return unseen
+}
+
 type warningKey string
 
 const key warningKey = "promql-warnings"
@@ -46,16 +156,33 @@ const key warningKey = "promql-warnings"
 type warnings struct {
 	mu    sync.Mutex
 	warns annotations.Annotations
+	// limit is the maximum number of retained annotations, zero means no limit.
+	limit     int
+	truncated bool
 }
 
-func newWarnings() *warnings {
-	return &warnings{warns: annotations.Annotations{}}
+func newWarnings(limit int) *warnings {
+	return &warnings{warns: annotations.Annotations{}, limit: limit}
 }
 
 func (w *warnings) add(warns error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	w.warns = w.warns.Add(warns)
+	w.addLocked(warns)
+}
+
+func (w *warnings) addLocked(warn error) {
+	if w.limit > 0 && len(w.warns) >= w.limit {
+		// Annotations are deduplicated by their message, so adding a retained one again is fine.
+		if _, ok := w.warns[warn.Error()]; !ok {
+			if !w.truncated {
+				w.truncated = true
+				w.warns = w.warns.Add(NewAnnotationsTruncatedWarning(w.limit))
+			}
+			return
+		}
+	}
+	w.warns = w.warns.Add(warn)
 }
 
 func (w *warnings) get() annotations.Annotations {
@@ -67,11 +194,24 @@ func (w *warnings) get() annotations.Annotations {
 func (w *warnings) merge(anno annotations.Annotations) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	w.warns = w.warns.Merge(anno)
+	if w.limit == 0 {
+		w.warns = w.warns.Merge(anno)
+		return
+	}
+	for _, warn := range anno {
+		w.addLocked(warn)
+	}
 }
 
 func NewContext(ctx context.Context) context.Context {
-	return context.WithValue(ctx, key, newWarnings())
+	return NewContextWithLimit(ctx, 0)
+}
+
+// NewContextWithLimit creates a context which retains at most limit distinct annotations.
+// Once the limit is reached, further annotations are replaced by a single truncation warning.
+// A limit of zero means no limit.
+func NewContextWithLimit(ctx context.Context, limit int) context.Context {
+	return context.WithValue(ctx, key, newWarnings(limit))
 }
 
 func AddToContext(warn error, ctx context.Context) {